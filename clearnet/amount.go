@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// maxAmountBits is the largest magnitude an Amount may have, matching the
+// uint256/int256 values used by the custody contract.
+const maxAmountBits = 256
+
+// ErrAmountOutOfRange is returned when a value does not fit into 256 bits.
+var ErrAmountOutOfRange = errors.New("amount out of range")
+
+// Amount represents an arbitrary-precision token amount in the token's smallest unit.
+// The zero value is a valid amount of 0. Amounts are immutable: arithmetic returns new values.
+//
+// In JSON an Amount is encoded as a decimal string; both strings and integer numbers are accepted
+// when decoding. In the database it is stored as NUMERIC(78,0) on PostgreSQL and as decimal text
+// on SQLite, so no precision is lost in either backend.
+type Amount struct {
+	v *big.Int
+}
+
+// NewAmount creates an Amount from an int64 value
+func NewAmount(v int64) Amount {
+	return Amount{v: big.NewInt(v)}
+}
+
+// NewAmountFromBig creates an Amount from a big.Int, rejecting values wider than 256 bits
+func NewAmountFromBig(v *big.Int) (Amount, error) {
+	if v == nil {
+		return Amount{}, nil
+	}
+	if v.BitLen() > maxAmountBits {
+		return Amount{}, ErrAmountOutOfRange
+	}
+	return Amount{v: new(big.Int).Set(v)}, nil
+}
+
+// ParseAmount parses a base 10 integer string into an Amount
+func ParseAmount(s string) (Amount, error) {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount %q", s)
+	}
+	return NewAmountFromBig(v)
+}
+
+// Big returns a copy of the amount as a big.Int
+func (a Amount) Big() *big.Int {
+	if a.v == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(a.v)
+}
+
+// Add returns a + b
+func (a Amount) Add(b Amount) Amount {
+	return Amount{v: new(big.Int).Add(a.Big(), b.Big())}
+}
+
+// Sub returns a - b
+func (a Amount) Sub(b Amount) Amount {
+	return Amount{v: new(big.Int).Sub(a.Big(), b.Big())}
+}
+
+// Neg returns -a
+func (a Amount) Neg() Amount {
+	return Amount{v: new(big.Int).Neg(a.Big())}
+}
+
+// Cmp compares a and b and returns -1, 0 or +1
+func (a Amount) Cmp(b Amount) int {
+	return a.Big().Cmp(b.Big())
+}
+
+// Sign returns -1, 0 or +1 depending on the sign of a
+func (a Amount) Sign() int {
+	if a.v == nil {
+		return 0
+	}
+	return a.v.Sign()
+}
+
+// IsZero reports whether a is 0
+func (a Amount) IsZero() bool {
+	return a.Sign() == 0
+}
+
+// String returns the base 10 representation of the amount
+func (a Amount) String() string {
+	if a.v == nil {
+		return "0"
+	}
+	return a.v.String()
+}
+
+// MarshalJSON encodes the amount as a decimal string
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON decodes an amount from a decimal string or an integer number
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Scan implements the sql.Scanner interface
+func (a *Amount) Scan(value any) error {
+	var parsed Amount
+	var err error
+
+	switch v := value.(type) {
+	case nil:
+		parsed = Amount{}
+	case int64:
+		parsed = NewAmount(v)
+	case string:
+		parsed, err = ParseAmount(v)
+	case []byte:
+		parsed, err = ParseAmount(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Amount", value)
+	}
+
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Value implements the driver.Valuer interface
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// GormDBDataType picks a column type that can hold a full 256-bit value for each dialect.
+// SQLite would coerce large NUMERIC values to REAL, so amounts are kept as text there.
+func (Amount) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "numeric(78,0)"
+	default:
+		return "text"
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAmountJSON tests that amounts are encoded as strings and decoded without truncation
+func TestAmountJSON(t *testing.T) {
+	var amounts []Amount
+	require.NoError(t, json.Unmarshal([]byte(`["123000000000000000000", 42, "-7"]`), &amounts))
+	require.Len(t, amounts, 3)
+	assert.Equal(t, "123000000000000000000", amounts[0].String())
+	assert.Equal(t, "42", amounts[1].String())
+	assert.Equal(t, "-7", amounts[2].String())
+
+	encoded, err := json.Marshal(amounts)
+	require.NoError(t, err)
+	assert.Equal(t, `["123000000000000000000","42","-7"]`, string(encoded))
+
+	// Fractions, exponents and values wider than 256 bits are rejected
+	var a Amount
+	assert.Error(t, json.Unmarshal([]byte(`"1.5"`), &a))
+	assert.Error(t, json.Unmarshal([]byte(`1e18`), &a))
+
+	tooLarge := new(big.Int).Lsh(big.NewInt(1), 256)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`"`+tooLarge.String()+`"`), &a), ErrAmountOutOfRange)
+	_, err = NewAmountFromBig(tooLarge)
+	assert.ErrorIs(t, err, ErrAmountOutOfRange)
+}
+
+// TestAmountRPCParams tests that large numeric params survive RPC message parsing
+func TestAmountRPCParams(t *testing.T) {
+	msg := []byte(`{"req":[1,"create_app_session",[{"allocations":[123456789012345678901234567890,"5"]}],1619123456789],"int":["123456789012345678901234567890",5],"sig":[]}`)
+
+	rpc, err := ParseRPCMessage(msg)
+	require.NoError(t, err)
+	require.Len(t, rpc.Intent, 2)
+	assert.Equal(t, "123456789012345678901234567890", rpc.Intent[0].String())
+
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	require.NoError(t, err)
+
+	var params CreateApplicationParams
+	require.NoError(t, json.Unmarshal(paramsJSON, &params))
+	require.Len(t, params.Allocations, 2)
+	assert.Equal(t, "123456789012345678901234567890", params.Allocations[0].String())
+	assert.Equal(t, "5", params.Allocations[1].String())
+}
+
+// TestAmountLedger tests that the ledger stores and sums amounts beyond the int64 range
+func TestAmountLedger(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	account := ledger.SelectBeneficiaryAccount("0xChannel", "0xParticipant", "0xToken")
+
+	// 100 tokens with 18 decimals overflows int64
+	hundredTokens, err := ParseAmount("100000000000000000000")
+	require.NoError(t, err)
+	require.NoError(t, ledger.Deposit(account, hundredTokens, "test"))
+	require.NoError(t, ledger.Deposit(account, hundredTokens, "test"))
+	require.NoError(t, ledger.Withdraw(account, NewAmount(1), "test"))
+
+	balance, err := account.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "199999999999999999999", balance.String())
+
+	balances, err := GetAccountBalances(db, "0xChannel", "")
+	require.NoError(t, err)
+	require.Len(t, balances, 1)
+	assert.Equal(t, "199999999999999999999", balances[0].Amount.String())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// StateRootStatus represents the publication state of a state root
+type StateRootStatus string
+
+var (
+	StateRootStatusPending   StateRootStatus = "pending"   // Stored, but not yet sent on-chain
+	StateRootStatusPublished StateRootStatus = "published" // Sent on-chain in TxHash
+	StateRootStatusFailed    StateRootStatus = "failed"    // Sending the commitment failed
+)
+
+// StateRoot is a Merkle root over all account balances after a given ledger entry
+type StateRoot struct {
+	ID          uint            `gorm:"primaryKey"`
+	Root        string          `gorm:"column:root;not null;index"`
+	LastEntryID uint            `gorm:"column:last_entry_id;not null"` // Balances include all entries up to this ID
+	LeafCount   int             `gorm:"column:leaf_count;not null"`
+	Network     string          `gorm:"column:network;not null"` // Chain ID of the network the root is published on
+	Status      StateRootStatus `gorm:"column:status;not null"`
+	TxHash      string          `gorm:"column:tx_hash;not null;default:''"`
+	CreatedAt   time.Time
+	PublishedAt *time.Time
+}
+
+// TableName specifies the table name for the StateRoot model
+func (StateRoot) TableName() string {
+	return "state_roots"
+}
+
+// StateRootProof proves the balance of an account against a state root
+type StateRootProof struct {
+	ID          uint           `gorm:"primaryKey"`
+	StateRootID uint           `gorm:"column:state_root_id;not null;index:idx_state_root_proofs_account"`
+	AccountID   string         `gorm:"column:account_id;not null;index:idx_state_root_proofs_account"`
+	Beneficiary string         `gorm:"column:beneficiary;not null;index:idx_state_root_proofs_account"`
+	Asset       string         `gorm:"column:asset;not null;index:idx_state_root_proofs_account"`
+	Balance     Amount         `gorm:"column:balance;not null"`
+	LeafIndex   int            `gorm:"column:leaf_index;not null"`
+	Proof       pq.StringArray `gorm:"type:text[];column:proof"` // Sibling hashes from the leaf up to the root
+}
+
+// TableName specifies the table name for the StateRootProof model
+func (StateRootProof) TableName() string {
+	return "state_root_proofs"
+}
+
+// stateLeafArgs is the ABI encoding of a balance leaf: account ID, beneficiary, asset and balance
+var stateLeafArgs = func() abi.Arguments {
+	stringType, _ := abi.NewType("string", "", nil)
+	int256Type, _ := abi.NewType("int256", "", nil)
+	return abi.Arguments{{Type: stringType}, {Type: stringType}, {Type: stringType}, {Type: int256Type}}
+}()
+
+// StateLeaf computes the Merkle leaf of an account balance as keccak256(keccak256(abi.encode(account, beneficiary, asset, balance))).
+// Hashing twice keeps leaves distinct from inner nodes.
+func StateLeaf(accountID, beneficiary, asset string, balance Amount) (common.Hash, error) {
+	encoded, err := stateLeafArgs.Pack(accountID, beneficiary, asset, balance.Big())
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to encode balance leaf: %w", err)
+	}
+	return crypto.Keccak256Hash(crypto.Keccak256(encoded)), nil
+}
+
+// snapshotBalances returns the last entry of every account up to and including lastEntryID,
+// whose running balances form the ledger state at that point. Entries are sorted by account.
+func snapshotBalances(db *gorm.DB, lastEntryID uint) ([]Entry, error) {
+	latest := db.Model(&Entry{}).Select("MAX(id)").Where("id <= ?", lastEntryID).Group("account_id, beneficiary, asset")
+
+	var entries []Entry
+	if err := db.Where("id IN (?)", latest).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].AccountID != entries[j].AccountID {
+			return entries[i].AccountID < entries[j].AccountID
+		}
+		if entries[i].Beneficiary != entries[j].Beneficiary {
+			return entries[i].Beneficiary < entries[j].Beneficiary
+		}
+		return entries[i].Asset < entries[j].Asset
+	})
+	return entries, nil
+}
+
+// stateRootPublisher sends a state root commitment on-chain
+type stateRootPublisher interface {
+	PublishStateRoot(ctx context.Context, root common.Hash, contract common.Address) (common.Hash, error)
+}
+
+// StateAnchor periodically commits the Merkle root of all ledger balances on-chain
+type StateAnchor struct {
+	ledger    *Ledger
+	publisher stateRootPublisher
+	network   string
+	contract  common.Address // Zero to publish the root as calldata
+}
+
+// applyStateRootTx follows the transaction of a published state root through replacements,
+// and marks the root failed if the transaction failed, so that the next root is published in its place
+func applyStateRootTx(tx *gorm.DB, otx *OutboundTx, previousHash string) error {
+	if previousHash == "" {
+		return nil
+	}
+	if previousHash != otx.TxHash {
+		if err := tx.Model(&StateRoot{}).Where("tx_hash = ?", previousHash).Update("tx_hash", otx.TxHash).Error; err != nil {
+			return fmt.Errorf("failed to update state root transaction: %w", err)
+		}
+	}
+	if otx.Status != OutboundTxFailed {
+		return nil
+	}
+
+	err := tx.Model(&StateRoot{}).Where("tx_hash = ? AND status = ?", otx.TxHash, StateRootStatusPublished).
+		Update("status", StateRootStatusFailed).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark state root failed: %w", err)
+	}
+	return nil
+}
+
+// NewStateAnchor creates a state anchor publishing through the given custody client
+func NewStateAnchor(ledger *Ledger, custody *Custody, contract common.Address) *StateAnchor {
+	return &StateAnchor{
+		ledger:    ledger,
+		publisher: custody,
+		network:   custody.networkID,
+		contract:  contract,
+	}
+}
+
+// ComputeStateRoot stores the Merkle root of all balances at the latest ledger entry, with the inclusion proof of every account.
+// It returns nil if no entry was recorded since the last published root.
+func (a *StateAnchor) ComputeStateRoot() (*StateRoot, error) {
+	db := a.ledger.db
+
+	var lastEntryID *uint
+	if err := db.Model(&Entry{}).Select("MAX(id)").Scan(&lastEntryID).Error; err != nil {
+		return nil, err
+	}
+	if lastEntryID == nil {
+		return nil, nil
+	}
+
+	// Roots that failed to publish are retried with the current state
+	var previous []StateRoot
+	if err := db.Where("status = ?", StateRootStatusPublished).Order("id DESC").Limit(1).Find(&previous).Error; err != nil {
+		return nil, err
+	}
+	if len(previous) > 0 && previous[0].LastEntryID >= *lastEntryID {
+		return nil, nil
+	}
+
+	entries, err := snapshotBalances(db, *lastEntryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+
+	leaves := make([]common.Hash, len(entries))
+	for i, entry := range entries {
+		leaves[i], err = StateLeaf(entry.AccountID, entry.Beneficiary, entry.Asset, entry.Balance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tree := NewMerkleTree(leaves)
+
+	stateRoot := &StateRoot{
+		Root:        tree.Root().Hex(),
+		LastEntryID: *lastEntryID,
+		LeafCount:   len(leaves),
+		Network:     a.network,
+		Status:      StateRootStatusPending,
+		CreatedAt:   time.Now(),
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(stateRoot).Error; err != nil {
+			return err
+		}
+
+		proofs := make([]StateRootProof, len(entries))
+		for i, entry := range entries {
+			proof := pq.StringArray{}
+			for _, sibling := range tree.Proof(i) {
+				proof = append(proof, sibling.Hex())
+			}
+			proofs[i] = StateRootProof{
+				StateRootID: stateRoot.ID,
+				AccountID:   entry.AccountID,
+				Beneficiary: entry.Beneficiary,
+				Asset:       entry.Asset,
+				Balance:     entry.Balance,
+				LeafIndex:   i,
+				Proof:       proof,
+			}
+		}
+		if len(proofs) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(proofs, 500).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store state root: %w", err)
+	}
+
+	return stateRoot, nil
+}
+
+// Anchor computes a new state root and publishes it on-chain
+func (a *StateAnchor) Anchor(ctx context.Context) (*StateRoot, error) {
+	stateRoot, err := a.ComputeStateRoot()
+	if err != nil || stateRoot == nil {
+		return nil, err
+	}
+
+	txHash, err := a.publisher.PublishStateRoot(ctx, common.HexToHash(stateRoot.Root), a.contract)
+	if err != nil {
+		if updateErr := a.ledger.db.Model(stateRoot).Update("status", StateRootStatusFailed).Error; updateErr != nil {
+			return stateRoot, fmt.Errorf("failed to publish state root: %w, and to record the failure: %v", err, updateErr)
+		}
+		return stateRoot, fmt.Errorf("failed to publish state root: %w", err)
+	}
+
+	publishedAt := time.Now()
+	stateRoot.Status = StateRootStatusPublished
+	stateRoot.TxHash = txHash.Hex()
+	stateRoot.PublishedAt = &publishedAt
+	if err := a.ledger.db.Save(stateRoot).Error; err != nil {
+		return stateRoot, fmt.Errorf("failed to record published state root: %w", err)
+	}
+
+	return stateRoot, nil
+}
+
+// AnchorPeriodically publishes a state root every interval until ctx is done
+func (a *StateAnchor) AnchorPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stateRoot, err := a.Anchor(ctx)
+			if err != nil {
+				log.Printf("Error anchoring state root: %v", err)
+				continue
+			}
+			if stateRoot != nil {
+				log.Printf("Published state root %s over %d balances in tx %s", stateRoot.Root, stateRoot.LeafCount, stateRoot.TxHash)
+			}
+		}
+	}
+}
+
+// GetStateRootProof returns the proof of an account balance against a published state root.
+// If stateRootID is zero, the latest published root is used.
+func GetStateRootProof(db *gorm.DB, stateRootID uint, accountID, beneficiary, asset string) (*StateRoot, *StateRootProof, error) {
+	var stateRoot StateRoot
+	query := db.Where("status = ?", StateRootStatusPublished)
+	if stateRootID > 0 {
+		query = query.Where("id = ?", stateRootID)
+	}
+	if err := query.Order("id DESC").First(&stateRoot).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errors.New("state root not found")
+		}
+		return nil, nil, err
+	}
+
+	var proof StateRootProof
+	err := db.Where("state_root_id = ? AND account_id = ? AND beneficiary = ? AND asset = ?",
+		stateRoot.ID, accountID, beneficiary, asset).First(&proof).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errors.New("account is not included in the state root")
+		}
+		return nil, nil, err
+	}
+
+	return &stateRoot, &proof, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRootPublisher records published state roots instead of sending transactions
+type fakeRootPublisher struct {
+	roots []common.Hash
+	err   error
+}
+
+func (p *fakeRootPublisher) PublishStateRoot(ctx context.Context, root common.Hash, contract common.Address) (common.Hash, error) {
+	if p.err != nil {
+		return common.Hash{}, p.err
+	}
+	p.roots = append(p.roots, root)
+	return crypto.Keccak256Hash(root[:]), nil
+}
+
+// TestMerkleTree tests that every leaf can be proven against the root for trees of any size
+func TestMerkleTree(t *testing.T) {
+	assert.Equal(t, common.Hash{}, NewMerkleTree(nil).Root())
+
+	for size := 1; size <= 9; size++ {
+		leaves := make([]common.Hash, size)
+		for i := range leaves {
+			leaves[i] = crypto.Keccak256Hash([]byte{byte(i)})
+		}
+
+		tree := NewMerkleTree(leaves)
+		for i, leaf := range leaves {
+			assert.True(t, VerifyMerkleProof(leaf, tree.Proof(i), tree.Root()), "leaf %d of %d", i, size)
+		}
+		assert.False(t, VerifyMerkleProof(crypto.Keccak256Hash([]byte("other")), tree.Proof(0), tree.Root()))
+	}
+}
+
+// TestStateAnchor tests that state roots are stored with proofs and published
+func TestStateAnchor(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	publisher := &fakeRootPublisher{}
+	anchor := &StateAnchor{ledger: ledger, publisher: publisher, network: "137"}
+
+	// Nothing to anchor in an empty ledger
+	stateRoot, err := anchor.Anchor(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, stateRoot)
+
+	alice := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, alice.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(40)))
+
+	stateRoot, err = anchor.Anchor(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, stateRoot)
+	assert.Equal(t, StateRootStatusPublished, stateRoot.Status)
+	assert.Equal(t, 3, stateRoot.LeafCount) // Channel, app and custody accounts
+	require.Len(t, publisher.roots, 1)
+	assert.Equal(t, publisher.roots[0].Hex(), stateRoot.Root)
+
+	// The stored proof verifies the balance against the published root
+	root, proof, err := GetStateRootProof(db, 0, "0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, err)
+	assert.Equal(t, stateRoot.ID, root.ID)
+	assert.Equal(t, "60", proof.Balance.String())
+
+	leaf, err := StateLeaf("0xChannel", "0xAlice", "0xUSDC", NewAmount(60))
+	require.NoError(t, err)
+	var siblings []common.Hash
+	for _, sibling := range proof.Proof {
+		siblings = append(siblings, common.HexToHash(sibling))
+	}
+	assert.True(t, VerifyMerkleProof(leaf, siblings, common.HexToHash(root.Root)))
+
+	// Users get the proofs of their own balances through the RPC
+	rpcRequest := &RPCRequest{
+		Req: RPCData{
+			RequestID: 1,
+			Method:    "get_state_proof",
+			Params:    []any{GetStateProofParams{AccountID: "0xChannel", Beneficiary: "0xAlice", Asset: "0xUSDC"}},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	response, err := HandleGetStateProof(rpcRequest, ledger, "0xalice")
+	require.NoError(t, err)
+	assert.Equal(t, leaf.Hex(), response.Res.Params[0].(StateProofResponse).Leaf)
+	_, err = HandleGetStateProof(rpcRequest, ledger, "0xBob")
+	assert.Error(t, err)
+
+	// No new root is published while the ledger is unchanged
+	stateRoot, err = anchor.Anchor(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, stateRoot)
+
+	// Failed publications are recorded and not served as proofs
+	require.NoError(t, ledger.Deposit(alice, NewAmount(1), "test"))
+	publisher.err = errors.New("rpc unavailable")
+	stateRoot, err = anchor.Anchor(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, StateRootStatusFailed, stateRoot.Status)
+
+	root, _, err = GetStateRootProof(db, 0, "0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, err)
+	assert.Equal(t, publisher.roots[0].Hex(), root.Root)
+
+	// The next run retries with the current state
+	publisher.err = nil
+	stateRoot, err = anchor.Anchor(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, stateRoot)
+	assert.Len(t, publisher.roots, 2)
+}
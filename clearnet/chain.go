@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Hash chains make the ledger and rpc_store tables tamper-evident.
+// Every record stores the hash of the previous record of its table and the hash of its own content
+// chained to it, so editing, deleting or reordering records breaks the chain from that point on.
+const (
+	ledgerChain = "ledger"
+	rpcChain    = "rpc_store"
+)
+
+// hashChains lists the chained tables in the order they are verified
+var hashChains = []string{ledgerChain, rpcChain}
+
+// chainBatchSize is the number of records loaded at once while walking a chain
+const chainBatchSize = 1000
+
+// ChainHead stores the hash of the last record of a hash chain.
+// Writers lock the head row while appending, which keeps record IDs in chain order.
+// The lock is held until the writing transaction commits, so appends to a chain are serialized:
+// the throughput of a chain is bounded by one commit round trip per transaction, whatever the accounts involved.
+type ChainHead struct {
+	Name      string `gorm:"primaryKey"`
+	Hash      string `gorm:"column:hash;not null"`
+	UpdatedAt time.Time
+}
+
+// TableName specifies the table name for the ChainHead model
+func (ChainHead) TableName() string {
+	return "hash_chain_heads"
+}
+
+// chainRecord is a record that is part of a hash chain
+type chainRecord interface {
+	recordID() uint
+	chainContent() ([]byte, error)
+	chainLinks() (prevHash, hash string)
+}
+
+// ChainBreak describes the first record at which a hash chain no longer verifies
+type ChainBreak struct {
+	Chain    string
+	RecordID uint // Zero if the chain ends before its head
+	Reason   string
+}
+
+// chainHash computes the hash of a record from the hash of the previous record and the record content
+func chainHash(prevHash string, content []byte) string {
+	return hexutil.Encode(crypto.Keccak256([]byte(prevHash), content))
+}
+
+// linkRecord computes the hash of a record appended after prevHash
+func linkRecord(prevHash string, record chainRecord) (string, error) {
+	content, err := record.chainContent()
+	if err != nil {
+		return "", fmt.Errorf("failed to encode record for hashing: %w", err)
+	}
+	return chainHash(prevHash, content), nil
+}
+
+// lockChainHead locks the head of a hash chain for the rest of tx and returns it.
+// A missing head starts a new chain; setupDatabase creates heads with initHashChain before any records are written.
+func lockChainHead(tx *gorm.DB, name string) (*ChainHead, error) {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ChainHead{Name: name, UpdatedAt: time.Now()}).Error; err != nil {
+		return nil, fmt.Errorf("failed to create %s chain head: %w", name, err)
+	}
+
+	if err := tx.Model(&ChainHead{}).Where("name = ?", name).Update("updated_at", time.Now()).Error; err != nil {
+		return nil, fmt.Errorf("failed to lock %s chain head: %w", name, err)
+	}
+
+	var head ChainHead
+	if err := tx.Where("name = ?", name).First(&head).Error; err != nil {
+		return nil, fmt.Errorf("failed to read %s chain head: %w", name, err)
+	}
+	return &head, nil
+}
+
+// saveChainHead stores the hash of the last record appended to the chain
+func saveChainHead(tx *gorm.DB, head *ChainHead) error {
+	return tx.Model(head).Update("hash", head.Hash).Error
+}
+
+// loadChainRecords returns up to limit records of a chain with IDs greater than afterID, in chain order
+func loadChainRecords(db *gorm.DB, name string, afterID uint, limit int) ([]chainRecord, error) {
+	var records []chainRecord
+	switch name {
+	case ledgerChain:
+		var entries []Entry
+		if err := db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&entries).Error; err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			records = append(records, &entries[i])
+		}
+	case rpcChain:
+		var messages []RPCRecord
+		if err := db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&messages).Error; err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			records = append(records, &messages[i])
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash chain %s", name)
+	}
+	return records, nil
+}
+
+// initHashChain creates the head of a hash chain.
+// Records written before the chain existed are linked in ID order, anchoring the chain at migration time.
+func initHashChain(db *gorm.DB, name string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var heads []ChainHead
+		if err := tx.Where("name = ?", name).Limit(1).Find(&heads).Error; err != nil {
+			return err
+		}
+		if len(heads) > 0 {
+			return nil
+		}
+
+		head := ChainHead{Name: name, UpdatedAt: time.Now()}
+		var lastID uint
+		for {
+			records, err := loadChainRecords(tx, name, lastID, chainBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				break
+			}
+
+			for _, record := range records {
+				hash, err := linkRecord(head.Hash, record)
+				if err != nil {
+					return err
+				}
+				err = tx.Table(name).Where("id = ?", record.recordID()).
+					Updates(map[string]any{"prev_hash": head.Hash, "hash": hash}).Error
+				if err != nil {
+					return err
+				}
+				head.Hash = hash
+				lastID = record.recordID()
+			}
+		}
+
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&head).Error
+	})
+}
+
+// VerifyHashChain walks a hash chain from its first record and returns the first broken link, or nil if the chain is intact
+func VerifyHashChain(db *gorm.DB, name string) (*ChainBreak, error) {
+	var head ChainHead
+	if err := db.Where("name = ?", name).First(&head).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &ChainBreak{Chain: name, Reason: "chain head is missing"}, nil
+		}
+		return nil, err
+	}
+
+	var prevHash string
+	var lastID uint
+	for {
+		records, err := loadChainRecords(db, name, lastID, chainBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			recordPrev, recordHash := record.chainLinks()
+			if recordPrev != prevHash {
+				return &ChainBreak{Chain: name, RecordID: record.recordID(),
+					Reason: fmt.Sprintf("previous hash %s does not match %s", recordPrev, prevHash)}, nil
+			}
+
+			hash, err := linkRecord(prevHash, record)
+			if err != nil {
+				return nil, err
+			}
+			if hash != recordHash {
+				return &ChainBreak{Chain: name, RecordID: record.recordID(),
+					Reason: fmt.Sprintf("content hash %s does not match stored hash %s", hash, recordHash)}, nil
+			}
+
+			prevHash = recordHash
+			lastID = record.recordID()
+		}
+	}
+
+	// Records removed from the end of the chain leave the head pointing past the last record
+	if head.Hash != prevHash {
+		return &ChainBreak{Chain: name, Reason: fmt.Sprintf("last record hash %s does not match chain head %s", prevHash, head.Hash)}, nil
+	}
+
+	return nil, nil
+}
+
+func (e *Entry) recordID() uint {
+	return e.ID
+}
+
+func (e *Entry) chainLinks() (string, string) {
+	return e.PrevHash, e.Hash
+}
+
+// chainContent encodes the fields of the entry covered by its hash
+func (e *Entry) chainContent() ([]byte, error) {
+	return json.Marshal([]any{
+		e.TransactionID,
+		e.AccountID,
+		e.Beneficiary,
+		e.Asset,
+		e.Credit.String(),
+		e.Debit.String(),
+		e.Balance.String(),
+		e.CreatedAt.UnixMicro(),
+	})
+}
+
+func (r *RPCRecord) recordID() uint {
+	return r.ID
+}
+
+func (r *RPCRecord) chainLinks() (string, string) {
+	return r.PrevHash, r.Hash
+}
+
+// chainContent encodes the fields of the RPC record covered by its hash
+func (r *RPCRecord) chainContent() ([]byte, error) {
+	return json.Marshal([]any{
+		r.Sender,
+		r.ReqID,
+		r.Method,
+		string(r.Params),
+		r.Timestamp,
+		append([]string{}, r.ReqSig...),
+		string(r.Response),
+		append([]string{}, r.ResSig...),
+	})
+}
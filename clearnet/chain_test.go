@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHashChainVerify tests that edits and deletions of chained records are detected
+func TestHashChainVerify(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	alice := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, alice.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(40)))
+
+	store := NewRPCStore(db)
+	for i := uint64(1); i <= 3; i++ {
+		req := &RPCData{RequestID: i, Method: "ping", Params: []any{}, Timestamp: uint64(time.Now().Unix())}
+		require.NoError(t, store.StoreMessage("0xAlice", req, []string{"sig"}, []byte(`{"res":"pong"}`), nil))
+	}
+
+	for _, name := range hashChains {
+		chainBreak, err := VerifyHashChain(db, name)
+		require.NoError(t, err)
+		assert.Nil(t, chainBreak, name)
+	}
+
+	var entries []Entry
+	require.NoError(t, db.Order("id").Find(&entries).Error)
+	require.Len(t, entries, 4)
+	assert.Empty(t, entries[0].PrevHash)
+	assert.Equal(t, entries[0].Hash, entries[1].PrevHash)
+
+	// Editing an entry breaks the chain at that entry
+	require.NoError(t, db.Model(&Entry{}).Where("id = ?", entries[2].ID).Update("debit", NewAmount(4)).Error)
+	chainBreak, err := VerifyHashChain(db, ledgerChain)
+	require.NoError(t, err)
+	require.NotNil(t, chainBreak)
+	assert.Equal(t, entries[2].ID, chainBreak.RecordID)
+
+	// Deleting the last record leaves the chain head dangling
+	var last RPCRecord
+	require.NoError(t, db.Order("id DESC").First(&last).Error)
+	require.NoError(t, db.Delete(&last).Error)
+	chainBreak, err = VerifyHashChain(db, rpcChain)
+	require.NoError(t, err)
+	require.NotNil(t, chainBreak)
+	assert.Zero(t, chainBreak.RecordID)
+}
+
+// TestHashChainInit tests that records written before the chain existed are linked when it is created
+func TestHashChainInit(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, db.Create(&Entry{AccountID: "0xChannel", Beneficiary: "0xAlice", Asset: "0xUSDC",
+			Credit: NewAmount(i), Balance: NewAmount(i * (i + 1) / 2), CreatedAt: time.Now()}).Error)
+	}
+
+	require.NoError(t, initHashChain(db, ledgerChain))
+	chainBreak, err := VerifyHashChain(db, ledgerChain)
+	require.NoError(t, err)
+	assert.Nil(t, chainBreak)
+
+	// New entries continue the chain
+	ledger := NewLedger(db)
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xChannel", "0xBob", "0xUSDC"), NewAmount(5), "test"))
+	chainBreak, err = VerifyHashChain(db, ledgerChain)
+	require.NoError(t, err)
+	assert.Nil(t, chainBreak)
+}
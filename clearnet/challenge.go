@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ChallengeResponseStatus represents the progress of the broker's response to a channel challenge
+type ChallengeResponseStatus string
+
+var (
+	ChallengeResponsePending   ChallengeResponseStatus = "pending"    // Not yet submitted
+	ChallengeResponseSubmitted ChallengeResponseStatus = "submitted"  // Checkpoint sent in TxHash
+	ChallengeResponseConfirmed ChallengeResponseStatus = "confirmed"  // The checkpoint in TxHash was mined
+	ChallengeResponseUnneeded  ChallengeResponseStatus = "not_needed" // The challenged state is not older than the latest countersigned state
+	ChallengeResponseFailed    ChallengeResponseStatus = "failed"     // Submitting failed, retried until the challenge expires
+	ChallengeResponseMissed    ChallengeResponseStatus = "missed"     // The challenge expired or there was no state to respond with
+)
+
+// ChallengeResponse tracks the response of the broker to a challenge of one of its channels
+type ChallengeResponse struct {
+	ID                uint                    `gorm:"primaryKey"`
+	ChannelID         string                  `gorm:"column:channel_id;not null;uniqueIndex:idx_challenge_responses_challenge"`
+	NetworkID         string                  `gorm:"column:network_id;not null"`
+	ChallengeTxHash   string                  `gorm:"column:challenge_tx_hash;not null;uniqueIndex:idx_challenge_responses_challenge"`
+	ChallengedVersion *uint64                 `gorm:"column:challenged_version"` // Nil if the challenged state could not be read
+	Expiration        time.Time               `gorm:"column:expiration;not null"`
+	StateVersion      uint64                  `gorm:"column:state_version;not null;default:0"` // Version of the state submitted in response
+	Status            ChallengeResponseStatus `gorm:"column:status;not null;index"`
+	TxHash            string                  `gorm:"column:tx_hash;not null;default:''"`
+	Attempts          int                     `gorm:"column:attempts;not null;default:0"`
+	Error             string                  `gorm:"column:error;not null;default:''"` // Reason of the last failure
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// TableName specifies the table name for the ChallengeResponse model
+func (ChallengeResponse) TableName() string {
+	return "challenge_responses"
+}
+
+// checkpointSubmitter reads challenged states and submits countersigned channel states on-chain
+type checkpointSubmitter interface {
+	ChallengedState(ctx context.Context, channelID common.Hash, challengeTxHash common.Hash) (*nitrolite.State, error)
+	Checkpoint(ctx context.Context, channelID common.Hash, state nitrolite.State) (common.Hash, error)
+}
+
+// ChallengeResponder answers challenges made with stale states by checkpointing the latest countersigned state
+type ChallengeResponder struct {
+	db        *gorm.DB
+	submitter checkpointSubmitter
+	network   string
+	wake      chan struct{} // Signals that a challenge was recorded
+}
+
+// NewChallengeResponder creates a challenge responder submitting through the given custody client
+func NewChallengeResponder(db *gorm.DB, custody *Custody) *ChallengeResponder {
+	return &ChallengeResponder{db: db, submitter: custody, network: custody.networkID, wake: make(chan struct{}, 1)}
+}
+
+// applyCheckpointTx follows the checkpoint transaction of a challenge response through replacements,
+// and marks the response failed if the transaction failed, so that it is submitted again
+func applyCheckpointTx(tx *gorm.DB, otx *OutboundTx, previousHash string) error {
+	if previousHash == "" {
+		return nil
+	}
+	if previousHash != otx.TxHash {
+		err := tx.Model(&ChallengeResponse{}).Where("tx_hash = ?", previousHash).Update("tx_hash", otx.TxHash).Error
+		if err != nil {
+			return fmt.Errorf("failed to update challenge response transaction: %w", err)
+		}
+	}
+	if otx.Status != OutboundTxFailed {
+		return nil
+	}
+
+	err := tx.Model(&ChallengeResponse{}).
+		Where("tx_hash = ? AND status = ?", otx.TxHash, ChallengeResponseSubmitted).
+		Updates(map[string]any{"status": ChallengeResponseFailed, "error": "checkpoint transaction failed: " + otx.Error}).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark challenge response failed: %w", err)
+	}
+	return nil
+}
+
+// Notify makes the responder submit pending responses without waiting for the next retry.
+// Call it once the transaction recording a challenge is committed.
+func (r *ChallengeResponder) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RecordChallenge marks the channel challenged and records a pending response to the challenge, in tx.
+// Nothing is read from or sent to the chain: the response is submitted by RetryResponses once tx is committed.
+// If expiration is zero, the challenge period of the channel is used.
+// A challenge that was already recorded is returned as it is.
+func (r *ChallengeResponder) RecordChallenge(tx *gorm.DB, channelID, challengeTxHash string, expiration time.Time) (*ChallengeResponse, error) {
+	channel, err := GetChannelByID(tx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if channel == nil {
+		return nil, fmt.Errorf("channel %s not found", channelID)
+	}
+	if err := TransitionChannel(tx, channel, ChannelStatusChallenged, "challenged", challengeTxHash); err != nil {
+		return nil, err
+	}
+
+	if expiration.IsZero() {
+		expiration = time.Now().Add(time.Duration(channel.Challenge) * time.Second)
+	}
+	response := &ChallengeResponse{
+		ChannelID:       channel.ChannelID,
+		NetworkID:       r.network,
+		ChallengeTxHash: challengeTxHash,
+		Expiration:      expiration,
+		Status:          ChallengeResponsePending,
+	}
+
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(response)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to record challenge: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		err := tx.Where("channel_id = ? AND challenge_tx_hash = ?", channel.ChannelID, challengeTxHash).First(response).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// respond checkpoints the latest countersigned state of the channel if it is newer than the challenged state.
+// The challenged state is read from the challenge transaction; if it cannot be read, the latest state is submitted.
+func (r *ChallengeResponder) respond(ctx context.Context, response *ChallengeResponse) error {
+	if response.ChallengedVersion == nil {
+		challenged, err := r.submitter.ChallengedState(ctx, common.HexToHash(response.ChannelID), common.HexToHash(response.ChallengeTxHash))
+		if err != nil {
+			log.Printf("Error reading challenged state of channel %s, responding with the latest state: %v", response.ChannelID, err)
+		} else if challenged.Version != nil {
+			version := challenged.Version.Uint64()
+			response.ChallengedVersion = &version
+		}
+	}
+
+	latest, err := GetLatestSignedChannelState(r.db, response.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case latest == nil:
+		response.Status = ChallengeResponseMissed
+		response.Error = "no countersigned state to respond with"
+	case response.ChallengedVersion != nil && *response.ChallengedVersion >= latest.Version:
+		response.Status = ChallengeResponseUnneeded
+	case !time.Now().Before(response.Expiration):
+		response.Status = ChallengeResponseMissed
+		response.Error = "challenge expired before a response was submitted"
+	default:
+		state, err := latest.SignedState()
+		if err != nil {
+			return err
+		}
+		response.StateVersion = latest.Version
+		response.Attempts++
+
+		txHash, err := r.submitter.Checkpoint(ctx, common.HexToHash(response.ChannelID), state)
+		if err != nil {
+			response.Status = ChallengeResponseFailed
+			response.Error = err.Error()
+		} else {
+			response.Status = ChallengeResponseSubmitted
+			response.TxHash = txHash.Hex()
+			response.Error = ""
+		}
+	}
+
+	if err := r.db.Save(response).Error; err != nil {
+		return fmt.Errorf("failed to record challenge response: %w", err)
+	}
+	if response.Status == ChallengeResponseFailed {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// RetryResponses responds to the challenges whose response is pending or failed, and returns how many were tried
+func (r *ChallengeResponder) RetryResponses(ctx context.Context) (int, error) {
+	var responses []ChallengeResponse
+	err := r.db.Where("network_id = ? AND status IN ?", r.network, []ChallengeResponseStatus{ChallengeResponsePending, ChallengeResponseFailed}).
+		Order("expiration").Find(&responses).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range responses {
+		if err := r.respond(ctx, &responses[i]); err != nil {
+			log.Printf("Error responding to challenge of channel %s: %v", responses[i].ChannelID, err)
+		}
+	}
+	return len(responses), nil
+}
+
+// RetryPeriodically submits pending and failed challenge responses every interval, and as soon as a challenge
+// is recorded, until ctx is done
+func (r *ChallengeResponder) RetryPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		if _, err := r.RetryResponses(ctx); err != nil {
+			log.Printf("Error retrying challenge responses: %v", err)
+		}
+	}
+}
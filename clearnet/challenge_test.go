@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCheckpointSubmitter records submitted states instead of sending transactions
+type fakeCheckpointSubmitter struct {
+	challenged map[string]*nitrolite.State // By challenge transaction hash
+	states     []nitrolite.State
+	err        error
+}
+
+func (s *fakeCheckpointSubmitter) ChallengedState(ctx context.Context, channelID common.Hash, challengeTxHash common.Hash) (*nitrolite.State, error) {
+	state, ok := s.challenged[challengeTxHash.Hex()]
+	if !ok {
+		return nil, errors.New("transaction not found")
+	}
+	return state, nil
+}
+
+func (s *fakeCheckpointSubmitter) Checkpoint(ctx context.Context, channelID common.Hash, state nitrolite.State) (common.Hash, error) {
+	if s.err != nil {
+		return common.Hash{}, s.err
+	}
+	s.states = append(s.states, state)
+	return crypto.Keccak256Hash(channelID[:], state.Version.Bytes()), nil
+}
+
+// TestChallengeResponse tests that challenges with stale states are answered with the latest countersigned state
+func TestChallengeResponse(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := Signer{privateKey: rawKey}
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := Signer{privateKey: brokerKey}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	require.NoError(t, CreateChannel(db, channelID.Hex(), participant.GetAddress().Hex(), 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+
+	// Version 1 is signed by both parties
+	state := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentRESIZE),
+		Version: big.NewInt(1),
+		Data:    []byte{0x01},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: common.HexToAddress("0xUSDC"), Amount: big.NewInt(60)},
+			{Destination: broker.GetAddress(), Token: common.HexToAddress("0xUSDC"), Amount: big.NewInt(0)},
+		},
+	}
+	encodedState, err := nitrolite.EncodeState(channelID, nitrolite.IntentRESIZE, state.Version, state.Data, state.Allocations)
+	require.NoError(t, err)
+	participantSig, err := participant.NitroSign(encodedState)
+	require.NoError(t, err)
+	brokerSig, err := broker.NitroSign(encodedState)
+	require.NoError(t, err)
+	state.Sigs = []nitrolite.Signature{participantSig}
+	_, err = RecordChannelState(db, channel, state, brokerSig)
+	require.NoError(t, err)
+
+	challengeTx := func(i byte) string { return common.BytesToHash([]byte{i}).Hex() }
+	submitter := &fakeCheckpointSubmitter{challenged: map[string]*nitrolite.State{
+		challengeTx(1): {Version: big.NewInt(0)},
+		challengeTx(2): {Version: big.NewInt(1)},
+		challengeTx(4): {Version: big.NewInt(0)},
+	}}
+	responder := &ChallengeResponder{db: db, submitter: submitter, network: "137"}
+	expiration := time.Now().Add(time.Hour)
+	// handle records a challenge, as the Challenged event does, then submits the pending responses
+	handle := func(i byte, expiration time.Time) *ChallengeResponse {
+		response, err := responder.RecordChallenge(db, channelID.Hex(), challengeTx(i), expiration)
+		require.NoError(t, err)
+		_, err = responder.RetryResponses(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, db.First(response, response.ID).Error)
+		return response
+	}
+
+	// Recording a challenge sends nothing
+	response, err := responder.RecordChallenge(db, channelID.Hex(), challengeTx(1), expiration)
+	require.NoError(t, err)
+	assert.Equal(t, ChallengeResponsePending, response.Status)
+	assert.Empty(t, submitter.states)
+
+	response = handle(1, expiration)
+	assert.Equal(t, ChallengeResponseSubmitted, response.Status)
+	require.NotNil(t, response.ChallengedVersion)
+	assert.Equal(t, uint64(0), *response.ChallengedVersion)
+	assert.Equal(t, uint64(1), response.StateVersion)
+	require.Len(t, submitter.states, 1)
+	assert.Equal(t, []nitrolite.Signature{participantSig, brokerSig}, submitter.states[0].Sigs)
+	assert.Equal(t, state.Allocations, submitter.states[0].Allocations)
+	channel, err = GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusChallenged, channel.Status)
+
+	// The same challenge event delivered twice is not answered twice
+	response = handle(1, expiration)
+	assert.Equal(t, ChallengeResponseSubmitted, response.Status)
+	assert.Len(t, submitter.states, 1)
+
+	// A challenge with the latest state needs no response
+	response = handle(2, expiration)
+	assert.Equal(t, ChallengeResponseUnneeded, response.Status)
+
+	// Failed submissions are retried until they succeed; a challenged state that cannot be read is answered with the latest one
+	submitter.err = errors.New("rpc unavailable")
+	response = handle(3, expiration)
+	assert.Equal(t, ChallengeResponseFailed, response.Status)
+	assert.Nil(t, response.ChallengedVersion)
+
+	submitter.err = nil
+	retried, err := responder.RetryResponses(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	require.NoError(t, db.First(response, response.ID).Error)
+	assert.Equal(t, ChallengeResponseSubmitted, response.Status)
+	assert.Equal(t, 2, response.Attempts)
+
+	// Expired challenges are not answered
+	response = handle(4, time.Now().Add(-time.Minute))
+	assert.Equal(t, ChallengeResponseMissed, response.Status)
+	assert.Len(t, submitter.states, 2)
+}
+
+// TestChallengedEvent tests that a Challenged event only records a pending response, which is submitted after the event is committed
+func TestChallengedEvent(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	submitter := &fakeCheckpointSubmitter{}
+	responder := &ChallengeResponder{db: db, submitter: submitter, network: "137", wake: make(chan struct{}, 1)}
+	c := &Custody{custody: binding, ledger: NewLedger(db), custodyAddr: custodyAddr, networkID: "137", challenges: responder}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	require.NoError(t, CreateChannel(db, channelID.Hex(), "0xParticipant", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+
+	expiration, err := custodyAbi.Events["Challenged"].Inputs.NonIndexed().Pack(big.NewInt(time.Now().Add(time.Hour).Unix()))
+	require.NoError(t, err)
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Challenged"].ID, channelID},
+		Data:    expiration,
+		TxHash:  common.HexToHash("0x01"),
+	})
+
+	var response ChallengeResponse
+	require.NoError(t, db.Where("channel_id = ?", channelID.Hex()).First(&response).Error)
+	assert.Equal(t, ChallengeResponsePending, response.Status)
+	assert.Empty(t, submitter.states)
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusChallenged, channel.Status)
+	assert.Len(t, responder.wake, 1)
+}
@@ -4,18 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
-// ChannelStatus represents the current state of a channel (open or closed)
+// ChannelStatus represents the current state of a channel in its lifecycle
 type ChannelStatus string
 
 var (
-	ChannelStatusJoining ChannelStatus = "joining"
-	ChannelStatusOpen    ChannelStatus = "open"
-	ChannelStatusClosed  ChannelStatus = "closed"
+	ChannelStatusJoining    ChannelStatus = "joining"
+	ChannelStatusJoinFailed ChannelStatus = "join_failed" // The broker's join transaction failed
+	ChannelStatusOpen       ChannelStatus = "open"
+	ChannelStatusResizing   ChannelStatus = "resizing"   // The broker signed a resize state that is not on-chain yet
+	ChannelStatusClosing    ChannelStatus = "closing"    // The broker signed a final state that is not on-chain yet
+	ChannelStatusChallenged ChannelStatus = "challenged" // A challenge of the channel is pending on-chain
+	ChannelStatusClosed     ChannelStatus = "closed"
 )
 
 // Channel represents a state channel between participants
@@ -31,9 +37,11 @@ type Channel struct {
 	Adjudicator  string        `gorm:"column:adjudicator;not null"`
 	NetworkID    string        `gorm:"column:network_id;not null"`
 	Token        string        `gorm:"column:token;not null"`
-	Amount       int64         `gorm:"column:amount;not null"`
+	Amount       Amount        `gorm:"column:amount;not null"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
+
+	StatusUpdatedAt time.Time `gorm:"column:status_updated_at"` // When the channel last changed status
 }
 
 // TableName specifies the table name for the Channel model
@@ -43,7 +51,8 @@ func (Channel) TableName() string {
 
 // CreateChannel creates a new channel in the database
 // For real channels, participantB is always the broker application
-func CreateChannel(tx *gorm.DB, channelID, participantA string, nonce uint64, adjudicator string, networkID string, tokenAddress string, amount int64) error {
+func CreateChannel(tx *gorm.DB, channelID, participantA string, nonce uint64, adjudicator string, networkID string, tokenAddress string, amount Amount) error {
+	now := time.Now()
 	channel := Channel{
 		ChannelID:    channelID,
 		ParticipantA: participantA,
@@ -54,18 +63,48 @@ func CreateChannel(tx *gorm.DB, channelID, participantA string, nonce uint64, ad
 		Adjudicator:  adjudicator,
 		Token:        tokenAddress,
 		Amount:       amount,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+
+		StatusUpdatedAt: now,
 	}
 
 	if err := tx.Create(&channel).Error; err != nil {
 		return fmt.Errorf("failed to create channel: %w", err)
 	}
+	if err := recordChannelTransition(tx, channelID, "", ChannelStatusJoining, "created", "", now); err != nil {
+		return err
+	}
 
 	log.Printf("Created new channel with ID: %s, network: %s", channelID, networkID)
 	return nil
 }
 
+// applyJoinTx marks a joining channel join_failed once its join transaction failed, unless another join is still under way
+func applyJoinTx(tx *gorm.DB, otx *OutboundTx, previousHash string) error {
+	if otx.Status != OutboundTxFailed {
+		return nil
+	}
+
+	var others int64
+	err := tx.Model(&OutboundTx{}).
+		Where("kind = ? AND reference = ? AND id <> ? AND status <> ?", TxKindJoin, otx.Reference, otx.ID, OutboundTxFailed).
+		Count(&others).Error
+	if err != nil || others > 0 {
+		return err
+	}
+
+	channel, err := GetChannelByID(tx, otx.Reference)
+	if err != nil || channel == nil || channel.Status != ChannelStatusJoining {
+		return err
+	}
+	if err := TransitionChannel(tx, channel, ChannelStatusJoinFailed, "join_failed", otx.TxHash); err != nil {
+		return fmt.Errorf("failed to mark join of channel %s failed: %w", otx.Reference, err)
+	}
+	log.Printf("Join of channel %s failed: %s", otx.Reference, otx.Error)
+	return nil
+}
+
 // GetChannelByID retrieves a channel by its ID
 func GetChannelByID(tx *gorm.DB, channelID string) (*Channel, error) {
 	var channel Channel
@@ -79,26 +118,54 @@ func GetChannelByID(tx *gorm.DB, channelID string) (*Channel, error) {
 	return &channel, nil
 }
 
-// getChannelForParticipant finds the channel between a participant and the broker
-func getChannelForParticipant(tx *gorm.DB, participant string) (*Channel, error) {
+// getChannelForParticipant finds the channel between a participant and the broker that holds token, in one of statuses.
+// If channelID is not empty, that channel is used if it is a channel of the participant in token and in one of statuses.
+// Otherwise the participant's latest channel in token and in one of statuses is used, on networkID if it is not empty.
+func getChannelForParticipant(tx *gorm.DB, participant, token, networkID, channelID string, statuses []ChannelStatus) (*Channel, error) {
+	described := "unclosed"
+	if len(statuses) == 1 {
+		described = string(statuses[0])
+	}
+
+	if channelID != "" {
+		channel, err := GetChannelByID(tx, channelID)
+		if err != nil {
+			return nil, err
+		}
+		if channel == nil || !strings.EqualFold(channel.ParticipantA, participant) || channel.ParticipantB != BrokerAddress || !slices.Contains(statuses, channel.Status) {
+			return nil, fmt.Errorf("channel %s is not an %s channel of participant %s", channelID, described, participant)
+		}
+		if !strings.EqualFold(channel.Token, token) {
+			return nil, fmt.Errorf("channel %s of participant %s holds token %s, not %s", channel.ChannelID, participant, channel.Token, token)
+		}
+		return channel, nil
+	}
+
+	query := tx.Where("LOWER(participant_a) = LOWER(?) AND participant_b = ? AND status IN ? AND LOWER(token) = LOWER(?)",
+		participant, BrokerAddress, statuses, token)
+	if networkID != "" {
+		query = query.Where("network_id = ?", networkID)
+	}
 	var channel Channel
-	if err := tx.Where("participant_a = ? AND participant_b = ? AND status = ?",
-		participant, BrokerAddress, ChannelStatusOpen).Order("nonce DESC").First(&channel).Error; err != nil {
-		return nil, fmt.Errorf("no open channel found for participant %s: %w", participant, err)
+	if err := query.Order("nonce DESC").First(&channel).Error; err != nil {
+		if networkID != "" {
+			return nil, fmt.Errorf("no %s channel of participant %s holds token %s on network %s: %w", described, participant, token, networkID, err)
+		}
+		return nil, fmt.Errorf("no %s channel of participant %s holds token %s: %w", described, participant, token, err)
 	}
 	return &channel, nil
 }
 
-// CheckExistingChannels checks if there is an existing open channel on the same network between participant A and B
-func CheckExistingChannels(tx *gorm.DB, participantA, participantB, networkID string) (*Channel, error) {
+// CheckExistingChannels checks if there is an existing active channel on the same network and in the same token between participant A and B
+func CheckExistingChannels(tx *gorm.DB, participantA, participantB, networkID, token string) (*Channel, error) {
 	var channel Channel
-	err := tx.Where("participant_a = ? AND participant_b = ? AND network_id = ? AND status = ?", participantA, participantB, networkID, ChannelStatusOpen).
+	err := tx.Where("participant_a = ? AND participant_b = ? AND network_id = ? AND LOWER(token) = LOWER(?) AND status IN ?", participantA, participantB, networkID, token, activeChannelStatuses).
 		First(&channel).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil // No open channel found
+			return nil, nil // No active channel found
 		}
-		return nil, fmt.Errorf("error checking for existing open channel: %w", err)
+		return nil, fmt.Errorf("error checking for existing channel: %w", err)
 	}
 
 	return &channel, nil
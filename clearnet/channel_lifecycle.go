@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidTransition is returned when a channel cannot move from its current status to the requested one
+var ErrInvalidTransition = errors.New("invalid channel transition")
+
+// channelTransitions lists the statuses each channel status can move to.
+// Every status but closed can be closed or challenged on-chain, whatever the broker expected.
+var channelTransitions = map[ChannelStatus][]ChannelStatus{
+	ChannelStatusJoining:    {ChannelStatusOpen, ChannelStatusJoinFailed, ChannelStatusChallenged, ChannelStatusClosed},
+	ChannelStatusJoinFailed: {ChannelStatusOpen, ChannelStatusChallenged, ChannelStatusClosed},
+	ChannelStatusOpen:       {ChannelStatusResizing, ChannelStatusClosing, ChannelStatusChallenged, ChannelStatusClosed},
+	ChannelStatusResizing:   {ChannelStatusOpen, ChannelStatusClosing, ChannelStatusChallenged, ChannelStatusClosed},
+	ChannelStatusClosing:    {ChannelStatusOpen, ChannelStatusChallenged, ChannelStatusClosed},
+	ChannelStatusChallenged: {ChannelStatusOpen, ChannelStatusClosed},
+}
+
+// activeChannelStatuses are the statuses of channels the broker joined or is joining that are not closed
+var activeChannelStatuses = []ChannelStatus{ChannelStatusJoining, ChannelStatusOpen, ChannelStatusResizing, ChannelStatusClosing, ChannelStatusChallenged}
+
+// unclosedChannelStatuses are the statuses of all channels that are not closed
+var unclosedChannelStatuses = append([]ChannelStatus{ChannelStatusJoinFailed}, activeChannelStatuses...)
+
+// CanTransitionTo reports whether a channel with this status can move to status to. Staying in the same status is always allowed.
+func (s ChannelStatus) CanTransitionTo(to ChannelStatus) bool {
+	if s == to {
+		return true
+	}
+	for _, allowed := range channelTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ChannelTransition is a change of the status of a channel
+type ChannelTransition struct {
+	ID        uint          `gorm:"primaryKey"`
+	ChannelID string        `gorm:"column:channel_id;not null;index"`
+	From      ChannelStatus `gorm:"column:from_status;not null"` // Empty when the channel was created
+	To        ChannelStatus `gorm:"column:to_status;not null"`
+	Reason    string        `gorm:"column:reason;not null"`    // Event or RPC method that caused the transition
+	Reference string        `gorm:"column:reference;not null"` // Transaction hash of the event, or RPC request ID
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for the ChannelTransition model
+func (ChannelTransition) TableName() string {
+	return "channel_transitions"
+}
+
+// TransitionChannel moves the channel to status to and records the transition. It fails with ErrInvalidTransition
+// if the move is not allowed, or if the channel changed status since it was read. Staying in the same status does nothing.
+func TransitionChannel(tx *gorm.DB, channel *Channel, to ChannelStatus, reason, reference string) error {
+	from := channel.Status
+	if from == to {
+		return nil
+	}
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("%w: channel %s is %s and cannot become %s", ErrInvalidTransition, channel.ChannelID, from, to)
+	}
+
+	now := time.Now()
+	result := tx.Model(&Channel{}).
+		Where("channel_id = ? AND status = ?", channel.ChannelID, from).
+		Updates(map[string]any{"status": to, "status_updated_at": now, "updated_at": now})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update status of channel %s: %w", channel.ChannelID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: channel %s is no longer %s", ErrInvalidTransition, channel.ChannelID, from)
+	}
+
+	channel.Status = to
+	channel.StatusUpdatedAt = now
+	channel.UpdatedAt = now
+	return recordChannelTransition(tx, channel.ChannelID, from, to, reason, reference, now)
+}
+
+// recordChannelTransition adds a transition to the history of a channel
+func recordChannelTransition(tx *gorm.DB, channelID string, from, to ChannelStatus, reason, reference string, at time.Time) error {
+	transition := &ChannelTransition{
+		ChannelID: channelID,
+		From:      from,
+		To:        to,
+		Reason:    reason,
+		Reference: reference,
+		CreatedAt: at,
+	}
+	if err := tx.Create(transition).Error; err != nil {
+		return fmt.Errorf("failed to record transition of channel %s: %w", channelID, err)
+	}
+	return nil
+}
+
+// GetChannelTransitions returns the transition history of a channel, oldest first
+func GetChannelTransitions(tx *gorm.DB, channelID string) ([]ChannelTransition, error) {
+	var transitions []ChannelTransition
+	if err := tx.Where("channel_id = ?", channelID).Order("id").Find(&transitions).Error; err != nil {
+		return nil, fmt.Errorf("failed to read transitions of channel %s: %w", channelID, err)
+	}
+	return transitions, nil
+}
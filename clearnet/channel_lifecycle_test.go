@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChannelTransitions tests that only legal transitions are applied, and that every transition is recorded
+func TestChannelTransitions(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	assert.True(t, ChannelStatusOpen.CanTransitionTo(ChannelStatusResizing))
+	assert.True(t, ChannelStatusResizing.CanTransitionTo(ChannelStatusResizing))
+	assert.True(t, ChannelStatusChallenged.CanTransitionTo(ChannelStatusClosed))
+	assert.False(t, ChannelStatusJoining.CanTransitionTo(ChannelStatusResizing))
+	assert.False(t, ChannelStatusChallenged.CanTransitionTo(ChannelStatusClosing))
+	assert.False(t, ChannelStatusClosed.CanTransitionTo(ChannelStatusOpen))
+
+	require.NoError(t, CreateChannel(db, "0xchannel", "0xParticipant", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	channel, err := GetChannelByID(db, "0xchannel")
+	require.NoError(t, err)
+	created := channel.StatusUpdatedAt
+
+	require.NoError(t, TransitionChannel(db, channel, ChannelStatusOpen, "joined", "0xjoin"))
+	require.NoError(t, TransitionChannel(db, channel, ChannelStatusResizing, "resize_channel", "1"))
+	assert.Equal(t, ChannelStatusResizing, channel.Status)
+
+	// Illegal transitions leave the channel as it is
+	err = TransitionChannel(db, channel, ChannelStatusJoining, "test", "")
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+
+	// A channel that changed status since it was read is not moved
+	stale := *channel
+	require.NoError(t, TransitionChannel(db, channel, ChannelStatusChallenged, "challenged", "0xchallenge"))
+	err = TransitionChannel(db, &stale, ChannelStatusOpen, "resized", "0xresize")
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+
+	stored, err := GetChannelByID(db, "0xchannel")
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusChallenged, stored.Status)
+	assert.False(t, stored.StatusUpdatedAt.Before(created))
+
+	transitions, err := GetChannelTransitions(db, "0xchannel")
+	require.NoError(t, err)
+	require.Len(t, transitions, 4)
+	for i, expected := range []struct{ from, to ChannelStatus }{
+		{"", ChannelStatusJoining},
+		{ChannelStatusJoining, ChannelStatusOpen},
+		{ChannelStatusOpen, ChannelStatusResizing},
+		{ChannelStatusResizing, ChannelStatusChallenged},
+	} {
+		assert.Equal(t, expected.from, transitions[i].From)
+		assert.Equal(t, expected.to, transitions[i].To)
+	}
+	assert.Equal(t, "challenged", transitions[3].Reason)
+	assert.Equal(t, "0xchallenge", transitions[3].Reference)
+}
+
+// TestChannelLifecycleRPC tests that resize and close requests are only accepted in the statuses that allow them,
+// and that custody events move the channel on
+func TestChannelLifecycleRPC(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	participantKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := Signer{privateKey: participantKey}
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &Signer{privateKey: brokerKey}
+
+	sim := simulated.NewBackend(types.GenesisAlloc{})
+	defer sim.Close()
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	ledger := NewLedger(db)
+	c := &Custody{client: sim.Client(), custody: binding, ledger: ledger, custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	token := "0x1000000000000000000000000000000000000001"
+	destination := participant.GetAddress().Hex()
+
+	resize := func(requestID uint64, id string) error {
+		req := ResizeChannelSignData{
+			RequestID: requestID,
+			Method:    "resize_channel",
+			Params:    []ResizeChannelParams{{ChannelID: id, ParticipantChange: big.NewInt(-10), FundsDestination: destination}},
+			Timestamp: uint64(time.Now().Unix()),
+		}
+		reqBytes, err := json.Marshal(req)
+		require.NoError(t, err)
+		sig, err := participant.Sign(reqBytes)
+		require.NoError(t, err)
+		rpc := &RPCRequest{Req: RPCData{RequestID: req.RequestID, Method: req.Method, Params: []any{req.Params[0]}, Timestamp: req.Timestamp}, Sig: []string{hexutil.Encode(sig)}}
+		_, err = HandleResizeChannel(rpc, ledger, broker)
+		return err
+	}
+	closeChannel := func(requestID uint64) error {
+		req := RPCData{
+			RequestID: requestID,
+			Method:    "close_channel",
+			Params:    []any{CloseChannelParams{ChannelID: channelID.Hex(), FundsDestination: destination}},
+			Timestamp: uint64(time.Now().Unix()),
+		}
+		reqBytes, err := json.Marshal(req)
+		require.NoError(t, err)
+		sig, err := participant.Sign(reqBytes)
+		require.NoError(t, err)
+		_, err = HandleCloseChannel(&RPCRequest{Req: req, Sig: []string{hexutil.Encode(sig)}}, ledger, broker)
+		return err
+	}
+	event := func(name string, txHash byte, data []byte) {
+		c.handleBlockChainEvent(types.Log{
+			Address: custodyAddr,
+			Topics:  []common.Hash{custodyAbi.Events[name].ID, channelID},
+			Data:    data,
+			TxHash:  common.BytesToHash([]byte{txHash}),
+		})
+	}
+	status := func() ChannelStatus {
+		channel, err := GetChannelByID(db, channelID.Hex())
+		require.NoError(t, err)
+		return channel.Status
+	}
+
+	// Unknown channels and channels the broker has not joined yet cannot be resized
+	assert.ErrorContains(t, resize(1, channelID.Hex()), "not found")
+	require.NoError(t, CreateChannel(db, channelID.Hex(), destination, 1, "0xAdjudicator", "137", token, NewAmount(100)))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelID.Hex(), destination, token), NewAmount(100), "test"))
+	assert.ErrorContains(t, resize(2, channelID.Hex()), "is joining and cannot be resized")
+	assert.ErrorContains(t, closeChannel(3), "is joining and cannot be closed")
+
+	event("Joined", 0x01, common.LeftPadBytes([]byte{1}, 32))
+	assert.Equal(t, ChannelStatusOpen, status())
+
+	// The resize state is signed, and the channel is open again once it is on-chain
+	require.NoError(t, resize(4, channelID.Hex()))
+	assert.Equal(t, ChannelStatusResizing, status())
+	deltas, err := custodyAbi.Events["Resized"].Inputs.NonIndexed().Pack([]*big.Int{big.NewInt(-10), big.NewInt(0)})
+	require.NoError(t, err)
+	event("Resized", 0x02, deltas)
+	assert.Equal(t, ChannelStatusOpen, status())
+
+	// A closing channel cannot be resized, and is closed by the Closed event
+	require.NoError(t, closeChannel(5))
+	assert.Equal(t, ChannelStatusClosing, status())
+	assert.ErrorContains(t, resize(6, channelID.Hex()), "is closing and cannot be resized")
+	event("Closed", 0x03, nil)
+	assert.Equal(t, ChannelStatusClosed, status())
+	assert.ErrorContains(t, closeChannel(7), "is closed and cannot be closed")
+
+	transitions, err := GetChannelTransitions(db, channelID.Hex())
+	require.NoError(t, err)
+	var reasons []string
+	for _, transition := range transitions {
+		reasons = append(reasons, transition.Reason)
+	}
+	assert.Equal(t, []string{"created", "joined", "resize_channel", "resized", "close_channel", "closed"}, reasons)
+	assert.Equal(t, "4", transitions[2].Reference)
+	assert.Equal(t, common.BytesToHash([]byte{0x03}).Hex(), transitions[5].Reference)
+}
+
+// TestResizeChannelExcludesHeldFunds tests that a resize state only allocates the participant's available balance
+func TestResizeChannelExcludesHeldFunds(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	participantKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := Signer{privateKey: participantKey}
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &Signer{privateKey: brokerKey}
+
+	ledger := NewLedger(db)
+	channelID := crypto.Keccak256Hash([]byte("channel")).Hex()
+	token := "0x1000000000000000000000000000000000000001"
+	destination := participant.GetAddress().Hex()
+	require.NoError(t, CreateChannel(db, channelID, destination, 1, "0xAdjudicator", "137", token, NewAmount(100)))
+	channel, err := GetChannelByID(db, channelID)
+	require.NoError(t, err)
+	require.NoError(t, TransitionChannel(db, channel, ChannelStatusOpen, "joined", "0xjoin"))
+
+	// 30 of the 100 deposited are reserved for a withdrawal signed earlier
+	account := ledger.SelectBeneficiaryAccount(channelID, destination, token)
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), "test"))
+	_, err = ledger.PlaceHold(account, NewAmount(30), 1)
+	require.NoError(t, err)
+
+	req := ResizeChannelSignData{
+		RequestID: 1,
+		Method:    "resize_channel",
+		Params:    []ResizeChannelParams{{ChannelID: channelID, ParticipantChange: big.NewInt(-10), FundsDestination: destination}},
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	reqBytes, err := json.Marshal(req)
+	require.NoError(t, err)
+	sig, err := participant.Sign(reqBytes)
+	require.NoError(t, err)
+	rpc := &RPCRequest{Req: RPCData{RequestID: req.RequestID, Method: req.Method, Params: []any{req.Params[0]}, Timestamp: req.Timestamp}, Sig: []string{hexutil.Encode(sig)}}
+	response, err := HandleResizeChannel(rpc, ledger, broker)
+	require.NoError(t, err)
+
+	resized := response.Res.Params[0].(ResizeChannelResponse)
+	assert.Equal(t, "60", resized.Allocations[0].Amount.String())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TokenPolicy bounds the deposits of channels in a token. Zero amounts are no bound.
+type TokenPolicy struct {
+	MinDeposit        Amount `json:"min_deposit"`
+	MaxDeposit        Amount `json:"max_deposit"`
+	MaxPerParticipant Amount `json:"max_per_participant"` // Total deposit of a participant's active channels in the token
+}
+
+// ChannelPolicy decides which channels created with the broker it joins. Empty rules allow anything,
+// and a nil policy accepts every channel.
+type ChannelPolicy struct {
+	Tokens                    map[string]TokenPolicy `json:"tokens,omitempty"`                       // Allowed tokens by address
+	Adjudicators              []string               `json:"adjudicators,omitempty"`                 // Allowed adjudicator addresses
+	MinChallenge              uint64                 `json:"min_challenge,omitempty"`                // Shortest challenge period, in seconds
+	MaxChallenge              uint64                 `json:"max_challenge,omitempty"`                // Longest challenge period, in seconds
+	MaxChannelsPerParticipant int                    `json:"max_channels_per_participant,omitempty"` // Active channels of a participant on the network
+}
+
+// ChannelRequest is a channel created on-chain with the broker, before the broker joins it
+type ChannelRequest struct {
+	ChannelID   string
+	NetworkID   string
+	Participant string
+	Token       string
+	Amount      Amount
+	Adjudicator string
+	Challenge   uint64 // Challenge period in seconds
+}
+
+// ParseChannelPolicy parses a JSON channel policy
+func ParseChannelPolicy(data string) (*ChannelPolicy, error) {
+	var policy ChannelPolicy
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, fmt.Errorf("invalid channel policy: %w", err)
+	}
+	return NewChannelPolicy(policy)
+}
+
+// NewChannelPolicy validates a channel policy and normalizes its addresses
+func NewChannelPolicy(policy ChannelPolicy) (*ChannelPolicy, error) {
+	tokens := make(map[string]TokenPolicy, len(policy.Tokens))
+	for token, bounds := range policy.Tokens {
+		if !common.IsHexAddress(token) {
+			return nil, fmt.Errorf("channel policy: invalid token address %q", token)
+		}
+		if bounds.MinDeposit.Sign() < 0 || bounds.MaxDeposit.Sign() < 0 || bounds.MaxPerParticipant.Sign() < 0 {
+			return nil, fmt.Errorf("channel policy: deposit bounds of token %s must not be negative", token)
+		}
+		if !bounds.MaxDeposit.IsZero() && bounds.MinDeposit.Cmp(bounds.MaxDeposit) > 0 {
+			return nil, fmt.Errorf("channel policy: min_deposit of token %s exceeds max_deposit", token)
+		}
+		tokens[common.HexToAddress(token).Hex()] = bounds
+	}
+	policy.Tokens = tokens
+
+	for i, adjudicator := range policy.Adjudicators {
+		if !common.IsHexAddress(adjudicator) {
+			return nil, fmt.Errorf("channel policy: invalid adjudicator address %q", adjudicator)
+		}
+		policy.Adjudicators[i] = common.HexToAddress(adjudicator).Hex()
+	}
+
+	if policy.MaxChallenge > 0 && policy.MinChallenge > policy.MaxChallenge {
+		return nil, fmt.Errorf("channel policy: min_challenge exceeds max_challenge")
+	}
+	if policy.MaxChannelsPerParticipant < 0 {
+		return nil, fmt.Errorf("channel policy: max_channels_per_participant must not be negative")
+	}
+	return &policy, nil
+}
+
+// Evaluate returns why the broker should not join the requested channel, or an empty string if it may
+func (p *ChannelPolicy) Evaluate(db *gorm.DB, req ChannelRequest) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+
+	bounds, allowed := p.Tokens[common.HexToAddress(req.Token).Hex()]
+	if len(p.Tokens) > 0 && !allowed {
+		return fmt.Sprintf("token %s is not accepted", req.Token), nil
+	}
+	if len(p.Adjudicators) > 0 && !containsFold(p.Adjudicators, req.Adjudicator) {
+		return fmt.Sprintf("adjudicator %s is not accepted", req.Adjudicator), nil
+	}
+	if req.Challenge < p.MinChallenge {
+		return fmt.Sprintf("challenge period of %ds is shorter than %ds", req.Challenge, p.MinChallenge), nil
+	}
+	if p.MaxChallenge > 0 && req.Challenge > p.MaxChallenge {
+		return fmt.Sprintf("challenge period of %ds is longer than %ds", req.Challenge, p.MaxChallenge), nil
+	}
+	if req.Amount.Cmp(bounds.MinDeposit) < 0 {
+		return fmt.Sprintf("deposit of %s is below the minimum of %s", req.Amount, bounds.MinDeposit), nil
+	}
+	if !bounds.MaxDeposit.IsZero() && req.Amount.Cmp(bounds.MaxDeposit) > 0 {
+		return fmt.Sprintf("deposit of %s is above the maximum of %s", req.Amount, bounds.MaxDeposit), nil
+	}
+
+	if p.MaxChannelsPerParticipant == 0 && bounds.MaxPerParticipant.IsZero() {
+		return "", nil
+	}
+	var active []Channel
+	err := db.Where("participant_a = ? AND network_id = ? AND status IN ?", req.Participant, req.NetworkID, activeChannelStatuses).
+		Find(&active).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to read channels of %s: %w", req.Participant, err)
+	}
+	if p.MaxChannelsPerParticipant > 0 && len(active) >= p.MaxChannelsPerParticipant {
+		return fmt.Sprintf("participant already has %d active channels", len(active)), nil
+	}
+	if !bounds.MaxPerParticipant.IsZero() {
+		total := req.Amount
+		for _, channel := range active {
+			if strings.EqualFold(channel.Token, req.Token) {
+				total = total.Add(channel.Amount)
+			}
+		}
+		if total.Cmp(bounds.MaxPerParticipant) > 0 {
+			return fmt.Sprintf("total deposit of %s would exceed the participant cap of %s", total, bounds.MaxPerParticipant), nil
+		}
+	}
+	return "", nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectedChannel is a channel created with the broker that the broker did not join because of its channel policy
+type RejectedChannel struct {
+	ID          uint   `gorm:"primaryKey"`
+	ChannelID   string `gorm:"column:channel_id;not null;uniqueIndex"`
+	NetworkID   string `gorm:"column:network_id;not null"`
+	Participant string `gorm:"column:participant;not null;index"`
+	Token       string `gorm:"column:token;not null"`
+	Amount      Amount `gorm:"column:amount;not null"`
+	Adjudicator string `gorm:"column:adjudicator;not null"`
+	Challenge   uint64 `gorm:"column:challenge;not null;default:0"`
+	Reason      string `gorm:"column:reason;not null"`
+	TxHash      string `gorm:"column:tx_hash;not null"` // Transaction that created the channel
+	CreatedAt   time.Time
+}
+
+// TableName specifies the table name for the RejectedChannel model
+func (RejectedChannel) TableName() string {
+	return "rejected_channels"
+}
+
+// RecordRejectedChannel stores why a channel was not joined. A channel already recorded keeps its first reason.
+func RecordRejectedChannel(db *gorm.DB, req ChannelRequest, reason, txHash string) error {
+	rejected := &RejectedChannel{
+		ChannelID:   req.ChannelID,
+		NetworkID:   req.NetworkID,
+		Participant: req.Participant,
+		Token:       req.Token,
+		Amount:      req.Amount,
+		Adjudicator: req.Adjudicator,
+		Challenge:   req.Challenge,
+		Reason:      reason,
+		TxHash:      txHash,
+		CreatedAt:   time.Now(),
+	}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(rejected).Error; err != nil {
+		return fmt.Errorf("failed to record rejected channel: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	policyToken       = "0x1000000000000000000000000000000000000001"
+	policyAdjudicator = "0xAD00000000000000000000000000000000000001"
+)
+
+// TestChannelPolicy tests that channels outside of the policy are rejected with a reason
+func TestChannelPolicy(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	policy, err := ParseChannelPolicy(`{
+		"tokens": {"` + policyToken + `": {"min_deposit": "10", "max_deposit": "1000", "max_per_participant": "1500"}},
+		"adjudicators": ["0xad00000000000000000000000000000000000001"],
+		"min_challenge": 3600,
+		"max_challenge": 86400,
+		"max_channels_per_participant": 2
+	}`)
+	require.NoError(t, err)
+
+	valid := ChannelRequest{
+		ChannelID:   "0xnew",
+		NetworkID:   "137",
+		Participant: "0xParticipant",
+		Token:       policyToken,
+		Amount:      NewAmount(100),
+		Adjudicator: policyAdjudicator,
+		Challenge:   7200,
+	}
+	reason, err := policy.Evaluate(db, valid)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+
+	for name, tc := range map[string]struct {
+		change func(req *ChannelRequest)
+		reason string
+	}{
+		"token":          {func(req *ChannelRequest) { req.Token = "0x2000000000000000000000000000000000000002" }, "is not accepted"},
+		"adjudicator":    {func(req *ChannelRequest) { req.Adjudicator = "0xAD00000000000000000000000000000000000002" }, "adjudicator"},
+		"short period":   {func(req *ChannelRequest) { req.Challenge = 60 }, "shorter than 3600s"},
+		"long period":    {func(req *ChannelRequest) { req.Challenge = 100000 }, "longer than 86400s"},
+		"small deposit":  {func(req *ChannelRequest) { req.Amount = NewAmount(5) }, "below the minimum of 10"},
+		"large deposit":  {func(req *ChannelRequest) { req.Amount = NewAmount(5000) }, "above the maximum of 1000"},
+		"zero challenge": {func(req *ChannelRequest) { req.Challenge = 0 }, "shorter"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := valid
+			tc.change(&req)
+			reason, err := policy.Evaluate(db, req)
+			require.NoError(t, err)
+			assert.Contains(t, reason, tc.reason)
+		})
+	}
+
+	// Caps count the active channels of the participant on the network
+	require.NoError(t, CreateChannel(db, "0xfirst", "0xParticipant", 1, policyAdjudicator, "137", policyToken, NewAmount(1000)))
+	reason, err = policy.Evaluate(db, valid)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+
+	large := valid
+	large.Amount = NewAmount(600)
+	reason, err = policy.Evaluate(db, large)
+	require.NoError(t, err)
+	assert.Contains(t, reason, "would exceed the participant cap of 1500")
+
+	require.NoError(t, CreateChannel(db, "0xsecond", "0xParticipant", 2, policyAdjudicator, "137", policyToken, NewAmount(10)))
+	reason, err = policy.Evaluate(db, valid)
+	require.NoError(t, err)
+	assert.Contains(t, reason, "already has 2 active channels")
+
+	other := valid
+	other.NetworkID = "8453"
+	reason, err = policy.Evaluate(db, other)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+
+	// A nil policy accepts everything
+	reason, err = (*ChannelPolicy)(nil).Evaluate(db, large)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+
+	_, err = ParseChannelPolicy(`{"tokens": {"0xUSDC": {}}}`)
+	assert.Error(t, err)
+	_, err = ParseChannelPolicy(`{"tokens": {"` + policyToken + `": {"min_deposit": "10", "max_deposit": "5"}}}`)
+	assert.Error(t, err)
+	_, err = ParseChannelPolicy(`{"min_challenge": 10, "max_challenge": 5}`)
+	assert.Error(t, err)
+}
+
+// TestCreatedChannelPolicy tests that the Created handler only joins channels accepted by the policy
+func TestCreatedChannelPolicy(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	previousBroker := BrokerAddress
+	defer func() { BrokerAddress = previousBroker }()
+	signer, err := NewSigner(hexutil.Encode(crypto.FromECDSA(key)))
+	require.NoError(t, err)
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	policy, err := NewChannelPolicy(ChannelPolicy{
+		Tokens:       map[string]TokenPolicy{policyToken: {MaxDeposit: NewAmount(1000)}},
+		MinChallenge: 3600,
+	})
+	require.NoError(t, err)
+	c := &Custody{custody: binding, ledger: NewLedger(db), custodyAddr: custodyAddr, networkID: "137", signer: signer, policy: policy}
+	c.txs = NewTxManager(db, nil, &bind.TransactOpts{From: common.HexToAddress(BrokerAddress)}, big.NewInt(137), "137", TxConfig{})
+
+	participant := common.HexToAddress("0xB0B0000000000000000000000000000000000001")
+	created := func(nonce uint64, amount int64, challenge uint64) types.Log {
+		channel := nitrolite.Channel{
+			Participants: []common.Address{participant, common.HexToAddress(BrokerAddress)},
+			Adjudicator:  common.HexToAddress(policyAdjudicator),
+			Challenge:    challenge,
+			Nonce:        nonce,
+		}
+		initial := nitrolite.State{
+			Version:     big.NewInt(0),
+			Data:        []byte{},
+			Allocations: []nitrolite.Allocation{{Destination: participant, Token: common.HexToAddress(policyToken), Amount: big.NewInt(amount)}},
+			Sigs:        []nitrolite.Signature{},
+		}
+		data, err := custodyAbi.Events["Created"].Inputs.NonIndexed().Pack(channel, initial)
+		require.NoError(t, err)
+		return types.Log{
+			Address: custodyAddr,
+			Topics:  []common.Hash{custodyAbi.Events["Created"].ID, crypto.Keccak256Hash(big.NewInt(int64(nonce)).Bytes())},
+			Data:    data,
+			TxHash:  crypto.Keccak256Hash([]byte{byte(nonce)}),
+		}
+	}
+
+	// A deposit above the maximum is recorded as rejected, without a channel or a join
+	rejected := created(1, 5000, 3600)
+	c.handleBlockChainEvent(rejected)
+	var rejections []RejectedChannel
+	require.NoError(t, db.Find(&rejections).Error)
+	require.Len(t, rejections, 1)
+	assert.Equal(t, rejected.Topics[1].Hex(), rejections[0].ChannelID)
+	assert.Equal(t, participant.Hex(), rejections[0].Participant)
+	assert.Equal(t, "5000", rejections[0].Amount.String())
+	assert.Equal(t, rejected.TxHash.Hex(), rejections[0].TxHash)
+	assert.Contains(t, rejections[0].Reason, "above the maximum of 1000")
+	channel, err := GetChannelByID(db, rejected.Topics[1].Hex())
+	require.NoError(t, err)
+	assert.Nil(t, channel)
+
+	// An accepted channel is created with its challenge period and its join is queued
+	accepted := created(2, 500, 7200)
+	c.handleBlockChainEvent(accepted)
+	channel, err = GetChannelByID(db, accepted.Topics[1].Hex())
+	require.NoError(t, err)
+	require.NotNil(t, channel)
+	assert.Equal(t, ChannelStatusJoining, channel.Status)
+	assert.Equal(t, uint64(7200), channel.Challenge)
+
+	var joins []OutboundTx
+	require.NoError(t, db.Where("kind = ?", TxKindJoin).Find(&joins).Error)
+	require.Len(t, joins, 1)
+	assert.Equal(t, accepted.Topics[1].Hex(), joins[0].Reference)
+	assert.Equal(t, OutboundTxQueued, joins[0].Status)
+
+	// A second channel in the same token is recorded as rejected, and not joined
+	duplicate := created(3, 500, 7200)
+	c.handleBlockChainEvent(duplicate)
+	rejections = nil
+	require.NoError(t, db.Order("id").Find(&rejections).Error)
+	require.Len(t, rejections, 2)
+	assert.Equal(t, duplicate.Topics[1].Hex(), rejections[1].ChannelID)
+	assert.Equal(t, duplicate.TxHash.Hex(), rejections[1].TxHash)
+	assert.Contains(t, rejections[1].Reason, "duplicate channel")
+	assert.Contains(t, rejections[1].Reason, accepted.Topics[1].Hex())
+	channel, err = GetChannelByID(db, duplicate.Topics[1].Hex())
+	require.NoError(t, err)
+	assert.Nil(t, channel)
+	require.NoError(t, db.Where("kind = ?", TxKindJoin).Find(&joins).Error)
+	assert.Len(t, joins, 1)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ChannelState is a channel state signed by the broker, with the countersignature of the participant once it is known.
+// States signed by both parties can be submitted on-chain by either of them, so every one is kept to defend challenges.
+type ChannelState struct {
+	ID             uint   `gorm:"primaryKey"`
+	ChannelID      string `gorm:"column:channel_id;not null;uniqueIndex:idx_channel_states_hash;index:idx_channel_states_version,priority:1"`
+	Version        uint64 `gorm:"column:version;not null;index:idx_channel_states_version,priority:2"`
+	Intent         uint8  `gorm:"column:intent;not null"`
+	Data           string `gorm:"column:data;not null"`                                           // Hex encoded state data
+	Allocations    []byte `gorm:"column:allocations;type:text;not null"`                          // JSON encoded allocations
+	StateHash      string `gorm:"column:state_hash;not null;uniqueIndex:idx_channel_states_hash"` // Hash of the encoded state, as signed
+	BrokerSig      string `gorm:"column:broker_sig;not null"`                                     // Hex encoded r, s and v
+	ParticipantSig string `gorm:"column:participant_sig;not null;default:''"`                     // Empty until the participant countersigns
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// TableName specifies the table name for the ChannelState model
+func (ChannelState) TableName() string {
+	return "channel_states"
+}
+
+// encodeSignature encodes a signature as hex of r, s and v
+func encodeSignature(sig nitrolite.Signature) string {
+	return hexutil.Encode(append(append(sig.R[:], sig.S[:]...), sig.V))
+}
+
+// decodeSignature decodes a signature encoded with encodeSignature
+func decodeSignature(s string) (nitrolite.Signature, error) {
+	var sig nitrolite.Signature
+	raw, err := hexutil.Decode(s)
+	if err != nil || len(raw) != 65 {
+		return sig, errors.New("invalid signature encoding")
+	}
+	copy(sig.R[:], raw[:32])
+	copy(sig.S[:], raw[32:64])
+	sig.V = raw[64]
+	return sig, nil
+}
+
+// participantSignature returns the first signature of the state made by the participant, if any
+func participantSignature(encodedState []byte, sigs []nitrolite.Signature, participant string) (nitrolite.Signature, bool) {
+	for _, sig := range sigs {
+		if ok, err := nitrolite.Verify(encodedState, sig, common.HexToAddress(participant)); err == nil && ok {
+			return sig, true
+		}
+	}
+	return nitrolite.Signature{}, false
+}
+
+// RecordChannelState stores a state of the channel signed by the broker.
+// A participant signature included in state.Sigs is stored with it. Recording the same state twice keeps the first record.
+func RecordChannelState(tx *gorm.DB, channel *Channel, state nitrolite.State, brokerSig nitrolite.Signature) (*ChannelState, error) {
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channel.ChannelID), nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	allocations := make([]Allocation, len(state.Allocations))
+	for i, alloc := range state.Allocations {
+		allocations[i] = Allocation{
+			Participant:  alloc.Destination.Hex(),
+			TokenAddress: alloc.Token.Hex(),
+			Amount:       alloc.Amount,
+		}
+	}
+	allocationsJSON, err := json.Marshal(allocations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode allocations: %w", err)
+	}
+
+	record := &ChannelState{
+		ChannelID:   channel.ChannelID,
+		Version:     state.Version.Uint64(),
+		Intent:      state.Intent,
+		Data:        hexutil.Encode(state.Data),
+		Allocations: allocationsJSON,
+		StateHash:   crypto.Keccak256Hash(encodedState).Hex(),
+		BrokerSig:   encodeSignature(brokerSig),
+	}
+	if sig, ok := participantSignature(encodedState, state.Sigs, channel.ParticipantA); ok {
+		record.ParticipantSig = encodeSignature(sig)
+	}
+
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(record).Error; err != nil {
+		return nil, fmt.Errorf("failed to record channel state: %w", err)
+	}
+	return record, nil
+}
+
+// RecordCountersignature stores the participant signature of a state the broker signed before,
+// taken from the signatures of the state as it was submitted on-chain.
+func RecordCountersignature(tx *gorm.DB, channel *Channel, state nitrolite.State) error {
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channel.ChannelID), nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	stateHash := crypto.Keccak256Hash(encodedState).Hex()
+
+	sig, ok := participantSignature(encodedState, state.Sigs, channel.ParticipantA)
+	if !ok {
+		return fmt.Errorf("state %s is not signed by participant %s", stateHash, channel.ParticipantA)
+	}
+
+	result := tx.Model(&ChannelState{}).
+		Where("channel_id = ? AND state_hash = ?", channel.ChannelID, stateHash).
+		Update("participant_sig", encodeSignature(sig))
+	if result.Error != nil {
+		return fmt.Errorf("failed to record countersignature: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("state %s of channel %s was not signed by the broker", stateHash, channel.ChannelID)
+	}
+	return nil
+}
+
+// RecordParticipantSignature stores the signature a participant gave over the hash of a state the broker signed,
+// and returns the countersigned state. The signature must be made by the participant of the channel.
+func RecordParticipantSignature(tx *gorm.DB, channel *Channel, stateHash string, sig nitrolite.Signature) (*ChannelState, error) {
+	var state ChannelState
+	if err := tx.Where("channel_id = ? AND state_hash = ?", channel.ChannelID, stateHash).First(&state).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("state %s of channel %s was not signed by the broker", stateHash, channel.ChannelID)
+		}
+		return nil, fmt.Errorf("failed to find channel state: %w", err)
+	}
+	if !signedBy(common.HexToHash(state.StateHash), sig, channel.ParticipantA) {
+		return nil, fmt.Errorf("state %s is not signed by participant %s", stateHash, channel.ParticipantA)
+	}
+
+	state.ParticipantSig = encodeSignature(sig)
+	if err := tx.Model(&state).Update("participant_sig", state.ParticipantSig).Error; err != nil {
+		return nil, fmt.Errorf("failed to record countersignature: %w", err)
+	}
+	return &state, nil
+}
+
+// signedBy reports whether sig is a signature of hash by address
+func signedBy(hash common.Hash, sig nitrolite.Signature, address string) bool {
+	raw := make([]byte, 65)
+	copy(raw[:32], sig.R[:])
+	copy(raw[32:64], sig.S[:])
+	raw[64] = sig.V
+	if raw[64] >= 27 {
+		raw[64] -= 27
+	}
+	pubKey, err := crypto.SigToPub(hash[:], raw)
+	if err != nil {
+		return false
+	}
+	return crypto.PubkeyToAddress(*pubKey) == common.HexToAddress(address)
+}
+
+// GetChannelStates returns the states the broker signed for a channel, latest version first
+func GetChannelStates(db *gorm.DB, channelID string) ([]ChannelState, error) {
+	var states []ChannelState
+	if err := db.Where("channel_id = ?", channelID).Order("version DESC, id DESC").Find(&states).Error; err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// GetLatestSignedChannelState returns the countersigned state with the highest version, or nil if there is none
+func GetLatestSignedChannelState(db *gorm.DB, channelID string) (*ChannelState, error) {
+	var states []ChannelState
+	err := db.Where("channel_id = ? AND participant_sig <> ''", channelID).Order("version DESC, id DESC").Limit(1).Find(&states).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return nil, nil
+	}
+	return &states[0], nil
+}
+
+// SignedState rebuilds the state with the signatures of both parties, in participant order, ready to be submitted on-chain
+func (s *ChannelState) SignedState() (nitrolite.State, error) {
+	if s.ParticipantSig == "" {
+		return nitrolite.State{}, errors.New("state is not countersigned")
+	}
+
+	data, err := hexutil.Decode(s.Data)
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("invalid state data: %w", err)
+	}
+
+	var allocations []Allocation
+	if err := json.Unmarshal(s.Allocations, &allocations); err != nil {
+		return nitrolite.State{}, fmt.Errorf("invalid allocations: %w", err)
+	}
+	state := nitrolite.State{
+		Intent:  s.Intent,
+		Version: new(big.Int).SetUint64(s.Version),
+		Data:    data,
+	}
+	for _, alloc := range allocations {
+		state.Allocations = append(state.Allocations, nitrolite.Allocation{
+			Destination: common.HexToAddress(alloc.Participant),
+			Token:       common.HexToAddress(alloc.TokenAddress),
+			Amount:      alloc.Amount,
+		})
+	}
+
+	participantSig, err := decodeSignature(s.ParticipantSig)
+	if err != nil {
+		return nitrolite.State{}, err
+	}
+	brokerSig, err := decodeSignature(s.BrokerSig)
+	if err != nil {
+		return nitrolite.State{}, err
+	}
+	// The participant is always first in the channel and the broker second
+	state.Sigs = []nitrolite.Signature{participantSig, brokerSig}
+
+	return state, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChannelStateHistory tests that states signed by the broker are stored and countersigned from on-chain submissions
+func TestChannelStateHistory(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := Signer{privateKey: rawKey}
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &Signer{privateKey: brokerKey}
+
+	ledger := NewLedger(db)
+	channelID := crypto.Keccak256Hash([]byte("channel")).Hex()
+	token := "0x1000000000000000000000000000000000000001"
+	require.NoError(t, CreateChannel(db, channelID, participant.GetAddress().Hex(), 1, "0xAdjudicator", "137", token, NewAmount(100)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelID).Update("status", ChannelStatusOpen).Error)
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelID, participant.GetAddress().Hex(), token), NewAmount(100), "test"))
+
+	req := RPCData{
+		RequestID: 1,
+		Method:    "close_channel",
+		Params:    []any{CloseChannelParams{ChannelID: channelID, FundsDestination: participant.GetAddress().Hex()}},
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	reqBytes, err := json.Marshal(req)
+	require.NoError(t, err)
+	reqSig, err := participant.Sign(reqBytes)
+	require.NoError(t, err)
+
+	_, err = HandleCloseChannel(&RPCRequest{Req: req, Sig: []string{hexutil.Encode(reqSig)}}, ledger, broker)
+	require.NoError(t, err)
+
+	getStates := func(sender string) ([]ChannelStateResponse, error) {
+		rpcRequest := &RPCRequest{Req: RPCData{
+			RequestID: 2,
+			Method:    "get_channel_states",
+			Params:    []any{GetChannelStatesParams{ChannelID: channelID}},
+			Timestamp: uint64(time.Now().Unix()),
+		}}
+		response, err := HandleGetChannelStates(rpcRequest, ledger, sender)
+		if err != nil {
+			return nil, err
+		}
+		require.Len(t, response.Res.Params, 1)
+		states, ok := response.Res.Params[0].([]ChannelStateResponse)
+		require.True(t, ok)
+		return states, nil
+	}
+
+	states, err := getStates(participant.GetAddress().Hex())
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, uint64(1), states[0].Version)
+	assert.Equal(t, uint8(nitrolite.IntentFINALIZE), states[0].Intent)
+	assert.Nil(t, states[0].ParticipantSignature)
+	require.Len(t, states[0].Allocations, 2)
+	assert.Equal(t, "100", states[0].Allocations[0].Amount.String())
+
+	// Other users cannot read the states of the channel
+	_, err = getStates("0xB0B0000000000000000000000000000000000002")
+	assert.Error(t, err)
+
+	// The participant submits the final state with both signatures on-chain
+	finalState := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentFINALIZE),
+		Version: big.NewInt(1),
+		Data:    []byte{},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: common.HexToAddress(token), Amount: big.NewInt(100)},
+			{Destination: common.HexToAddress(BrokerAddress), Token: common.HexToAddress(token), Amount: big.NewInt(0)},
+		},
+	}
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.IntentFINALIZE, finalState.Version, finalState.Data, finalState.Allocations)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.Keccak256Hash(encodedState).Hex(), states[0].StateHash)
+
+	channel, err := GetChannelByID(db, channelID)
+	require.NoError(t, err)
+
+	// A state the broker did not sign is not countersigned
+	otherState := finalState
+	otherState.Version = big.NewInt(2)
+	otherEncoded, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.IntentFINALIZE, otherState.Version, otherState.Data, otherState.Allocations)
+	require.NoError(t, err)
+	otherSig, err := participant.NitroSign(otherEncoded)
+	require.NoError(t, err)
+	otherState.Sigs = []nitrolite.Signature{otherSig}
+	assert.Error(t, RecordCountersignature(db, channel, otherState))
+
+	participantSig, err := participant.NitroSign(encodedState)
+	require.NoError(t, err)
+	brokerSig, err := broker.NitroSign(encodedState)
+	require.NoError(t, err)
+	finalState.Sigs = []nitrolite.Signature{participantSig, brokerSig}
+	require.NoError(t, RecordCountersignature(db, channel, finalState))
+
+	states, err = getStates(participant.GetAddress().Hex())
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.NotNil(t, states[0].ParticipantSignature)
+	assert.Equal(t, hexutil.Encode(participantSig.R[:]), states[0].ParticipantSignature.R)
+	assert.Equal(t, hexutil.Encode(brokerSig.R[:]), states[0].Signature.R)
+}
+
+// TestCountersignState tests that participants can countersign states the broker signed, and only with their own signature
+func TestCountersignState(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := Signer{privateKey: rawKey}
+	otherKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	other := Signer{privateKey: otherKey}
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &Signer{privateKey: brokerKey}
+
+	ledger := NewLedger(db)
+	channelID := crypto.Keccak256Hash([]byte("channel")).Hex()
+	token := "0x1000000000000000000000000000000000000001"
+	require.NoError(t, CreateChannel(db, channelID, participant.GetAddress().Hex(), 1, "0xAdjudicator", "137", token, NewAmount(100)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelID).Update("status", ChannelStatusOpen).Error)
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelID, participant.GetAddress().Hex(), token), NewAmount(100), "test"))
+
+	req := RPCData{
+		RequestID: 1,
+		Method:    "close_channel",
+		Params:    []any{CloseChannelParams{ChannelID: channelID, FundsDestination: participant.GetAddress().Hex()}},
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	reqBytes, err := json.Marshal(req)
+	require.NoError(t, err)
+	reqSig, err := participant.Sign(reqBytes)
+	require.NoError(t, err)
+	_, err = HandleCloseChannel(&RPCRequest{Req: req, Sig: []string{hexutil.Encode(reqSig)}}, ledger, broker)
+	require.NoError(t, err)
+
+	states, err := GetChannelStates(db, channelID)
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	stateHash := states[0].StateHash
+
+	countersign := func(sender string, hash string, signer Signer) (*ChannelStateResponse, error) {
+		raw, err := crypto.Sign(common.HexToHash(hash).Bytes(), signer.privateKey)
+		require.NoError(t, err)
+		sig := Signature{V: raw[64] + 27, R: hexutil.Encode(raw[:32]), S: hexutil.Encode(raw[32:64])}
+
+		rpcRequest := &RPCRequest{Req: RPCData{
+			RequestID: 2,
+			Method:    "countersign_state",
+			Params: []any{CountersignStateParams{
+				ChannelID: channelID,
+				StateHash: hash,
+				Signature: sig,
+			}},
+			Timestamp: uint64(time.Now().Unix()),
+		}}
+		response, err := HandleCountersignState(rpcRequest, ledger, sender)
+		if err != nil {
+			return nil, err
+		}
+		require.Len(t, response.Res.Params, 1)
+		state, ok := response.Res.Params[0].(ChannelStateResponse)
+		require.True(t, ok)
+		return &state, nil
+	}
+
+	// Only the participant can countersign, only with their own signature, and only states the broker signed
+	_, err = countersign(other.GetAddress().Hex(), stateHash, other)
+	assert.ErrorContains(t, err, "channel not found")
+	_, err = countersign(participant.GetAddress().Hex(), stateHash, other)
+	assert.ErrorContains(t, err, "is not signed by participant")
+	_, err = countersign(participant.GetAddress().Hex(), crypto.Keccak256Hash([]byte("other")).Hex(), participant)
+	assert.ErrorContains(t, err, "was not signed by the broker")
+
+	latest, err := GetLatestSignedChannelState(db, channelID)
+	require.NoError(t, err)
+	assert.Nil(t, latest)
+
+	state, err := countersign(participant.GetAddress().Hex(), stateHash, participant)
+	require.NoError(t, err)
+	require.NotNil(t, state.ParticipantSignature)
+
+	latest, err = GetLatestSignedChannelState(db, channelID)
+	require.NoError(t, err)
+	require.NotNil(t, latest)
+	assert.Equal(t, stateHash, latest.StateHash)
+	signed, err := latest.SignedState()
+	require.NoError(t, err)
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.Intent(signed.Intent), signed.Version, signed.Data, signed.Allocations)
+	require.NoError(t, err)
+	_, ok := participantSignature(encodedState, signed.Sigs, participant.GetAddress().Hex())
+	assert.True(t, ok)
+}
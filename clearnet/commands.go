@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// commands are maintenance tasks run instead of the server, as `clearnet <command> [args...]`
+var commands = map[string]func(db *gorm.DB, args []string) error{
+	"check-balances": checkBalancesCommand,
+	"verify-chains":  verifyChainsCommand,
+}
+
+// runCommand runs the named maintenance command against the database
+func runCommand(db *gorm.DB, name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command")
+	}
+	return command(db, args)
+}
+
+// checkBalancesCommand recomputes account balances from the ledger entries and reports any drift
+func checkBalancesCommand(db *gorm.DB, args []string) error {
+	drifts, err := CheckAccountBalances(db)
+	if err != nil {
+		return err
+	}
+
+	for _, drift := range drifts {
+		log.Printf("balance drift in account %s of %s (%s): stored %s, computed from entries %s",
+			drift.AccountID, drift.Beneficiary, drift.Asset, drift.Stored, drift.Computed)
+	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("found %d accounts with drifted balances", len(drifts))
+	}
+
+	log.Println("All account balances match the ledger entries")
+	return nil
+}
+
+// verifyChainsCommand walks the hash chains of the ledger and rpc_store tables and reports the first broken link of each
+func verifyChainsCommand(db *gorm.DB, args []string) error {
+	broken := 0
+	for _, name := range hashChains {
+		chainBreak, err := VerifyHashChain(db, name)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s chain: %w", name, err)
+		}
+		if chainBreak == nil {
+			log.Printf("%s chain is intact", name)
+			continue
+		}
+
+		broken++
+		if chainBreak.RecordID == 0 {
+			log.Printf("%s chain is broken: %s", name, chainBreak.Reason)
+		} else {
+			log.Printf("%s chain is broken at record %d: %s", name, chainBreak.RecordID, chainBreak.Reason)
+		}
+	}
+
+	if broken > 0 {
+		return fmt.Errorf("found %d broken hash chains", broken)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const concurrentRequests = 10
+
+// setupConcurrentDB creates a test database on which concurrent transactions really contend.
+// The shared in-memory SQLite database fails with "database table is locked" instead of waiting, so SQLite tests
+// use a file in WAL mode, where writers wait for each other up to the busy timeout. PostgreSQL databases wait on
+// row locks and are used as they are.
+func setupConcurrentDB(t *testing.T) (*gorm.DB, func()) {
+	t.Helper()
+	if os.Getenv("TEST_DB_DRIVER") == "postgres" {
+		return setupTestDB(t)
+	}
+
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=10000", filepath.Join(t.TempDir(), "clearnet.db"))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, migrateModels(db))
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	return db, func() { sqlDB.Close() }
+}
+
+// TestConcurrentTransfers tests that concurrent transfers from one account cannot overdraw it
+func TestConcurrentTransfers(t *testing.T) {
+	db, cleanup := setupConcurrentDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	from := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(from, NewAmount(100), "test"))
+
+	var wg sync.WaitGroup
+	errs := make([]error, concurrentRequests)
+	for i := 0; i < concurrentRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			to := ledger.SelectBeneficiaryAccount(fmt.Sprintf("0xApp%d", i), "0xAlice", "0xUSDC")
+			errs[i] = from.Transfer(TransactionKindAppFund, RPCReference("0xAlice", uint64(i)), to, NewAmount(30))
+		}(i)
+	}
+	wg.Wait()
+
+	// Exactly three transfers of 30 fit into a balance of 100, every other one fails for lack of funds
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInsufficientFunds)
+	}
+	assert.Equal(t, 3, succeeded)
+
+	balance, err := from.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, NewAmount(100-30*int64(succeeded)).String(), balance.String())
+	assert.GreaterOrEqual(t, balance.Sign(), 0)
+
+	var transferred Amount
+	for i := 0; i < concurrentRequests; i++ {
+		appBalance, err := ledger.SelectBeneficiaryAccount(fmt.Sprintf("0xApp%d", i), "0xAlice", "0xUSDC").Balance()
+		require.NoError(t, err)
+		transferred = transferred.Add(appBalance)
+	}
+	assert.Equal(t, NewAmount(30*int64(succeeded)).String(), transferred.String())
+}
+
+// TestConcurrentCreateApplication tests that concurrent app sessions funded by the same participant cannot double-spend
+func TestConcurrentCreateApplication(t *testing.T) {
+	rawKeyA, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerA := Signer{privateKey: rawKeyA}
+	addrA := signerA.GetAddress().Hex()
+
+	rawKeyB, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerB := Signer{privateKey: rawKeyB}
+	addrB := signerB.GetAddress().Hex()
+
+	db, cleanup := setupConcurrentDB(t)
+	defer cleanup()
+
+	tokenAddress := "0xTokenXYZ"
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelA", ParticipantA: addrA, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: tokenAddress, Nonce: 1}).Error)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelB", ParticipantA: addrB, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: tokenAddress, Nonce: 1}).Error)
+
+	ledger := NewLedger(db)
+	channelAccount := ledger.SelectBeneficiaryAccount("0xChannelA", addrA, tokenAddress)
+	require.NoError(t, ledger.Deposit(channelAccount, NewAmount(100), "test"))
+
+	// Build all requests up front; each one uses its own nonce and therefore its own app session
+	nonce := uint64(time.Now().Unix())
+	requests := make([]*RPCRequest, concurrentRequests)
+	for i := range requests {
+		params := CreateApplicationParams{
+			Definition: AppDefinition{
+				Protocol:     "test-proto",
+				Participants: []string{addrA, addrB},
+				Weights:      []uint64{1, 1},
+				Quorum:       2,
+				Challenge:    60,
+				Nonce:        nonce + uint64(i),
+			},
+			Token:       tokenAddress,
+			Allocations: []Amount{NewAmount(30), NewAmount(0)},
+		}
+		requests[i] = newCreateAppRequest(t, uint64(i+1), params, signerA, signerB)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var appIDs []string
+	var failures []error
+	for _, rpcReq := range requests {
+		wg.Add(1)
+		go func(rpcReq *RPCRequest) {
+			defer wg.Done()
+			resp, err := HandleCreateApplication(rpcReq, ledger, nil, addrA)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, err)
+				return
+			}
+			appIDs = append(appIDs, resp.Res.Params[0].(*AppResponse).AppID)
+		}(rpcReq)
+	}
+	wg.Wait()
+
+	assert.Len(t, appIDs, 3)
+	for _, err := range failures {
+		assert.ErrorIs(t, err, ErrInsufficientFunds)
+	}
+
+	balance, err := channelAccount.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, NewAmount(100-30*int64(len(appIDs))).String(), balance.String())
+
+	var sessions int64
+	require.NoError(t, db.Model(&VApp{}).Count(&sessions).Error)
+	assert.Equal(t, int64(len(appIDs)), sessions)
+
+	for _, appID := range appIDs {
+		appBalance, err := ledger.SelectBeneficiaryAccount(appID, addrA, tokenAddress).Balance()
+		require.NoError(t, err)
+		assert.Equal(t, "30", appBalance.String())
+	}
+}
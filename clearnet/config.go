@@ -1,10 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math/big"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
@@ -14,7 +20,17 @@ import (
 // knownNetworks maps network name prefixes to their respective chain IDs.
 // Each prefix is used to find corresponding environment variables:
 // - {PREFIX}_INFURA_URL: The Infura endpoint URL for the network
+// - {PREFIX}_RPC_URLS: Optional comma-separated endpoint URLs, tried after the Infura URL in the given order
 // - {PREFIX}_CUSTODY_CONTRACT_ADDRESS: The custody contract address
+// - {PREFIX}_START_BLOCK: Optional block to backfill events from when the network is first listened to
+// - {PREFIX}_CONFIRMATIONS: Optional number of blocks mined on top of an event before it takes effect
+// - {PREFIX}_LISTEN_MODE: Optional "subscribe" or "poll", chosen from the URL schemes by default
+// - {PREFIX}_POLL_INTERVAL: Optional interval between reads of new events, 5s by default
+// - {PREFIX}_MAX_BLOCK_RANGE: Optional largest block range of a single eth_getLogs request, 1000 by default
+// - {PREFIX}_MAX_FEE_GWEI: Optional highest fee per gas of broker transactions, 500 gwei by default
+// - {PREFIX}_MAX_PRIORITY_FEE_GWEI: Optional highest priority fee per gas of broker transactions, 50 gwei by default
+// - {PREFIX}_CHANNEL_POLICY: Optional JSON policy of the channels the broker joins, every channel by default
+// - {PREFIX}_TX_REPLACE_AFTER: Optional time after which an unmined broker transaction is sent again with higher fees, 3m by default
 var knownNetworks = map[string]string{
 	"POLYGON": "137",
 	"CELO":    "42220",
@@ -25,15 +41,37 @@ var knownNetworks = map[string]string{
 type NetworkConfig struct {
 	Name           string
 	ChainID        string
-	InfuraURL      string
+	RPCURLs        []string // In order of preference
 	CustodyAddress string
+	Listener       ListenerConfig
+	Transactions   TxConfig
+	ChannelPolicy  *ChannelPolicy
 }
 
+// defaultConfirmations is the confirmation depth of networks that do not set one
+const defaultConfirmations = 12
+
+// Defaults of the broker transaction settings of a network
+const (
+	defaultMaxFeeGwei         = 500
+	defaultMaxPriorityFeeGwei = 50
+	defaultTxReplaceAfter     = 3 * time.Minute
+)
+
 // Config represents the overall application configuration
 type Config struct {
 	networks      map[string]*NetworkConfig
 	dbURL         string
 	privateKeyHex string
+	fees          *FeeSchedule
+
+	// State root anchoring is enabled when anchorNetwork names a configured network
+	anchorNetwork  string
+	anchorContract string
+	anchorInterval time.Duration
+
+	// Interval between solvency reports
+	solvencyInterval time.Duration
 }
 
 // LoadConfig builds configuration from environment variables
@@ -63,16 +101,51 @@ func LoadConfig() (*Config, error) {
 		log.Println("BROKER_PRIVATE_KEY environment variable is required")
 	}
 
+	// Broker fees are optional and given as a JSON array of fee rules.
+	var fees *FeeSchedule
+	if feesJSON := os.Getenv("BROKER_FEES"); feesJSON != "" {
+		var err error
+		fees, err = ParseFeeSchedule(feesJSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	anchorInterval := time.Hour
+	if interval := os.Getenv("ANCHOR_INTERVAL"); interval != "" {
+		var err error
+		anchorInterval, err = time.ParseDuration(interval)
+		if err != nil || anchorInterval <= 0 {
+			return nil, fmt.Errorf("invalid ANCHOR_INTERVAL %q", interval)
+		}
+	}
+
+	solvencyInterval := time.Hour
+	if interval := os.Getenv("SOLVENCY_REPORT_INTERVAL"); interval != "" {
+		var err error
+		solvencyInterval, err = time.ParseDuration(interval)
+		if err != nil || solvencyInterval <= 0 {
+			return nil, fmt.Errorf("invalid SOLVENCY_REPORT_INTERVAL %q", interval)
+		}
+	}
+
 	config := Config{
-		networks:      make(map[string]*NetworkConfig),
-		dbURL:         dbURL,
-		privateKeyHex: privateKeyHex,
+		networks:       make(map[string]*NetworkConfig),
+		dbURL:          dbURL,
+		privateKeyHex:  privateKeyHex,
+		fees:           fees,
+		anchorNetwork:  strings.ToLower(os.Getenv("ANCHOR_NETWORK")),
+		anchorContract: os.Getenv("ANCHOR_CONTRACT_ADDRESS"),
+		anchorInterval: anchorInterval,
+
+		solvencyInterval: solvencyInterval,
 	}
 
 	// Process each network
 	envs := os.Environ()
 	for network, chainID := range knownNetworks {
 		infuraURL := ""
+		rpcURLs := ""
 		custodyAddress := ""
 
 		// Look for matching environment variables
@@ -87,19 +160,46 @@ func LoadConfig() (*Config, error) {
 
 			if strings.HasPrefix(key, network+"_INFURA_URL") {
 				infuraURL = value
+			} else if key == network+"_RPC_URLS" {
+				rpcURLs = value
 			} else if strings.HasPrefix(key, network+"_CUSTODY_CONTRACT_ADDRESS") {
 				custodyAddress = value
 			}
 		}
 
-		// Only add network if both required variables are present
-		if infuraURL != "" && custodyAddress != "" {
+		var urls []string
+		for _, u := range append([]string{infuraURL}, strings.Split(rpcURLs, ",")...) {
+			if u = strings.TrimSpace(u); u != "" && !slices.Contains(urls, u) {
+				urls = append(urls, u)
+			}
+		}
+
+		// Only add network if it has an endpoint and a custody contract
+		if len(urls) > 0 && custodyAddress != "" {
+			listener, err := loadListenerConfig(network, urls)
+			if err != nil {
+				return nil, err
+			}
+			transactions, err := loadTxConfig(network)
+			if err != nil {
+				return nil, err
+			}
+			var policy *ChannelPolicy
+			if policyJSON := os.Getenv(network + "_CHANNEL_POLICY"); policyJSON != "" {
+				if policy, err = ParseChannelPolicy(policyJSON); err != nil {
+					return nil, fmt.Errorf("invalid %s_CHANNEL_POLICY: %w", network, err)
+				}
+			}
+
 			networkLower := strings.ToLower(network)
 			config.networks[networkLower] = &NetworkConfig{
 				Name:           networkLower,
 				ChainID:        chainID,
-				InfuraURL:      infuraURL,
+				RPCURLs:        urls,
 				CustodyAddress: custodyAddress,
+				Listener:       listener,
+				Transactions:   transactions,
+				ChannelPolicy:  policy,
 			}
 		}
 	}
@@ -107,6 +207,115 @@ func LoadConfig() (*Config, error) {
 	return &config, nil
 }
 
+// loadListenerConfig reads how events of a network are listened to from its {PREFIX}_* environment variables
+func loadListenerConfig(network string, rpcURLs []string) (ListenerConfig, error) {
+	cfg := ListenerConfig{
+		Mode:          ListenModeSubscribe,
+		PollInterval:  defaultPollInterval,
+		MaxBlockRange: defaultMaxBlockRange,
+		Confirmations: defaultConfirmations,
+	}
+	// The listener may fail over to any endpoint, so it only subscribes if all of them support it
+	for _, u := range rpcURLs {
+		if listenModeForURL(u) == ListenModePoll {
+			cfg.Mode = ListenModePoll
+		}
+	}
+
+	if mode := os.Getenv(network + "_LISTEN_MODE"); mode != "" {
+		cfg.Mode = ListenMode(strings.ToLower(mode))
+		if cfg.Mode != ListenModeSubscribe && cfg.Mode != ListenModePoll {
+			return cfg, fmt.Errorf("invalid %s_LISTEN_MODE %q", network, mode)
+		}
+	}
+	if interval := os.Getenv(network + "_POLL_INTERVAL"); interval != "" {
+		var err error
+		cfg.PollInterval, err = time.ParseDuration(interval)
+		if err != nil || cfg.PollInterval <= 0 {
+			return cfg, fmt.Errorf("invalid %s_POLL_INTERVAL %q", network, interval)
+		}
+	}
+	if blockRange := os.Getenv(network + "_MAX_BLOCK_RANGE"); blockRange != "" {
+		var err error
+		cfg.MaxBlockRange, err = strconv.ParseUint(blockRange, 10, 64)
+		if err != nil || cfg.MaxBlockRange == 0 {
+			return cfg, fmt.Errorf("invalid %s_MAX_BLOCK_RANGE %q", network, blockRange)
+		}
+	}
+	if startBlock := os.Getenv(network + "_START_BLOCK"); startBlock != "" {
+		var err error
+		cfg.StartBlock, err = strconv.ParseUint(startBlock, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s_START_BLOCK %q", network, startBlock)
+		}
+	}
+	if confirmations := os.Getenv(network + "_CONFIRMATIONS"); confirmations != "" {
+		var err error
+		cfg.Confirmations, err = strconv.ParseUint(confirmations, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s_CONFIRMATIONS %q", network, confirmations)
+		}
+	}
+	return cfg, nil
+}
+
+// loadTxConfig reads the fee caps and replacement delay of broker transactions on a network from its {PREFIX}_* environment variables
+func loadTxConfig(network string) (TxConfig, error) {
+	cfg := TxConfig{
+		MaxFeeCap:    new(big.Int).Mul(big.NewInt(defaultMaxFeeGwei), big.NewInt(params.GWei)),
+		MaxTipCap:    new(big.Int).Mul(big.NewInt(defaultMaxPriorityFeeGwei), big.NewInt(params.GWei)),
+		ReplaceAfter: defaultTxReplaceAfter,
+	}
+
+	if fee := os.Getenv(network + "_MAX_FEE_GWEI"); fee != "" {
+		var err error
+		if cfg.MaxFeeCap, err = parseGwei(fee); err != nil {
+			return cfg, fmt.Errorf("invalid %s_MAX_FEE_GWEI %q", network, fee)
+		}
+	}
+	if fee := os.Getenv(network + "_MAX_PRIORITY_FEE_GWEI"); fee != "" {
+		var err error
+		if cfg.MaxTipCap, err = parseGwei(fee); err != nil {
+			return cfg, fmt.Errorf("invalid %s_MAX_PRIORITY_FEE_GWEI %q", network, fee)
+		}
+	}
+	if after := os.Getenv(network + "_TX_REPLACE_AFTER"); after != "" {
+		var err error
+		cfg.ReplaceAfter, err = time.ParseDuration(after)
+		if err != nil || cfg.ReplaceAfter <= 0 {
+			return cfg, fmt.Errorf("invalid %s_TX_REPLACE_AFTER %q", network, after)
+		}
+	}
+	return cfg, nil
+}
+
+// parseGwei converts a positive decimal amount of gwei, such as "0.05", to wei
+func parseGwei(s string) (*big.Int, error) {
+	gwei, ok := new(big.Float).SetPrec(256).SetString(s)
+	if !ok || gwei.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid gwei amount %q", s)
+	}
+	wei, _ := gwei.Mul(gwei, big.NewFloat(params.GWei)).Int(nil)
+	if wei.Sign() <= 0 {
+		return nil, fmt.Errorf("gwei amount %q is below 1 wei", s)
+	}
+	return wei, nil
+}
+
+// listenModeForURL polls HTTP endpoints, which cannot push logs, and subscribes over WebSocket and IPC
+func listenModeForURL(rpcURL string) ListenMode {
+	lower := strings.ToLower(rpcURL)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return ListenModePoll
+	}
+	return ListenModeSubscribe
+}
+
+// migrateModels creates or updates the tables of all models stored by the broker
+func migrateModels(db *gorm.DB) error {
+	return db.AutoMigrate(&Entry{}, &Transaction{}, &LedgerAccount{}, &Hold{}, &ChainHead{}, &StateRoot{}, &StateRootProof{}, &SolvencyReport{}, &LiabilityRoot{}, &ReserveHolding{}, &LiabilityAnomaly{}, &LiabilityProof{}, &ReconciliationRun{}, &Discrepancy{}, &ChannelState{}, &ChallengeResponse{}, &ProcessedEvent{}, &DeadLetterEvent{}, &EventCursor{}, &OutboundTx{}, &RejectedChannel{}, &ChannelTransition{}, &Channel{}, &VApp{}, &RPCRecord{})
+}
+
 // setupDatabase initializes the database connection and performs migrations.
 func setupDatabase(dsn string) (*gorm.DB, error) {
 	var db *gorm.DB
@@ -131,9 +340,42 @@ func setupDatabase(dsn string) (*gorm.DB, error) {
 
 	// Auto-migrate the models.
 	log.Println("Running database migrations...")
-	if err := db.AutoMigrate(&Entry{}, &Channel{}, &VApp{}, &RPCRecord{}); err != nil {
+	// Balances of accounts posted to before balances were materialized must be computed from their entries
+	rebuildBalances := !db.Migrator().HasColumn(&LedgerAccount{}, "balance")
+	backfillBalances := !db.Migrator().HasColumn(&Entry{}, "balance")
+	if err := migrateModels(db); err != nil {
 		return nil, err
 	}
+	// Holds no longer expire; they are released when a newer state is checkpointed
+	if db.Migrator().HasColumn(&Hold{}, "expires_at") {
+		if err := db.Migrator().DropColumn(&Hold{}, "expires_at"); err != nil {
+			return nil, err
+		}
+	}
+	// Superseded by idx_ledger_account_history, which also covers point-in-time lookups
+	if db.Migrator().HasIndex(&Entry{}, "idx_ledger_account") {
+		if err := db.Migrator().DropIndex(&Entry{}, "idx_ledger_account"); err != nil {
+			return nil, err
+		}
+	}
+	if err := backfillEntryAssets(db); err != nil {
+		return nil, err
+	}
+	if backfillBalances {
+		if err := backfillEntryBalances(db); err != nil {
+			return nil, err
+		}
+	}
+	if rebuildBalances {
+		if err := rebuildAccountBalances(db); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range hashChains {
+		if err := initHashChain(db, name); err != nil {
+			return nil, err
+		}
+	}
 	log.Println("Database migrations completed successfully")
 	return db, nil
 }
@@ -1,19 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
@@ -22,62 +22,116 @@ var (
 	custodyAbi *abi.ABI
 )
 
+// ethBackend is the node API used by the custody client
+type ethBackend interface {
+	bind.ContractBackend
+	ethereum.BlockNumberReader
+	ethereum.TransactionReader
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+}
+
 // Custody implements the BlockchainClient interface using the Custody contract
 type Custody struct {
-	client       *ethclient.Client
+	client       ethBackend
+	endpoints    *RPCPool
 	custody      *nitrolite.Custody
 	ledger       *Ledger
 	custodyAddr  common.Address
 	transactOpts *bind.TransactOpts
 	networkID    string
 	signer       *Signer
+	challenges   *ChallengeResponder
+	txs          *TxManager
+	policy       *ChannelPolicy // Nil to join every channel created with the broker
+	metrics      *Metrics
 }
 
-// NewCustody initializes the Ethereum client and custody contract wrapper.
-func NewCustody(signer *Signer, ledger *Ledger, infuraURL, custodyAddressStr, networkID string) (*Custody, error) {
-	custodyAddress := common.HexToAddress(custodyAddressStr)
-	client, err := ethclient.Dial(infuraURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Ethereum node: %w", err)
+// NewCustody initializes the Ethereum client over the network's RPC endpoints, its transaction manager and the custody contract wrapper.
+func NewCustody(signer *Signer, ledger *Ledger, metrics *Metrics, network *NetworkConfig) (*Custody, error) {
+	networkID := network.ChainID
+	custodyAddress := common.HexToAddress(network.CustodyAddress)
+	chainID, ok := new(big.Int).SetString(networkID, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid chain ID %q", networkID)
 	}
 
-	chainID, err := client.ChainID(context.Background())
+	client, err := NewRPCPool(networkID, chainID, network.RPCURLs, metrics)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get chain ID: %w", err)
+		return nil, err
 	}
 
-	// Create auth options for transactions.
+	// Create auth options for transactions, which are sent by the transaction manager.
 	auth, err := bind.NewKeyedTransactorWithChainID(signer.GetPrivateKey(), chainID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transaction signer: %w", err)
 	}
-	auth.GasPrice = big.NewInt(30000000000) // 20 gwei.
-	auth.GasLimit = uint64(3000000)
 
 	custody, err := nitrolite.NewCustody(custodyAddress, client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to bind custody contract: %w", err)
 	}
 
-	return &Custody{
+	c := &Custody{
 		client:       client,
+		endpoints:    client,
 		custody:      custody,
 		ledger:       ledger,
 		custodyAddr:  custodyAddress,
 		transactOpts: auth,
 		networkID:    networkID,
 		signer:       signer,
-	}, nil
+		policy:       network.ChannelPolicy,
+		metrics:      metrics,
+	}
+	c.challenges = NewChallengeResponder(ledger.db, c)
+	c.txs = NewTxManager(ledger.db, client, auth, chainID, networkID, network.Transactions)
+	c.txs.OnUpdate(TxKindJoin, applyJoinTx)
+	c.txs.OnUpdate(TxKindCheckpoint, applyCheckpointTx)
+	c.txs.OnUpdate(TxKindStateRoot, applyStateRootTx)
+	return c, nil
+}
+
+// ListenEvents initializes event listening for the custody contract.
+// Listening resumes after the last processed block; on first start it begins at cfg.StartBlock, or at the current block if it is zero.
+// Events take effect once cfg.Confirmations blocks were mined on top of them.
+func (c *Custody) ListenEvents(ctx context.Context, cfg ListenerConfig) {
+	lastBlock, err := c.resumeBlock(ctx, cfg.StartBlock)
+	for err != nil {
+		log.Printf("Error finding the block to listen from on network %s: %v", c.networkID, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+		lastBlock, err = c.resumeBlock(ctx, cfg.StartBlock)
+	}
+
+	listenEvents(ctx, c.client, c.networkID, c.custodyAddr, c.networkID, lastBlock, cfg, c.handleBlockChainEvent, c.saveEventCursor)
+}
+
+// resumeBlock returns the last block whose custody logs were processed
+func (c *Custody) resumeBlock(ctx context.Context, startBlock uint64) (uint64, error) {
+	block, ok, err := GetEventCursor(c.ledger.db, c.networkID, c.custodyAddr.Hex())
+	if err != nil || ok {
+		return block, err
+	}
+	if startBlock > 0 {
+		return startBlock - 1, nil
+	}
+	return c.client.BlockNumber(ctx)
 }
 
-// ListenEvents initializes event listening for the custody contract
-func (c *Custody) ListenEvents(ctx context.Context) {
-	// TODO: store processed events in a database
-	listenEvents(ctx, c.client, c.networkID, c.custodyAddr, c.networkID, 0, c.handleBlockChainEvent)
+// saveEventCursor records that all logs of the custody contract up to block were processed
+func (c *Custody) saveEventCursor(block uint64) {
+	if err := SaveEventCursor(c.ledger.db, c.networkID, c.custodyAddr.Hex(), block); err != nil {
+		log.Printf("Error saving event cursor of network %s at block %d: %v", c.networkID, block, err)
+	}
 }
 
-// Join calls the join method on the custody contract
-func (c *Custody) Join(channelID string, lastStateData []byte) error {
+// Join queues the join transaction of the channel in db, which may be an open transaction, and returns the broker
+// signature of the joined state. A join that fails marks the channel join_failed.
+func (c *Custody) Join(db *gorm.DB, channelID string, lastStateData []byte) (nitrolite.Signature, error) {
 	// Convert string channelID to bytes32
 	channelIDBytes := common.HexToHash(channelID)
 
@@ -86,224 +140,162 @@ func (c *Custody) Join(channelID string, lastStateData []byte) error {
 
 	sig, err := c.signer.NitroSign(lastStateData)
 	if err != nil {
-		return fmt.Errorf("failed to sign data: %w", err)
+		return nitrolite.Signature{}, fmt.Errorf("failed to sign data: %w", err)
 	}
 
-	gasPrice, err := c.client.SuggestGasPrice(context.Background())
+	data, err := custodyAbi.Pack("join", channelIDBytes, index, sig)
 	if err != nil {
-		return fmt.Errorf("failed to suggest gas price: %w", err)
+		return nitrolite.Signature{}, fmt.Errorf("failed to encode join call: %w", err)
 	}
+	if _, err := c.txs.Enqueue(db, TxKindJoin, channelID, c.custodyAddr, data); err != nil {
+		return nitrolite.Signature{}, fmt.Errorf("failed to join channel: %w", err)
+	}
+
+	return sig, nil
+}
 
-	c.transactOpts.GasPrice = gasPrice.Add(gasPrice, gasPrice)
-	// Call the join method on the custody contract
-	tx, err := c.custody.Join(c.transactOpts, channelIDBytes, index, sig)
+// Checkpoint submits a state signed by both parties to the custody contract, which resolves a challenge with an older state
+func (c *Custody) Checkpoint(ctx context.Context, channelID common.Hash, state nitrolite.State) (common.Hash, error) {
+	data, err := custodyAbi.Pack("checkpoint", channelID, state, []nitrolite.State{})
 	if err != nil {
-		return fmt.Errorf("failed to join channel: %w", err)
+		return common.Hash{}, fmt.Errorf("failed to encode checkpoint call: %w", err)
 	}
-	log.Println("TxHash:", tx.Hash().Hex())
 
-	return nil
+	otx, err := c.txs.Send(ctx, TxKindCheckpoint, channelID.Hex(), c.custodyAddr, data)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to checkpoint channel: %w", err)
+	}
+	return common.HexToHash(otx.TxHash), nil
 }
 
-// handleBlockChainEvent processes different event types received from the blockchain
-func (c *Custody) handleBlockChainEvent(l types.Log) {
-	log.Printf("Received event: %+v\n", l)
+// submittedState decodes the candidate state from the calldata of a transaction calling method of the custody contract for the channel
+func (c *Custody) submittedState(ctx context.Context, txHash common.Hash, method string, channelID common.Hash) (*nitrolite.State, error) {
+	tx, _, err := c.client.TransactionByHash(ctx, txHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction %s: %w", txHash.Hex(), err)
+	}
 
-	eventID := l.Topics[0]
-	switch eventID {
-	case custodyAbi.Events["Created"].ID:
-		ev, err := c.custody.ParseCreated(l)
-		log.Printf("[Created] Event data: %+v\n", ev)
-		if err != nil {
-			fmt.Println("error parsing Created event:", err)
-			return
-		}
+	abiMethod, ok := custodyAbi.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown custody method %s", method)
+	}
+	data := tx.Data()
+	if tx.To() == nil || *tx.To() != c.custodyAddr || len(data) < 4 || !bytes.Equal(data[:4], abiMethod.ID) {
+		return nil, fmt.Errorf("transaction %s does not call %s on the custody contract", txHash.Hex(), method)
+	}
 
-		if len(ev.Channel.Participants) < 2 {
-			log.Println("[Created] Error: not enough participants in the channel")
-			return
-		}
+	args, err := abiMethod.Inputs.Unpack(data[4:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s call: %w", method, err)
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("unexpected %s call arguments", method)
+	}
+	if id, ok := args[0].([32]byte); !ok || common.Hash(id) != channelID {
+		return nil, fmt.Errorf("transaction %s calls %s for another channel", txHash.Hex(), method)
+	}
 
-		participantA := ev.Channel.Participants[0].Hex()
-		nonce := ev.Channel.Nonce
-		participantB := ev.Channel.Participants[1].Hex()
+	state := *abi.ConvertType(args[1], new(nitrolite.State)).(*nitrolite.State)
+	return &state, nil
+}
 
-		// Check if channel was created with the broker.
-		if participantB != BrokerAddress {
-			fmt.Printf("participantB [%s] is not Broker[%s]: ", participantB, BrokerAddress)
-			return
-		}
+// ChallengedState decodes the state a channel was challenged with from the calldata of the challenge transaction
+func (c *Custody) ChallengedState(ctx context.Context, channelID common.Hash, challengeTxHash common.Hash) (*nitrolite.State, error) {
+	return c.submittedState(ctx, challengeTxHash, "challenge", channelID)
+}
 
-		// Check if there is already existing open channel with the broker
-		existingOpenChannel, err := CheckExistingChannels(c.ledger.db, participantA, participantB, c.networkID)
-		if err != nil {
-			log.Printf("[Created] Error checking channels in database: %v", err)
-			return
-		}
+// recordSubmittedState stores the participant countersignature of a state submitted on-chain, if it could be read
+func recordSubmittedState(tx *gorm.DB, channelID common.Hash, state *nitrolite.State) {
+	if state == nil {
+		return
+	}
 
-		if existingOpenChannel != nil {
-			log.Printf("[Created] An open channel with broker already exists: %s", existingOpenChannel.ChannelID)
-			return
-		}
+	channel, err := GetChannelByID(tx, channelID.Hex())
+	if err != nil || channel == nil {
+		log.Printf("Error finding channel %s to record its submitted state: %v", channelID.Hex(), err)
+		return
+	}
 
-		tokenAddress := ev.Initial.Allocations[0].Token.Hex()
-		tokenAmount := ev.Initial.Allocations[0].Amount.Int64()
-
-		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
-		err = CreateChannel(
-			c.ledger.db,
-			channelID,
-			participantA,
-			nonce,
-			ev.Channel.Adjudicator.Hex(),
-			c.networkID,
-			tokenAddress,
-			tokenAmount,
-		)
-		if err != nil {
-			log.Printf("[ChannelCreated] Error creating/updating channel in database: %v", err)
-			return
-		}
+	if err := RecordCountersignature(tx, channel, *state); err != nil {
+		log.Printf("Error recording countersignature of channel %s: %v", channelID.Hex(), err)
+	}
+}
 
-		encodedState, err := nitrolite.EncodeState(ev.ChannelId, nitrolite.IntentINITIALIZE, big.NewInt(0), ev.Initial.Data, ev.Initial.Allocations)
+// stateRootCommitAbi is the interface of contracts receiving state root commitments
+const stateRootCommitAbi = `[{"type":"function","name":"commit","inputs":[{"name":"root","type":"bytes32"}],"outputs":[],"stateMutability":"nonpayable"}]`
+
+// PublishStateRoot commits a ledger state root on-chain and returns the transaction hash.
+// If contract is set, its commit(bytes32) method is called; otherwise the root is sent as calldata
+// of a transaction from the broker to itself.
+func (c *Custody) PublishStateRoot(ctx context.Context, root common.Hash, contract common.Address) (common.Hash, error) {
+	to := c.transactOpts.From
+	data := root[:]
+	if contract != (common.Address{}) {
+		parsed, err := abi.JSON(strings.NewReader(stateRootCommitAbi))
 		if err != nil {
-			log.Printf("[ChannelCreated] Error encoding state hash: %v", err)
-			return
+			return common.Hash{}, fmt.Errorf("failed to parse commit ABI: %w", err)
 		}
-
-		if err := c.Join(channelID, encodedState); err != nil {
-			log.Printf("[ChannelCreated] Error joining channel: %v", err)
-			return
+		if data, err = parsed.Pack("commit", root); err != nil {
+			return common.Hash{}, fmt.Errorf("failed to encode commit call: %w", err)
 		}
+		to = contract
+	}
 
-		log.Printf("[ChannelCreated] Successfully initiated join for channel %s on network %s", channelID, c.networkID)
-
-		log.Printf("[ChannelCreated] Successfully initiated join for channel %s on network %s",
-			channelID, c.networkID)
-
-		account := c.ledger.SelectBeneficiaryAccount(channelID, participantA)
+	otx, err := c.txs.Send(ctx, TxKindStateRoot, root.Hex(), to, data)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to commit state root: %w", err)
+	}
+	return common.HexToHash(otx.TxHash), nil
+}
 
-		if err := account.Record(tokenAmount); err != nil {
-			log.Printf("[ChannelCreated] Error recording initial balance for participant A: %v", err)
-			return
-		}
+// BrokerAvailable returns the broker's balance of token deposited in the custody contract and not locked in any channel
+func (c *Custody) BrokerAvailable(ctx context.Context, token common.Address) (*big.Int, error) {
+	info, err := c.custody.GetAccountInfo(&bind.CallOpts{Context: ctx}, common.HexToAddress(BrokerAddress), token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account info: %w", err)
+	}
+	return info.Available, nil
+}
 
-	case custodyAbi.Events["Joined"].ID:
-		ev, err := c.custody.ParseJoined(l)
-		if err != nil {
-			log.Println("error parsing ChannelJoined event:", err)
-			return
-		}
-		log.Printf("Joined event data: %+v\n", ev)
-
-		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
-		err = c.ledger.db.Transaction(func(tx *gorm.DB) error {
-			var channel Channel
-			result := tx.Where("channel_id = ?", channelID).First(&channel)
-			if result.Error != nil {
-				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return fmt.Errorf("channel with ID %s not found", channelID)
-				}
-				return fmt.Errorf("error finding channel: %w", result.Error)
-			}
-
-			// Update the channel status to "open"
-			channel.Status = ChannelStatusOpen
-			channel.UpdatedAt = time.Now()
-			if err := tx.Save(&channel).Error; err != nil {
-				return fmt.Errorf("failed to close channel: %w", err)
-			}
-			log.Printf("Joined channel with ID: %s", channelID)
-
-			return nil
-		})
-		if err != nil {
-			log.Printf("[Joined] Error closing channel in database: %v", err)
-			return
-		}
+// BrokerChannels returns the IDs of the channels the custody contract lists for the broker
+func (c *Custody) BrokerChannels(ctx context.Context) ([]common.Hash, error) {
+	ids, err := c.custody.GetAccountChannels(&bind.CallOpts{Context: ctx}, common.HexToAddress(BrokerAddress))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account channels: %w", err)
+	}
+	channelIDs := make([]common.Hash, len(ids))
+	for i, id := range ids {
+		channelIDs[i] = common.BytesToHash(id[:])
+	}
+	return channelIDs, nil
+}
 
-	case custodyAbi.Events["Closed"].ID:
-		ev, err := c.custody.ParseClosed(l)
-		if err != nil {
-			log.Println("error parsing ChannelJoined event:", err)
-			return
-		}
-		log.Printf("Closed event data: %+v\n", ev)
-
-		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
-
-		err = c.ledger.db.Transaction(func(tx *gorm.DB) error {
-			var channel Channel
-			result := tx.Where("channel_id = ?", channelID).First(&channel)
-			if result.Error != nil {
-				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return fmt.Errorf("channel with ID %s not found", channelID)
-				}
-				return fmt.Errorf("error finding channel: %w", result.Error)
-			}
-
-			// Update the channel status to "closed"
-			channel.Status = ChannelStatusClosed
-			channel.Amount = 0
-			channel.UpdatedAt = time.Now()
-			channel.Version++
-			if err := tx.Save(&channel).Error; err != nil {
-				return fmt.Errorf("failed to close channel: %w", err)
-			}
-
-			account := c.ledger.SelectBeneficiaryAccount(channelID, channel.ParticipantA)
-			account.db = tx
-			balance, err := account.Balance()
-			if err != nil {
-				log.Printf("[Closed] Error getting balances for participant: %v", err)
-				return err
-			}
-
-			if err := account.Record(-balance); err != nil {
-				log.Printf("[Closed] Error recording initial balance for participant A: %v", err)
-				return err
-			}
-
-			log.Printf("Closed channel with ID: %s", channelID)
-
-			return nil
-		})
-		if err != nil {
-			log.Printf("[Closed] Error closing channel in database: %v", err)
-			return
-		}
+// erc20BalanceAbi is the ERC20 view returning the token balance of an account
+const erc20BalanceAbi = `[{"type":"function","name":"balanceOf","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"}]`
 
-	case custodyAbi.Events["Resized"].ID:
-		ev, err := c.custody.ParseResized(l)
+// CustodyBalance returns the balance of token held by the custody contract for all its users and channels.
+// The custody contract has no view of the funds locked in a single channel, so this is the finest on-chain amount.
+// The zero address stands for the native currency of the network.
+func (c *Custody) CustodyBalance(ctx context.Context, token common.Address) (*big.Int, error) {
+	if token == (common.Address{}) {
+		balance, err := c.client.BalanceAt(ctx, c.custodyAddr, nil)
 		if err != nil {
-			log.Println("error parsing ChannelJoined event:", err)
-			return
-		}
-		log.Printf("Resized event data: %+v\n", ev)
-
-		channelID := common.BytesToHash(ev.ChannelId[:])
-
-		var channel Channel
-		result := c.ledger.db.Where("channel_id = ?", channelID.Hex()).First(&channel)
-		if result.Error != nil {
-			log.Println("error finding channel:", result.Error)
-			return
-		}
-
-		for _, change := range ev.DeltaAllocations {
-			channel.Amount += change.Int64()
+			return nil, fmt.Errorf("failed to get native balance of the custody contract: %w", err)
 		}
+		return balance, nil
+	}
 
-		channel.UpdatedAt = time.Now()
-		channel.Version++
-		if err := c.ledger.db.Save(&channel).Error; err != nil {
-			log.Printf("[Resized] Error saving channel in database: %v", err)
-			return
-		}
+	parsed, err := abi.JSON(strings.NewReader(erc20BalanceAbi))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ERC20 ABI: %w", err)
+	}
 
-	default:
-		fmt.Println("Unknown event ID:", eventID.Hex())
+	var out []any
+	contract := bind.NewBoundContract(token, parsed, c.client, c.client, c.client)
+	if err := contract.Call(&bind.CallOpts{Context: ctx}, &out, "balanceOf", c.custodyAddr); err != nil {
+		return nil, fmt.Errorf("failed to get %s balance of the custody contract: %w", token.Hex(), err)
 	}
+	return *abi.ConvertType(out[0], new(*big.Int)).(**big.Int), nil
 }
 
 // UpdateBalanceMetrics fetches the broker's account information from the smart contract and updates metrics
@@ -333,13 +325,19 @@ func (c *Custody) UpdateBalanceMetrics(ctx context.Context, tokens []common.Addr
 		metrics.BrokerBalanceAvailable.With(prometheus.Labels{
 			"network": c.networkID,
 			"token":   token.Hex(),
-		}).Set(float64(info.Available.Int64()))
+		}).Set(bigToFloat64(info.Available))
 
 		metrics.BrokerChannelCount.With(prometheus.Labels{
 			"network": c.networkID,
 			"token":   token.Hex(),
-		}).Set(float64(info.ChannelCount.Int64()))
+		}).Set(bigToFloat64(info.ChannelCount))
 
 		logger.Infow("Updated contract balance metrics", "network", c.networkID, "token", token.Hex(), "available", info.Available.String(), "channels", info.ChannelCount.String())
 	}
 }
+
+// bigToFloat64 converts a big.Int to float64 for reporting, without wrapping around on overflow
+func bigToFloat64(v *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(v).Float64()
+	return f
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Results of custody event processing reported in metrics
+const (
+	custodyEventProcessed = "processed"
+	custodyEventFailed    = "failed"
+	custodyEventUnparsed  = "unparsed"
+	custodyEventDuplicate = "duplicate"
+	custodyEventReverted  = "reverted"
+)
+
+// errUnparsedEvent marks custody logs that could not be decoded into a known event
+var errUnparsedEvent = errors.New("unparsed custody event")
+
+// ProcessedEvent records a custody contract log whose effects were applied, so that it is never applied twice
+type ProcessedEvent struct {
+	ID          uint   `gorm:"primaryKey"`
+	NetworkID   string `gorm:"column:network_id;not null;uniqueIndex:idx_processed_events_log"`
+	TxHash      string `gorm:"column:tx_hash;not null;uniqueIndex:idx_processed_events_log"`
+	LogIndex    uint   `gorm:"column:log_index;not null;uniqueIndex:idx_processed_events_log"`
+	EventName   string `gorm:"column:event_name;not null"`
+	BlockNumber uint64 `gorm:"column:block_number;not null;index"`
+	BlockHash   string `gorm:"column:block_hash;not null;default:''"`
+	ChannelID   string `gorm:"column:channel_id;not null;default:''"`
+	// JSON of the channel before the event was applied, empty if the channel did not exist; restored if the log is removed by a reorg
+	ChannelSnapshot string `gorm:"column:channel_snapshot;type:text;not null;default:''"`
+	CreatedAt       time.Time
+}
+
+// TableName specifies the table name for the ProcessedEvent model
+func (ProcessedEvent) TableName() string {
+	return "processed_events"
+}
+
+// DeadLetterEvent is a custody contract log that could not be parsed or processed, kept for inspection and replay
+type DeadLetterEvent struct {
+	ID              uint           `gorm:"primaryKey"`
+	NetworkID       string         `gorm:"column:network_id;not null;uniqueIndex:idx_custody_dead_letters_log"`
+	ContractAddress string         `gorm:"column:contract_address;not null"`
+	EventName       string         `gorm:"column:event_name;not null"` // Empty if the event is unknown
+	BlockNumber     uint64         `gorm:"column:block_number;not null"`
+	TxHash          string         `gorm:"column:tx_hash;not null;uniqueIndex:idx_custody_dead_letters_log"`
+	LogIndex        uint           `gorm:"column:log_index;not null;uniqueIndex:idx_custody_dead_letters_log"`
+	Topics          pq.StringArray `gorm:"column:topics;type:text[]"`
+	Data            string         `gorm:"column:data;not null"` // Hex encoded log data
+	Reason          string         `gorm:"column:reason;not null"`
+	CreatedAt       time.Time
+}
+
+// TableName specifies the table name for the DeadLetterEvent model
+func (DeadLetterEvent) TableName() string {
+	return "custody_dead_letters"
+}
+
+// custodyEventHandler applies one type of custody contract event. For events emitted by a call that submits a state,
+// submitted is that state, read before the event transaction is opened, or nil if it could not be read.
+type custodyEventHandler func(c *Custody, ledger *Ledger, l types.Log, submitted *nitrolite.State) error
+
+// submittedStateMethods maps the events emitted by a call that submits a state to the custody method of the call
+var submittedStateMethods = map[string]string{
+	"Checkpointed": "checkpoint",
+	"Resized":      "resize",
+	"Closed":       "close",
+}
+
+// submittedStateTimeout bounds reading the state submitted by the transaction of an event
+const submittedStateTimeout = 10 * time.Second
+
+// custodyEventHandlers maps every event of the custody contract to its handler
+var custodyEventHandlers = map[string]custodyEventHandler{
+	"Created":      (*Custody).handleCreated,
+	"Joined":       (*Custody).handleJoined,
+	"Opened":       (*Custody).handleOpened,
+	"Challenged":   (*Custody).handleChallenged,
+	"Checkpointed": (*Custody).handleCheckpointed,
+	"Resized":      (*Custody).handleResized,
+	"Closed":       (*Custody).handleClosed,
+}
+
+// parseError wraps an error decoding an event log
+func parseError(event string, err error) error {
+	return fmt.Errorf("%w: failed to parse %s event: %v", errUnparsedEvent, event, err)
+}
+
+// handleBlockChainEvent dispatches a custody contract log to the handler of its event.
+// Each log is applied at most once, in the transaction that records it as processed, and reverted if a reorg removes it.
+// Logs that cannot be parsed or processed are stored as dead letters.
+func (c *Custody) handleBlockChainEvent(l types.Log) {
+	if l.Removed {
+		if _, err := c.revertEvent(l); err != nil {
+			log.Printf("Error reverting removed log %d of tx %s: %v", l.Index, l.TxHash.Hex(), err)
+		}
+		return
+	}
+
+	var eventName string
+	var duplicate bool
+	var err error
+	if len(l.Topics) == 0 {
+		err = fmt.Errorf("%w: log has no topics", errUnparsedEvent)
+	} else if event, lookupErr := custodyAbi.EventByID(l.Topics[0]); lookupErr != nil {
+		err = fmt.Errorf("%w: unknown event ID %s", errUnparsedEvent, l.Topics[0].Hex())
+	} else if handler, ok := custodyEventHandlers[event.Name]; !ok {
+		eventName = event.Name
+		err = fmt.Errorf("%w: no handler for %s event", errUnparsedEvent, event.Name)
+	} else {
+		eventName = event.Name
+		// The node is queried before the transaction is opened, so that the ledger is not locked during network I/O
+		submitted := c.readSubmittedState(eventName, l)
+		err = c.ledger.db.Transaction(func(tx *gorm.DB) error {
+			claimed, err := claimEvent(tx, c.networkID, eventName, l)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				duplicate = true
+				return nil
+			}
+			return handler(c, &Ledger{db: tx}, l, submitted)
+		})
+		// Challenge responses are submitted once the challenge is committed
+		if err == nil && !duplicate && eventName == "Challenged" {
+			c.challenges.Notify()
+		}
+	}
+
+	result := custodyEventProcessed
+	if duplicate {
+		result = custodyEventDuplicate
+		log.Printf("[%s] Skipping already processed log %d of tx %s", eventName, l.Index, l.TxHash.Hex())
+	} else if err != nil {
+		result = custodyEventFailed
+		if errors.Is(err, errUnparsedEvent) {
+			result = custodyEventUnparsed
+		}
+		log.Printf("[%s] Error handling event in tx %s: %v", eventName, l.TxHash.Hex(), err)
+		if dlErr := c.deadLetter(l, eventName, err); dlErr != nil {
+			log.Printf("[%s] Error storing dead letter for tx %s: %v", eventName, l.TxHash.Hex(), dlErr)
+		}
+	}
+
+	if c.metrics != nil {
+		label := eventName
+		if label == "" {
+			label = "unknown"
+		}
+		c.metrics.CustodyEvents.WithLabelValues(c.networkID, label, result).Inc()
+	}
+}
+
+// readSubmittedState returns the state submitted by the transaction that emitted l, if the event has one and it can be read
+func (c *Custody) readSubmittedState(eventName string, l types.Log) *nitrolite.State {
+	method, ok := submittedStateMethods[eventName]
+	if !ok || len(l.Topics) < 2 || c.client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), submittedStateTimeout)
+	defer cancel()
+	state, err := c.submittedState(ctx, l.TxHash, method, l.Topics[1])
+	if err != nil {
+		log.Printf("Error reading %s state of channel %s: %v", method, l.Topics[1].Hex(), err)
+		return nil
+	}
+	return state
+}
+
+// claimEvent records the log as processed, with the state of its channel before it is applied,
+// and returns false if it already was
+func claimEvent(tx *gorm.DB, networkID, eventName string, l types.Log) (bool, error) {
+	event := &ProcessedEvent{
+		NetworkID:   networkID,
+		TxHash:      l.TxHash.Hex(),
+		LogIndex:    l.Index,
+		EventName:   eventName,
+		BlockNumber: l.BlockNumber,
+		BlockHash:   l.BlockHash.Hex(),
+	}
+	// Every custody event is indexed by channel ID
+	if len(l.Topics) > 1 {
+		event.ChannelID = l.Topics[1].Hex()
+		snapshot, err := snapshotChannel(tx, event.ChannelID)
+		if err != nil {
+			return false, err
+		}
+		event.ChannelSnapshot = snapshot
+	}
+
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record processed event: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// deadLetter stores a log that failed with reason
+func (c *Custody) deadLetter(l types.Log, eventName string, reason error) error {
+	topics := make(pq.StringArray, len(l.Topics))
+	for i, topic := range l.Topics {
+		topics[i] = topic.Hex()
+	}
+	return c.ledger.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&DeadLetterEvent{
+		NetworkID:       c.networkID,
+		ContractAddress: l.Address.Hex(),
+		EventName:       eventName,
+		BlockNumber:     l.BlockNumber,
+		TxHash:          l.TxHash.Hex(),
+		LogIndex:        l.Index,
+		Topics:          topics,
+		Data:            hexutil.Encode(l.Data),
+		Reason:          reason.Error(),
+	}).Error
+}
+
+// handleCreated joins channels opened with the broker and credits the initial deposit of the participant
+func (c *Custody) handleCreated(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseCreated(l)
+	if err != nil {
+		return parseError("Created", err)
+	}
+	log.Printf("[Created] Event data: %+v\n", ev)
+
+	if len(ev.Channel.Participants) < 2 {
+		return errors.New("not enough participants in the channel")
+	}
+	if len(ev.Initial.Allocations) == 0 {
+		return errors.New("initial state has no allocations")
+	}
+
+	participantA := ev.Channel.Participants[0].Hex()
+	nonce := ev.Channel.Nonce
+	participantB := ev.Channel.Participants[1].Hex()
+
+	// Channels with other counterparties are none of the broker's business
+	if participantB != BrokerAddress {
+		log.Printf("[Created] participantB [%s] is not Broker[%s]", participantB, BrokerAddress)
+		return nil
+	}
+
+	tokenAddress := ev.Initial.Allocations[0].Token.Hex()
+	tokenAmount, err := NewAmountFromBig(ev.Initial.Allocations[0].Amount)
+	if err != nil {
+		return fmt.Errorf("invalid initial allocation amount: %w", err)
+	}
+
+	channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+	request := ChannelRequest{
+		ChannelID:   channelID,
+		NetworkID:   c.networkID,
+		Participant: participantA,
+		Token:       tokenAddress,
+		Amount:      tokenAmount,
+		Adjudicator: ev.Channel.Adjudicator.Hex(),
+		Challenge:   ev.Channel.Challenge,
+	}
+
+	// A participant has at most one channel with the broker per token on each network
+	existingChannel, err := CheckExistingChannels(ledger.db, participantA, participantB, c.networkID, tokenAddress)
+	if err != nil {
+		return fmt.Errorf("error checking channels in database: %w", err)
+	}
+	if existingChannel != nil && existingChannel.ChannelID != channelID {
+		reason := fmt.Sprintf("duplicate channel: channel %s in token %s already exists", existingChannel.ChannelID, tokenAddress)
+		log.Printf("[Created] Rejected channel %s on network %s: %s", channelID, c.networkID, reason)
+		return RecordRejectedChannel(ledger.db, request, reason, l.TxHash.Hex())
+	}
+	if existingChannel != nil {
+		log.Printf("[Created] Channel %s already exists", channelID)
+		return nil
+	}
+
+	reason, err := c.policy.Evaluate(ledger.db, request)
+	if err != nil {
+		return fmt.Errorf("error evaluating channel policy: %w", err)
+	}
+	if reason != "" {
+		log.Printf("[Created] Rejected channel %s on network %s: %s", channelID, c.networkID, reason)
+		return RecordRejectedChannel(ledger.db, request, reason, l.TxHash.Hex())
+	}
+
+	err = CreateChannel(
+		ledger.db,
+		channelID,
+		participantA,
+		nonce,
+		ev.Channel.Adjudicator.Hex(),
+		c.networkID,
+		tokenAddress,
+		tokenAmount,
+	)
+	if err != nil {
+		return fmt.Errorf("error creating channel in database: %w", err)
+	}
+	if err := ledger.db.Model(&Channel{}).Where("channel_id = ?", channelID).Update("challenge", ev.Channel.Challenge).Error; err != nil {
+		return fmt.Errorf("error recording challenge period: %w", err)
+	}
+
+	encodedState, err := nitrolite.EncodeState(ev.ChannelId, nitrolite.IntentINITIALIZE, big.NewInt(0), ev.Initial.Data, ev.Initial.Allocations)
+	if err != nil {
+		return fmt.Errorf("error encoding state hash: %w", err)
+	}
+
+	brokerSig, err := c.Join(ledger.db, channelID, encodedState)
+	if err != nil {
+		return fmt.Errorf("error joining channel: %w", err)
+	}
+
+	// The initial state carries the signature of the participant who created the channel
+	initialState := nitrolite.State{
+		Intent:      uint8(nitrolite.IntentINITIALIZE),
+		Version:     big.NewInt(0),
+		Data:        ev.Initial.Data,
+		Allocations: ev.Initial.Allocations,
+		Sigs:        ev.Initial.Sigs,
+	}
+	if channel, err := GetChannelByID(ledger.db, channelID); err != nil || channel == nil {
+		log.Printf("[Created] Error finding channel to record its initial state: %v", err)
+	} else if _, err := RecordChannelState(ledger.db, channel, initialState, brokerSig); err != nil {
+		log.Printf("[Created] Error recording initial state: %v", err)
+	}
+
+	log.Printf("[Created] Queued join for channel %s on network %s", channelID, c.networkID)
+
+	account := ledger.SelectBeneficiaryAccount(channelID, participantA, tokenAddress)
+	if err := ledger.Deposit(account, tokenAmount, ChainReference(l.TxHash.Hex(), l.Index)); err != nil {
+		return fmt.Errorf("error recording initial balance for participant A: %w", err)
+	}
+	return nil
+}
+
+// handleJoined marks the channel open once the broker joined it
+func (c *Custody) handleJoined(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseJoined(l)
+	if err != nil {
+		return parseError("Joined", err)
+	}
+	log.Printf("[Joined] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+	return ledger.db.Transaction(func(tx *gorm.DB) error {
+		var channel Channel
+		result := tx.Where("channel_id = ?", channelID).First(&channel)
+		if result.Error != nil {
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("channel with ID %s not found", channelID)
+			}
+			return fmt.Errorf("error finding channel: %w", result.Error)
+		}
+
+		if err := TransitionChannel(tx, &channel, ChannelStatusOpen, "joined", l.TxHash.Hex()); err != nil {
+			return fmt.Errorf("failed to open channel: %w", err)
+		}
+		log.Printf("Joined channel with ID: %s", channelID)
+
+		return nil
+	})
+}
+
+// handleOpened marks the channel open once all participants joined it
+func (c *Custody) handleOpened(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseOpened(l)
+	if err != nil {
+		return parseError("Opened", err)
+	}
+	log.Printf("[Opened] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+	channel, err := GetChannelByID(ledger.db, channelID)
+	if err != nil {
+		return err
+	}
+	if channel == nil {
+		log.Printf("[Opened] Channel %s is not a channel of the broker", channelID)
+		return nil
+	}
+	// A channel already opened by the Joined event stays as it is
+	if channel.Status != ChannelStatusJoining && channel.Status != ChannelStatusJoinFailed {
+		return nil
+	}
+	if err := TransitionChannel(ledger.db, channel, ChannelStatusOpen, "opened", l.TxHash.Hex()); err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	return nil
+}
+
+// handleChallenged records a challenge of a channel, to be answered with the latest countersigned state.
+// The response is read and submitted by the challenge responder once the event is committed.
+func (c *Custody) handleChallenged(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseChallenged(l)
+	if err != nil {
+		return parseError("Challenged", err)
+	}
+	log.Printf("[Challenged] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:])
+
+	var expiration time.Time
+	if ev.Expiration != nil && ev.Expiration.Sign() > 0 {
+		expiration = time.Unix(ev.Expiration.Int64(), 0)
+	}
+
+	response, err := c.challenges.RecordChallenge(ledger.db, channelID.Hex(), l.TxHash.Hex(), expiration)
+	if err != nil {
+		return fmt.Errorf("error handling challenge of channel %s: %w", channelID.Hex(), err)
+	}
+	log.Printf("[Challenged] Challenge of channel %s: response %s", channelID.Hex(), response.Status)
+	return nil
+}
+
+// handleCheckpointed confirms checkpoints sent by the broker, records the countersignature of checkpointed states
+// and releases the holds of the states they supersede
+func (c *Custody) handleCheckpointed(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseCheckpointed(l)
+	if err != nil {
+		return parseError("Checkpointed", err)
+	}
+	log.Printf("[Checkpointed] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:])
+	err = ledger.db.Model(&ChallengeResponse{}).
+		Where("channel_id = ? AND tx_hash = ? AND status = ?", channelID.Hex(), l.TxHash.Hex(), ChallengeResponseSubmitted).
+		Update("status", ChallengeResponseConfirmed).Error
+	if err != nil {
+		return fmt.Errorf("failed to confirm challenge response: %w", err)
+	}
+
+	// A checkpoint of a newer state resolves a pending challenge
+	channel, err := GetChannelByID(ledger.db, channelID.Hex())
+	if err != nil {
+		return err
+	}
+	if channel != nil && channel.Status == ChannelStatusChallenged {
+		if err := TransitionChannel(ledger.db, channel, ChannelStatusOpen, "checkpointed", l.TxHash.Hex()); err != nil {
+			return err
+		}
+	}
+
+	// States signed before the checkpointed one can no longer be submitted, so their holds are released
+	// and a channel waiting for one of them is open again
+	if channel != nil && submitted != nil {
+		version := submitted.Version.Uint64()
+		account := ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token)
+		if err := ledger.ReleaseSupersededHolds(account, version); err != nil {
+			return fmt.Errorf("failed to release superseded holds: %w", err)
+		}
+		waiting := channel.Status == ChannelStatusResizing || channel.Status == ChannelStatusClosing
+		if waiting && channel.Version+1 < version {
+			if err := TransitionChannel(ledger.db, channel, ChannelStatusOpen, "checkpointed", l.TxHash.Hex()); err != nil {
+				return err
+			}
+		}
+	}
+
+	recordSubmittedState(ledger.db, channelID, submitted)
+	return nil
+}
+
+// handleResized applies the allocation changes of a resize, credits top-ups and settles the holds placed for it
+func (c *Custody) handleResized(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseResized(l)
+	if err != nil {
+		return parseError("Resized", err)
+	}
+	log.Printf("[Resized] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:])
+
+	err = ledger.db.Transaction(func(tx *gorm.DB) error {
+		var channel Channel
+		if err := tx.Where("channel_id = ?", channelID.Hex()).First(&channel).Error; err != nil {
+			return fmt.Errorf("error finding channel: %w", err)
+		}
+
+		var participantChange Amount
+		for i, change := range ev.DeltaAllocations {
+			delta, err := NewAmountFromBig(change)
+			if err != nil {
+				return fmt.Errorf("invalid delta allocation: %w", err)
+			}
+			channel.Amount = channel.Amount.Add(delta)
+			if i == 0 {
+				participantChange = delta
+			}
+		}
+
+		if err := TransitionChannel(tx, &channel, ChannelStatusOpen, "resized", l.TxHash.Hex()); err != nil {
+			return err
+		}
+		channel.UpdatedAt = time.Now()
+		channel.Version++
+		if err := tx.Save(&channel).Error; err != nil {
+			return fmt.Errorf("error saving channel: %w", err)
+		}
+
+		// Settle the hold placed when the resize state was signed
+		var withdrawn Amount
+		if participantChange.Sign() < 0 {
+			withdrawn = participantChange.Neg()
+		}
+		ledgerTx := &Ledger{db: tx}
+		account := ledgerTx.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token)
+		reference := ChainReference(l.TxHash.Hex(), l.Index)
+		if err := ledgerTx.SettleHolds(account, channel.Version, withdrawn, reference); err != nil {
+			return err
+		}
+
+		// Funds the participant added to the channel are credited like an initial deposit
+		if participantChange.Sign() > 0 {
+			if err := ledgerTx.Deposit(account, participantChange, reference); err != nil {
+				return fmt.Errorf("error recording top-up of participant: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error resizing channel in database: %w", err)
+	}
+
+	recordSubmittedState(ledger.db, channelID, submitted)
+	return nil
+}
+
+// handleClosed closes the channel and withdraws the final allocation of the participant.
+// The allocation is read from the state submitted by the close transaction. Any difference with the ledger balance
+// stays in the channel account, where reconciliation reports it.
+func (c *Custody) handleClosed(ledger *Ledger, l types.Log, submitted *nitrolite.State) error {
+	ev, err := c.custody.ParseClosed(l)
+	if err != nil {
+		return parseError("Closed", err)
+	}
+	log.Printf("[Closed] Event data: %+v\n", ev)
+
+	channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+
+	final := submitted
+	if final == nil {
+		log.Printf("Final state of channel %s is unknown, withdrawing the ledger balance", channelID)
+	}
+
+	err = ledger.db.Transaction(func(tx *gorm.DB) error {
+		var channel Channel
+		result := tx.Where("channel_id = ?", channelID).First(&channel)
+		if result.Error != nil {
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("channel with ID %s not found", channelID)
+			}
+			return fmt.Errorf("error finding channel: %w", result.Error)
+		}
+
+		if err := TransitionChannel(tx, &channel, ChannelStatusClosed, "closed", l.TxHash.Hex()); err != nil {
+			return err
+		}
+		channel.Amount = Amount{}
+		channel.UpdatedAt = time.Now()
+		channel.Version++
+		if err := tx.Save(&channel).Error; err != nil {
+			return fmt.Errorf("failed to close channel: %w", err)
+		}
+
+		ledgerTx := &Ledger{db: tx}
+		account := ledgerTx.SelectBeneficiaryAccount(channelID, channel.ParticipantA, channel.Token)
+		balance, err := account.Balance()
+		if err != nil {
+			return fmt.Errorf("error getting balances for participant: %w", err)
+		}
+
+		withdrawn := balance
+		if final != nil {
+			withdrawn, err = finalAllocation(final, channel.Token)
+			if err != nil {
+				return fmt.Errorf("invalid final state of channel %s: %w", channelID, err)
+			}
+			if withdrawn.Cmp(balance) != 0 {
+				log.Printf("Final allocation %s of channel %s differs from the ledger balance %s of the participant", withdrawn, channelID, balance)
+			}
+		}
+
+		if err := ledgerTx.SettleHolds(account, channel.Version, withdrawn, ChainReference(l.TxHash.Hex(), l.Index)); err != nil {
+			return fmt.Errorf("error settling final balance: %w", err)
+		}
+
+		log.Printf("Closed channel with ID: %s", channelID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error closing channel in database: %w", err)
+	}
+
+	recordSubmittedState(ledger.db, common.BytesToHash(ev.ChannelId[:]), submitted)
+	return nil
+}
+
+// finalAllocation returns the amount allocated to the participant by the final state of a channel
+func finalAllocation(state *nitrolite.State, token string) (Amount, error) {
+	if len(state.Allocations) == 0 {
+		return Amount{}, errors.New("no allocations")
+	}
+	allocation := state.Allocations[0]
+	if allocation.Token.Hex() != normalizeAddress(token) {
+		return Amount{}, fmt.Errorf("allocation of token %s, channel token is %s", allocation.Token.Hex(), token)
+	}
+	return NewAmountFromBig(allocation.Amount)
+}
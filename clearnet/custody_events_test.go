@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCustodyEventDispatch tests that custody logs reach their typed handler and failures are kept as dead letters
+func TestCustodyEventDispatch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	c := &Custody{custody: binding, ledger: NewLedger(db), custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	require.NoError(t, CreateChannel(db, channelID.Hex(), "0xParticipant", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+
+	// Opened marks a joining channel open
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Opened"].ID, channelID},
+		TxHash:  common.HexToHash("0x01"),
+	})
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusOpen, channel.Status)
+
+	// Unknown events, malformed logs and failed processing are dead-lettered
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{crypto.Keccak256Hash([]byte("Deposited(address,address,uint256)"))},
+		TxHash:  common.HexToHash("0x02"),
+	})
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Joined"].ID, channelID},
+		Data:    []byte{0x01},
+		TxHash:  common.HexToHash("0x03"),
+		Index:   4,
+	})
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Opened"].ID},
+		TxHash:  common.HexToHash("0x04"),
+	})
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Joined"].ID, crypto.Keccak256Hash([]byte("unknown"))},
+		Data:    common.LeftPadBytes([]byte{1}, 32),
+		TxHash:  common.HexToHash("0x05"),
+	})
+
+	var deadLetters []DeadLetterEvent
+	require.NoError(t, db.Order("id").Find(&deadLetters).Error)
+	require.Len(t, deadLetters, 4)
+
+	assert.Equal(t, "", deadLetters[0].EventName)
+	assert.Contains(t, deadLetters[0].Reason, "unknown event ID")
+
+	assert.Equal(t, "Joined", deadLetters[1].EventName)
+	assert.Contains(t, deadLetters[1].Reason, "failed to parse Joined event")
+	assert.Equal(t, common.HexToHash("0x03").Hex(), deadLetters[1].TxHash)
+	assert.Equal(t, uint(4), deadLetters[1].LogIndex)
+	assert.Equal(t, "0x01", deadLetters[1].Data)
+	assert.Equal(t, custodyAddr.Hex(), deadLetters[1].ContractAddress)
+	assert.Len(t, deadLetters[1].Topics, 2)
+
+	assert.Equal(t, "Opened", deadLetters[2].EventName)
+	assert.Contains(t, deadLetters[2].Reason, "failed to parse Opened event")
+
+	assert.Equal(t, "Joined", deadLetters[3].EventName)
+	assert.Contains(t, deadLetters[3].Reason, "not found")
+}
+
+// TestCustodyEventReplay tests that a log is applied once however often it is delivered, and retried if it failed
+func TestCustodyEventReplay(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	c := &Custody{custody: binding, ledger: NewLedger(db), custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	joined := types.Log{
+		Address:     custodyAddr,
+		Topics:      []common.Hash{custodyAbi.Events["Joined"].ID, channelID},
+		Data:        common.LeftPadBytes([]byte{1}, 32),
+		BlockNumber: 10,
+		TxHash:      common.HexToHash("0x01"),
+		Index:       2,
+	}
+
+	// A log that fails is not marked processed, so it is applied when delivered again
+	c.handleBlockChainEvent(joined)
+	var processed []ProcessedEvent
+	require.NoError(t, db.Find(&processed).Error)
+	assert.Empty(t, processed)
+
+	require.NoError(t, CreateChannel(db, channelID.Hex(), "0xParticipant", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	c.handleBlockChainEvent(joined)
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusOpen, channel.Status)
+
+	require.NoError(t, db.Find(&processed).Error)
+	require.Len(t, processed, 1)
+	assert.Equal(t, "Joined", processed[0].EventName)
+	assert.Equal(t, uint64(10), processed[0].BlockNumber)
+
+	// Delivering the log again has no effect
+	require.NoError(t, db.Model(channel).Update("status", ChannelStatusJoinFailed).Error)
+	c.handleBlockChainEvent(joined)
+	channel, err = GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusJoinFailed, channel.Status)
+
+	require.NoError(t, db.Find(&processed).Error)
+	assert.Len(t, processed, 1)
+
+	// The same log index in another transaction is another event
+	other := joined
+	other.TxHash = common.HexToHash("0x02")
+	c.handleBlockChainEvent(other)
+	channel, err = GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusOpen, channel.Status)
+}
+
+// TestResizedTopUp tests that funds added to a channel by a resize are credited to the participant
+func TestResizedTopUp(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	sim := simulated.NewBackend(types.GenesisAlloc{})
+	defer sim.Close()
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	ledger := NewLedger(db)
+	c := &Custody{client: sim.Client(), custody: binding, ledger: ledger, custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	require.NoError(t, CreateChannel(db, channelID.Hex(), "0xParticipant", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelID.Hex()).Update("status", ChannelStatusOpen).Error)
+	account := ledger.SelectBeneficiaryAccount(channelID.Hex(), "0xParticipant", "0xUSDC")
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), "test"))
+
+	deltas, err := custodyAbi.Events["Resized"].Inputs.NonIndexed().Pack([]*big.Int{big.NewInt(50), big.NewInt(0)})
+	require.NoError(t, err)
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Resized"].ID, channelID},
+		Data:    deltas,
+		TxHash:  common.HexToHash("0x01"),
+	})
+
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "150", channel.Amount.String())
+	balance, err := account.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "150", balance.String())
+	custody, err := ledger.SelectCustodyAccount(channelID.Hex(), "0xUSDC").Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "-150", custody.String())
+}
+
+// TestClosedFinalAllocation tests that closing a channel withdraws the final allocation submitted on-chain,
+// leaving any difference with the ledger balance in the channel account
+func TestClosedFinalAllocation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	sim := simulated.NewBackend(types.GenesisAlloc{from: {Balance: big.NewInt(params.Ether)}})
+	defer sim.Close()
+	client := sim.Client()
+	ctx := context.Background()
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	ledger := NewLedger(db)
+	c := &Custody{client: client, custody: binding, ledger: ledger, custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	participant := common.HexToAddress("0xB0B0000000000000000000000000000000000001")
+	token := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	require.NoError(t, CreateChannel(db, channelID.Hex(), participant.Hex(), 1, "0xAdjudicator", "137", token.Hex(), NewAmount(100)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelID.Hex()).Update("status", ChannelStatusOpen).Error)
+	account := ledger.SelectBeneficiaryAccount(channelID.Hex(), participant.Hex(), token.Hex())
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), "test"))
+
+	// The final state allocates 60 to the participant, although the ledger still has 100
+	final := nitrolite.State{
+		Version: big.NewInt(2),
+		Data:    []byte{},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant, Token: token, Amount: big.NewInt(60)},
+			{Destination: common.HexToAddress(BrokerAddress), Token: token, Amount: big.NewInt(40)},
+		},
+		Sigs: []nitrolite.Signature{},
+	}
+	data, err := custodyAbi.Pack("close", channelID, final, []nitrolite.State{})
+	require.NoError(t, err)
+	chainID, err := client.ChainID(ctx)
+	require.NoError(t, err)
+	tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+		ChainID:   chainID,
+		GasTipCap: big.NewInt(params.GWei),
+		GasFeeCap: big.NewInt(100 * params.GWei),
+		Gas:       200000,
+		To:        &custodyAddr,
+		Data:      data,
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.SendTransaction(ctx, tx))
+	sim.Commit()
+
+	c.handleBlockChainEvent(types.Log{
+		Address: custodyAddr,
+		Topics:  []common.Hash{custodyAbi.Events["Closed"].ID, channelID},
+		TxHash:  tx.Hash(),
+	})
+
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusClosed, channel.Status)
+	balance, err := account.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "40", balance.String())
+	custody, err := ledger.SelectCustodyAccount(channelID.Hex(), token.Hex()).Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "-40", custody.String())
+}
+
+// TestCheckpointReleasesSupersededHolds tests that checkpointing a state releases the holds of the states signed before it,
+// and reopens a channel that was waiting for one of them
+func TestCheckpointReleasesSupersededHolds(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	sim := simulated.NewBackend(types.GenesisAlloc{from: {Balance: big.NewInt(params.Ether)}})
+	defer sim.Close()
+	client := sim.Client()
+	ctx := context.Background()
+
+	custodyAddr := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	binding, err := nitrolite.NewCustody(custodyAddr, nil)
+	require.NoError(t, err)
+	ledger := NewLedger(db)
+	c := &Custody{client: client, custody: binding, ledger: ledger, custodyAddr: custodyAddr, networkID: "137"}
+
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	participant := common.HexToAddress("0xB0B0000000000000000000000000000000000001")
+	token := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	require.NoError(t, CreateChannel(db, channelID.Hex(), participant.Hex(), 1, "0xAdjudicator", "137", token.Hex(), NewAmount(100)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelID.Hex()).Update("status", ChannelStatusResizing).Error)
+	account := ledger.SelectBeneficiaryAccount(channelID.Hex(), participant.Hex(), token.Hex())
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), "test"))
+	_, err = ledger.PlaceHold(account, NewAmount(40), 1)
+	require.NoError(t, err)
+
+	chainID, err := client.ChainID(ctx)
+	require.NoError(t, err)
+	checkpoint := func(nonce uint64, version int64) common.Hash {
+		state := nitrolite.State{
+			Version: big.NewInt(version),
+			Data:    []byte{},
+			Allocations: []nitrolite.Allocation{
+				{Destination: participant, Token: token, Amount: big.NewInt(100)},
+				{Destination: common.HexToAddress(BrokerAddress), Token: token, Amount: big.NewInt(0)},
+			},
+			Sigs: []nitrolite.Signature{},
+		}
+		data, err := custodyAbi.Pack("checkpoint", channelID, state, []nitrolite.State{})
+		require.NoError(t, err)
+		tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasTipCap: big.NewInt(params.GWei),
+			GasFeeCap: big.NewInt(100 * params.GWei),
+			Gas:       200000,
+			To:        &custodyAddr,
+			Data:      data,
+		})
+		require.NoError(t, err)
+		require.NoError(t, client.SendTransaction(ctx, tx))
+		sim.Commit()
+
+		c.handleBlockChainEvent(types.Log{
+			Address: custodyAddr,
+			Topics:  []common.Hash{custodyAbi.Events["Checkpointed"].ID, channelID},
+			TxHash:  tx.Hash(),
+		})
+		return tx.Hash()
+	}
+	state := func() (ChannelStatus, string) {
+		channel, err := GetChannelByID(db, channelID.Hex())
+		require.NoError(t, err)
+		available, err := account.AvailableBalance()
+		require.NoError(t, err)
+		return channel.Status, available.String()
+	}
+
+	// A checkpoint of the held state itself leaves it to be submitted
+	checkpoint(0, 1)
+	status, available := state()
+	assert.Equal(t, ChannelStatusResizing, status)
+	assert.Equal(t, "60", available)
+
+	// A checkpoint of a later state supersedes it
+	checkpoint(1, 2)
+	status, available = state()
+	assert.Equal(t, ChannelStatusOpen, status)
+	assert.Equal(t, "100", available)
+}
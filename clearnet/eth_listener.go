@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math/big"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +20,10 @@ var logger = log.Logger("base-event-listener")
 
 const (
 	maxBackOffCount = 5
+	// defaultMaxBlockRange is the largest block range requested at once when reading historical logs
+	defaultMaxBlockRange = 1000
+	// defaultPollInterval is how often logs are read from history when polling or waiting for confirmations
+	defaultPollInterval = 5 * time.Second
 )
 
 func init() {
@@ -33,7 +39,37 @@ func init() {
 
 type LogHandler func(l types.Log)
 
-// listenEvents listens for blockchain events and processes them with the provided handler
+// ListenMode selects how new logs are received from a node
+type ListenMode string
+
+const (
+	ListenModeSubscribe ListenMode = "subscribe" // eth_subscribe, over WebSocket or IPC
+	ListenModePoll      ListenMode = "poll"      // eth_getLogs on an interval, for HTTP endpoints
+)
+
+// ListenerConfig controls how the logs of a contract are read from a network
+type ListenerConfig struct {
+	Mode          ListenMode
+	PollInterval  time.Duration // How often logs are read from history when polling or waiting for confirmations
+	MaxBlockRange uint64        // Largest block range requested at once with eth_getLogs
+	Confirmations uint64        // Blocks mined on top of a log before it is handled
+	StartBlock    uint64        // Block to start from the first time the contract is listened to, zero for the current block
+}
+
+// CursorHandler is called with the last block whose logs were all handled
+type CursorHandler func(block uint64)
+
+// logBackend reads contract logs from a node
+type logBackend interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// listenEvents listens for blockchain events and processes them with the provided handler.
+// Logs after lastBlock emitted while not subscribed are backfilled from history, on start and after every reconnect.
+// With confirmations, logs are only handled once that many blocks were mined on top of them, and are read from
+// history every poll interval. Logs removed by a reorg are passed to the handler with Removed set,
+// and the logs from their block on are read again. In poll mode, logs are only read from history.
 func listenEvents(
 	ctx context.Context,
 	client bind.ContractBackend,
@@ -41,16 +77,36 @@ func listenEvents(
 	contractAddress common.Address,
 	networkID string,
 	lastBlock uint64,
+	cfg ListenerConfig,
 	handler LogHandler,
+	saveCursor CursorHandler,
 ) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.Mode == ListenModePoll {
+		pollEvents(ctx, client, subID, contractAddress, networkID, lastBlock, cfg, handler, saveCursor)
+		return
+	}
+	confirmations := cfg.Confirmations
+
 	var backOffCount atomic.Uint64
 	var currentCh chan types.Log
 	var eventSubscription event.Subscription
 
-	logger.Infow("starting listening events", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String())
+	var confirmationCheck <-chan time.Time
+	if confirmations > 0 {
+		ticker := time.NewTicker(cfg.PollInterval)
+		defer ticker.Stop()
+		confirmationCheck = ticker.C
+	}
+
+	logger.Infow("starting listening events", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock, "confirmations", confirmations)
 	for {
 		if eventSubscription == nil {
-			waitForBackOffTimeout(int(backOffCount.Load()))
+			if !waitForBackOffTimeout(ctx, int(backOffCount.Load())) {
+				return
+			}
 
 			currentCh = make(chan types.Log, 100)
 
@@ -64,16 +120,55 @@ func listenEvents(
 				continue
 			}
 
+			// Subscribe first so that no log falls between the backfilled range and the subscription
+			lastBlock, err = backfillEvents(ctx, client, contractAddress, lastBlock, cfg, handler, saveCursor)
+			if err != nil {
+				logger.Errorw("failed to backfill events", "error", err, "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock)
+				eventSub.Unsubscribe()
+				backOffCount.Add(1)
+				continue
+			}
+
 			eventSubscription = eventSub
-			logger.Infow("watching events", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String())
+			logger.Infow("watching events", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock)
 			backOffCount.Store(0)
 		}
 
 		select {
+		case <-ctx.Done():
+			eventSubscription.Unsubscribe()
+			return
 		case eventLog := <-currentCh:
-			lastBlock = eventLog.BlockNumber
-			logger.Debugw("received new event", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "blockNumber", lastBlock, "logIndex", eventLog.Index)
+			if eventLog.Removed {
+				logger.Warnw("event removed by reorg", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "blockNumber", eventLog.BlockNumber, "logIndex", eventLog.Index)
+				handler(eventLog)
+				// Logs of the replaced blocks that are still canonical are read again
+				if eventLog.BlockNumber <= lastBlock {
+					lastBlock = blockBefore(eventLog.BlockNumber)
+					saveCursor(lastBlock)
+				}
+				var err error
+				if lastBlock, err = backfillEvents(ctx, client, contractAddress, lastBlock, cfg, handler, saveCursor); err != nil {
+					logger.Errorw("failed to backfill events after reorg", "error", err, "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock)
+				}
+				continue
+			}
+			if confirmations > 0 || eventLog.BlockNumber <= lastBlock {
+				// Handled by the backfill once confirmed, or already handled by it
+				continue
+			}
+			// All logs of earlier blocks were delivered before this one
+			if blockBefore(eventLog.BlockNumber) > lastBlock {
+				lastBlock = blockBefore(eventLog.BlockNumber)
+				saveCursor(lastBlock)
+			}
+			logger.Debugw("received new event", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "blockNumber", eventLog.BlockNumber, "logIndex", eventLog.Index)
 			handler(eventLog)
+		case <-confirmationCheck:
+			var err error
+			if lastBlock, err = backfillEvents(ctx, client, contractAddress, lastBlock, cfg, handler, saveCursor); err != nil {
+				logger.Errorw("failed to read confirmed events", "error", err, "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock)
+			}
 		case err := <-eventSubscription.Err():
 			if err != nil {
 				logger.Errorw("event subscription error", "error", err, "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String())
@@ -87,15 +182,104 @@ func listenEvents(
 	}
 }
 
-// waitForBackOffTimeout implements exponential backoff between retries
-func waitForBackOffTimeout(backOffCount int) {
-	if backOffCount > maxBackOffCount {
-		logger.Fatalw("back off limit reached, exiting", "backOffCollisionCount", backOffCount)
-		return
+// pollEvents reads the logs of the contract from history every poll interval until ctx is done,
+// for endpoints that do not support subscriptions
+func pollEvents(
+	ctx context.Context,
+	client logBackend,
+	subID string,
+	contractAddress common.Address,
+	networkID string,
+	lastBlock uint64,
+	cfg ListenerConfig,
+	handler LogHandler,
+	saveCursor CursorHandler,
+) {
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+
+	logger.Infow("starting polling events", "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock, "interval", cfg.PollInterval)
+	for {
+		var err error
+		if lastBlock, err = backfillEvents(ctx, client, contractAddress, lastBlock, cfg, handler, saveCursor); err != nil {
+			logger.Errorw("failed to poll events", "error", err, "subID", subID, "networkID", networkID, "contractAddress", contractAddress.String(), "lastBlock", lastBlock)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backfillEvents handles the logs of the contract after lastBlock up to the latest block with cfg.Confirmations
+// confirmations, in ranges of at most cfg.MaxBlockRange blocks, and returns the last block handled
+func backfillEvents(
+	ctx context.Context,
+	client logBackend,
+	contractAddress common.Address,
+	lastBlock uint64,
+	cfg ListenerConfig,
+	handler LogHandler,
+	saveCursor CursorHandler,
+) (uint64, error) {
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return lastBlock, fmt.Errorf("failed to get latest block: %w", err)
+	}
+	if header.Number.Uint64() < cfg.Confirmations {
+		return lastBlock, nil
+	}
+	head := header.Number.Uint64() - cfg.Confirmations
+	blockRange := cfg.MaxBlockRange
+	if blockRange == 0 {
+		blockRange = defaultMaxBlockRange
+	}
+
+	for lastBlock < head {
+		from := lastBlock + 1
+		to := min(from+blockRange-1, head)
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{contractAddress},
+		})
+		if err != nil {
+			return lastBlock, fmt.Errorf("failed to filter logs of blocks %d-%d: %w", from, to, err)
+		}
+		logger.Debugw("backfilling events", "contractAddress", contractAddress.String(), "fromBlock", from, "toBlock", to, "logs", len(logs))
+
+		for _, l := range logs {
+			handler(l)
+		}
+		lastBlock = to
+		saveCursor(lastBlock)
+	}
+	return lastBlock, nil
+}
+
+// blockBefore returns the block preceding block, or the genesis block itself, which has no parent to go back to
+func blockBefore(block uint64) uint64 {
+	if block == 0 {
+		return 0
+	}
+	return block - 1
+}
+
+// waitForBackOffTimeout waits with exponential backoff between retries, capped at 2^maxBackOffCount-1 seconds,
+// and returns false if ctx is done first. Failures of one network never stop the broker.
+func waitForBackOffTimeout(ctx context.Context, backOffCount int) bool {
+	if backOffCount == 0 {
+		return ctx.Err() == nil
 	}
 
-	if backOffCount > 0 {
-		logger.Infow("backing off before subscribing on contract events", "backOffCollisionCount", backOffCount)
-		<-time.After(time.Duration(2^backOffCount-1) * time.Second)
+	delay := time.Duration(1<<min(backOffCount, maxBackOffCount)-1) * time.Second
+	logger.Infow("backing off before subscribing on contract events", "backOffCollisionCount", backOffCount, "delay", delay)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
 	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLogBackend serves logs of a chain with a head moved by the test
+type fakeLogBackend struct {
+	mu      sync.Mutex
+	head    uint64
+	logs    []types.Log
+	queries []ethereum.FilterQuery
+}
+
+func (b *fakeLogBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &types.Header{Number: new(big.Int).SetUint64(b.head)}, nil
+}
+
+func (b *fakeLogBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queries = append(b.queries, q)
+	var logs []types.Log
+	for _, l := range b.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+// TestBackfillEvents tests that missed logs are read in bounded ranges and the cursor follows them
+func TestBackfillEvents(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	contract := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	backend := &fakeLogBackend{
+		head: 2500,
+		logs: []types.Log{
+			{BlockNumber: 90, Index: 0},
+			{BlockNumber: 150, Index: 0},
+			{BlockNumber: 150, Index: 1},
+			{BlockNumber: 2400, Index: 0},
+		},
+	}
+
+	var handled []types.Log
+	handler := func(l types.Log) { handled = append(handled, l) }
+	saveCursor := func(block uint64) {
+		require.NoError(t, SaveEventCursor(db, "137", contract.Hex(), block))
+	}
+
+	_, ok, err := GetEventCursor(db, "137", contract.Hex())
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	lastBlock, err := backfillEvents(context.Background(), backend, contract, 99, ListenerConfig{}, handler, saveCursor)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2500), lastBlock)
+
+	// Blocks 100 to 2500 are read in three ranges, skipping logs up to the last processed block
+	require.Len(t, backend.queries, 3)
+	assert.Equal(t, uint64(100), backend.queries[0].FromBlock.Uint64())
+	assert.Equal(t, uint64(1099), backend.queries[0].ToBlock.Uint64())
+	assert.Equal(t, uint64(2100), backend.queries[2].FromBlock.Uint64())
+	assert.Equal(t, uint64(2500), backend.queries[2].ToBlock.Uint64())
+	assert.Equal(t, []common.Address{contract}, backend.queries[0].Addresses)
+	require.Len(t, handled, 3)
+	assert.Equal(t, uint64(150), handled[0].BlockNumber)
+	assert.Equal(t, uint(1), handled[1].Index)
+
+	cursor, ok, err := GetEventCursor(db, "137", contract.Hex())
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2500), cursor)
+
+	// Nothing is read when the cursor is at the head
+	backend.queries = nil
+	lastBlock, err = backfillEvents(context.Background(), backend, contract, cursor, ListenerConfig{}, handler, saveCursor)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2500), lastBlock)
+	assert.Empty(t, backend.queries)
+	assert.Len(t, handled, 3)
+
+	// Blocks without enough confirmations are left for later
+	backend.head = 2600
+	lastBlock, err = backfillEvents(context.Background(), backend, contract, cursor, ListenerConfig{Confirmations: 50}, handler, saveCursor)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2550), lastBlock)
+	require.Len(t, backend.queries, 1)
+	assert.Equal(t, uint64(2501), backend.queries[0].FromBlock.Uint64())
+	assert.Equal(t, uint64(2550), backend.queries[0].ToBlock.Uint64())
+}
+
+// TestPollEvents tests that polling reads new logs in bounded ranges as the chain grows
+func TestPollEvents(t *testing.T) {
+	contract := common.HexToAddress("0xC0570D1000000000000000000000000000000001")
+	backend := &fakeLogBackend{
+		head: 100,
+		logs: []types.Log{
+			{BlockNumber: 60, Index: 0},
+			{BlockNumber: 120, Index: 0},
+			{BlockNumber: 150, Index: 0},
+		},
+	}
+
+	var mu sync.Mutex
+	var handled []uint64
+	var cursor uint64
+	handler := func(l types.Log) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, l.BlockNumber)
+	}
+	saveCursor := func(block uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		cursor = block
+	}
+	progress := func() ([]uint64, uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint64(nil), handled...), cursor
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := ListenerConfig{Mode: ListenModePoll, PollInterval: 10 * time.Millisecond, MaxBlockRange: 20, Confirmations: 5}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pollEvents(ctx, backend, "test", contract, "137", 50, cfg, handler, saveCursor)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, cursor := progress()
+		return cursor == 95
+	}, time.Second, 5*time.Millisecond)
+	blocks, _ := progress()
+	assert.Equal(t, []uint64{60}, blocks)
+
+	backend.mu.Lock()
+	backend.head = 200
+	backend.mu.Unlock()
+	require.Eventually(t, func() bool {
+		_, cursor := progress()
+		return cursor == 195
+	}, time.Second, 5*time.Millisecond)
+	blocks, _ = progress()
+	assert.Equal(t, []uint64{60, 120, 150}, blocks)
+
+	// Every request stays within the block range
+	backend.mu.Lock()
+	for _, q := range backend.queries {
+		assert.LessOrEqual(t, q.ToBlock.Uint64()-q.FromBlock.Uint64()+1, uint64(20))
+	}
+	backend.mu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("polling did not stop")
+	}
+}
+
+// TestListenModeForURL tests that HTTP endpoints are polled and others subscribed to
+func TestListenModeForURL(t *testing.T) {
+	assert.Equal(t, ListenModePoll, listenModeForURL("https://polygon-mainnet.infura.io/v3/key"))
+	assert.Equal(t, ListenModePoll, listenModeForURL("HTTP://localhost:8545"))
+	assert.Equal(t, ListenModeSubscribe, listenModeForURL("wss://polygon-mainnet.infura.io/ws/v3/key"))
+	assert.Equal(t, ListenModeSubscribe, listenModeForURL("/var/run/geth.ipc"))
+}
+
+// TestBlockBefore tests that going back from the genesis block does not wrap around
+func TestBlockBefore(t *testing.T) {
+	assert.Equal(t, uint64(41), blockBefore(42))
+	assert.Equal(t, uint64(0), blockBefore(1))
+	assert.Equal(t, uint64(0), blockBefore(0))
+}
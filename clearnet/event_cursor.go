@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EventCursor is the last block whose logs of a contract were all processed, from which listening resumes after a restart
+type EventCursor struct {
+	ID              uint   `gorm:"primaryKey"`
+	NetworkID       string `gorm:"column:network_id;not null;uniqueIndex:idx_event_cursors_contract"`
+	ContractAddress string `gorm:"column:contract_address;not null;uniqueIndex:idx_event_cursors_contract"`
+	BlockNumber     uint64 `gorm:"column:block_number;not null"`
+	UpdatedAt       time.Time
+}
+
+// TableName specifies the table name for the EventCursor model
+func (EventCursor) TableName() string {
+	return "event_cursors"
+}
+
+// GetEventCursor returns the last processed block of a contract, and false if its logs were never processed
+func GetEventCursor(db *gorm.DB, networkID, contractAddress string) (uint64, bool, error) {
+	var cursors []EventCursor
+	err := db.Where("network_id = ? AND contract_address = ?", networkID, contractAddress).Limit(1).Find(&cursors).Error
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read event cursor: %w", err)
+	}
+	if len(cursors) == 0 {
+		return 0, false, nil
+	}
+	return cursors[0].BlockNumber, true, nil
+}
+
+// SaveEventCursor stores the last processed block of a contract
+func SaveEventCursor(db *gorm.DB, networkID, contractAddress string, block uint64) error {
+	cursor := &EventCursor{
+		NetworkID:       networkID,
+		ContractAddress: contractAddress,
+		BlockNumber:     block,
+		UpdatedAt:       time.Now(),
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "network_id"}, {Name: "contract_address"}},
+		DoUpdates: clause.AssignmentColumns([]string{"block_number", "updated_at"}),
+	}).Create(cursor).Error
+	if err != nil {
+		return fmt.Errorf("failed to save event cursor: %w", err)
+	}
+	return nil
+}
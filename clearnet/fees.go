@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// BrokerFeeAccountID is the ledger account collecting the fees charged by the broker.
+// Its beneficiary is the broker address.
+const BrokerFeeAccountID = "broker_fees"
+
+// maxFeeBPS is the largest fee in basis points, which charges the whole amount
+const maxFeeBPS = 10000
+
+// FeeRule describes the fee charged for moving funds in or out of app sessions.
+// Empty selectors match any value; the rule matching the most selectors applies.
+type FeeRule struct {
+	Method   string `json:"method,omitempty"`   // RPC method, create_app_session or close_app_session
+	Token    string `json:"token,omitempty"`    // Token address of the asset
+	Network  string `json:"network,omitempty"`  // Chain ID of the participant's channel
+	Protocol string `json:"protocol,omitempty"` // Protocol of the app session
+	Flat     Amount `json:"flat"`               // Fixed fee per charged allocation
+	BPS      uint64 `json:"bps"`                // Fee in basis points of the allocation
+}
+
+// FeeSchedule holds the fee rules of the broker. A nil schedule charges no fees.
+type FeeSchedule struct {
+	rules []FeeRule
+}
+
+// ParseFeeSchedule parses a JSON array of fee rules
+func ParseFeeSchedule(data string) (*FeeSchedule, error) {
+	var rules []FeeRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, fmt.Errorf("invalid fee schedule: %w", err)
+	}
+	return NewFeeSchedule(rules...)
+}
+
+// NewFeeSchedule validates the fee rules and creates a fee schedule
+func NewFeeSchedule(rules ...FeeRule) (*FeeSchedule, error) {
+	for i, rule := range rules {
+		if rule.Flat.Sign() < 0 {
+			return nil, fmt.Errorf("fee rule %d: flat fee must not be negative", i)
+		}
+		if rule.BPS > maxFeeBPS {
+			return nil, fmt.Errorf("fee rule %d: fee must not exceed %d basis points", i, maxFeeBPS)
+		}
+	}
+	return &FeeSchedule{rules: rules}, nil
+}
+
+// rule returns the most specific rule matching the given selectors.
+// Among equally specific rules the first one wins.
+func (s *FeeSchedule) rule(method, token, network, protocol string) (FeeRule, bool) {
+	if s == nil {
+		return FeeRule{}, false
+	}
+
+	best, bestScore := -1, -1
+	for i, rule := range s.rules {
+		score := 0
+		for _, selector := range []struct{ want, got string }{
+			{rule.Method, method},
+			{rule.Token, token},
+			{rule.Network, network},
+			{rule.Protocol, protocol},
+		} {
+			if selector.want == "" {
+				continue
+			}
+			if !strings.EqualFold(selector.want, selector.got) {
+				score = -1
+				break
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	if best < 0 {
+		return FeeRule{}, false
+	}
+	return s.rules[best], true
+}
+
+// Fee returns the fee charged on amount. The fee never exceeds the amount, and nothing is charged on zero amounts.
+func (s *FeeSchedule) Fee(method, token, network, protocol string, amount Amount) Amount {
+	rule, ok := s.rule(method, token, network, protocol)
+	if !ok || amount.Sign() <= 0 {
+		return Amount{}
+	}
+
+	fee := new(big.Int).Mul(amount.Big(), new(big.Int).SetUint64(rule.BPS))
+	fee.Quo(fee, big.NewInt(maxFeeBPS))
+	fee.Add(fee, rule.Flat.Big())
+	if fee.Cmp(amount.Big()) > 0 {
+		return amount
+	}
+
+	// The fee is at most amount, so it always fits
+	result, _ := NewAmountFromBig(fee)
+	return result
+}
+
+// SelectFeeAccount returns the broker fee account for an asset
+func (l *Ledger) SelectFeeAccount(asset string) *BeneficiaryAccount {
+	return l.SelectBeneficiaryAccount(BrokerFeeAccountID, BrokerAddress, asset)
+}
+
+// ChargeFee moves a fee from account to the broker fee account as a fee journal transaction
+func (l *Ledger) ChargeFee(account *BeneficiaryAccount, fee Amount, reference string) error {
+	if fee.Sign() < 0 {
+		return errors.New("fee must be positive")
+	}
+
+	_, err := l.Post(TransactionKindFee, reference,
+		Posting{Account: account, Amount: fee.Neg()},
+		Posting{Account: l.SelectFeeAccount(account.Asset), Amount: fee},
+	)
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFeeSchedule tests fee rule selection and fee calculation
+func TestFeeSchedule(t *testing.T) {
+	fees, err := ParseFeeSchedule(`[
+		{"bps": 10},
+		{"token": "0xUSDC", "flat": "5", "bps": 0},
+		{"token": "0xUSDC", "network": "137", "protocol": "game", "flat": "1", "bps": 100},
+		{"method": "close_app_session", "bps": 10000}
+	]`)
+	require.NoError(t, err)
+
+	// Default rule
+	assert.Equal(t, "1", fees.Fee("create_app_session", "0xWETH", "8453", "chat", NewAmount(1999)).String())
+	// Token rule, matched case-insensitively
+	assert.Equal(t, "5", fees.Fee("create_app_session", "0xusdc", "8453", "chat", NewAmount(1000)).String())
+	// Most specific rule wins
+	assert.Equal(t, "11", fees.Fee("create_app_session", "0xUSDC", "137", "game", NewAmount(1000)).String())
+	// Fees never exceed the amount and are not charged on zero amounts
+	assert.Equal(t, "3", fees.Fee("create_app_session", "0xUSDC", "8453", "chat", NewAmount(3)).String())
+	assert.Equal(t, "0", fees.Fee("create_app_session", "0xUSDC", "8453", "chat", NewAmount(0)).String())
+	assert.Equal(t, "700", fees.Fee("close_app_session", "0xWETH", "8453", "chat", NewAmount(700)).String())
+
+	// A nil schedule charges nothing
+	var none *FeeSchedule
+	assert.Equal(t, "0", none.Fee("create_app_session", "0xUSDC", "137", "game", NewAmount(1000)).String())
+
+	_, err = ParseFeeSchedule(`[{"bps": 10001}]`)
+	assert.Error(t, err)
+	_, err = ParseFeeSchedule(`[{"flat": "-1"}]`)
+	assert.Error(t, err)
+}
+
+// TestAppSessionFees tests that fees are charged to participants on app session create and close
+func TestAppSessionFees(t *testing.T) {
+	rawKeyA, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerA := Signer{privateKey: rawKeyA}
+	addrA := signerA.GetAddress().Hex()
+
+	rawKeyB, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerB := Signer{privateKey: rawKeyB}
+	addrB := signerB.GetAddress().Hex()
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tokenAddress := "0xTokenXYZ"
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelA", ParticipantA: addrA, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: tokenAddress, NetworkID: "137", Nonce: 1}).Error)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelB", ParticipantA: addrB, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: tokenAddress, NetworkID: "137", Nonce: 1}).Error)
+
+	ledger := NewLedger(db)
+	channelAccountA := ledger.SelectBeneficiaryAccount("0xChannelA", addrA, tokenAddress)
+	channelAccountB := ledger.SelectBeneficiaryAccount("0xChannelB", addrB, tokenAddress)
+	require.NoError(t, ledger.Deposit(channelAccountA, NewAmount(1000), "test"))
+
+	// 1% on create, a flat fee of 3 on close
+	fees, err := NewFeeSchedule(
+		FeeRule{Method: "create_app_session", BPS: 100},
+		FeeRule{Method: "close_app_session", Flat: NewAmount(3)},
+	)
+	require.NoError(t, err)
+
+	params := CreateApplicationParams{
+		Definition: AppDefinition{
+			Protocol:     "test-proto",
+			Participants: []string{addrA, addrB},
+			Weights:      []uint64{1, 1},
+			Quorum:       2,
+			Challenge:    60,
+			Nonce:        uint64(time.Now().Unix()),
+		},
+		Token:       tokenAddress,
+		Allocations: []Amount{NewAmount(500), NewAmount(0)},
+	}
+	resp, err := HandleCreateApplication(newCreateAppRequest(t, 1, params, signerA, signerB), ledger, fees, addrA)
+	require.NoError(t, err)
+
+	appResp, ok := resp.Res.Params[0].(*AppResponse)
+	require.True(t, ok)
+	require.Len(t, appResp.Fees, 2)
+	assert.Equal(t, "5", appResp.Fees[0].String())
+	assert.Equal(t, "0", appResp.Fees[1].String())
+
+	balance, err := channelAccountA.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "495", balance.String())
+
+	// Close with an allocation to each participant; both pay the flat fee
+	closeParams := CloseApplicationParams{
+		AppID:            appResp.AppID,
+		FinalAllocations: []Amount{NewAmount(400), NewAmount(100)},
+	}
+	closeReq := &RPCRequest{
+		Req: RPCData{
+			RequestID: 2,
+			Method:    "close_app_session",
+			Params:    []any{closeParams},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	signBytes, err := json.Marshal(CloseAppSignData{
+		RequestID: closeReq.Req.RequestID,
+		Method:    closeReq.Req.Method,
+		Params:    []CloseApplicationParams{closeParams},
+		Timestamp: closeReq.Req.Timestamp,
+	})
+	require.NoError(t, err)
+	for _, signer := range []Signer{signerA, signerB} {
+		sig, err := signer.Sign(signBytes)
+		require.NoError(t, err)
+		closeReq.Sig = append(closeReq.Sig, hexutil.Encode(sig))
+	}
+
+	resp, err = HandleCloseApplication(closeReq, ledger, fees, addrA)
+	require.NoError(t, err)
+	appResp, ok = resp.Res.Params[0].(*AppResponse)
+	require.True(t, ok)
+	require.Len(t, appResp.Fees, 2)
+	assert.Equal(t, "3", appResp.Fees[0].String())
+	assert.Equal(t, "3", appResp.Fees[1].String())
+
+	balance, err = channelAccountA.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "892", balance.String())
+
+	balance, err = channelAccountB.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "97", balance.String())
+
+	revenue, err := ledger.SelectFeeAccount(tokenAddress).Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "11", revenue.String())
+
+	var feeTransactions int64
+	require.NoError(t, db.Model(&Transaction{}).Where("kind = ?", TransactionKindFee).Count(&feeTransactions).Error)
+	assert.Equal(t, int64(3), feeTransactions)
+}
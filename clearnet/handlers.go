@@ -31,7 +31,8 @@ type AppDefinition struct {
 type CreateApplicationParams struct {
 	Definition  AppDefinition `json:"definition"`
 	Token       string        `json:"token"`
-	Allocations []int64       `json:"allocations"`
+	Allocations []Amount      `json:"allocations"`
+	ChannelIDs  []string      `json:"channel_ids,omitempty"` // Channel funding each participant, empty for the participant's channel in the token
 }
 
 type CreateAppSignData struct {
@@ -48,8 +49,9 @@ func (r CreateAppSignData) MarshalJSON() ([]byte, error) {
 
 // CloseApplicationParams represents parameters needed for virtual app closure
 type CloseApplicationParams struct {
-	AppID            string  `json:"app_id"`
-	FinalAllocations []int64 `json:"allocations"`
+	AppID            string   `json:"app_id"`
+	FinalAllocations []Amount `json:"allocations"`
+	ChannelIDs       []string `json:"channel_ids,omitempty"` // Channel receiving each allocation, empty for the channel that funded the participant
 }
 
 type CloseAppSignData struct {
@@ -66,8 +68,10 @@ func (r CloseAppSignData) MarshalJSON() ([]byte, error) {
 
 // AppResponse represents response data for application operations
 type AppResponse struct {
-	AppID  string `json:"app_id"`
-	Status string `json:"status"`
+	AppID  string   `json:"app_id"`
+	Status string   `json:"status"`
+	Fees   []Amount `json:"fees,omitempty"`   // Broker fee charged to each participant, in the order of participants
+	Errors []string `json:"errors,omitempty"` // Why the allocation of each participant was not settled, empty if it was
 }
 
 // ResizeChannelParams represents parameters needed for resizing a channel
@@ -133,7 +137,130 @@ type Signature struct {
 // AvailableBalance represents a participant's availability for virtual apps
 type AvailableBalance struct {
 	Address string `json:"address"`
-	Amount  int64  `json:"amount"`
+	Asset   string `json:"asset"`
+	Amount  Amount `json:"amount"`
+}
+
+// GetLedgerBalancesParams represents parameters for querying the balances of a ledger account.
+// AsOf is a Unix timestamp in seconds; AsOfEntry is a ledger entry ID.
+type GetLedgerBalancesParams struct {
+	AccountID string `json:"acc"`
+	Asset     string `json:"asset,omitempty"`
+	AsOf      uint64 `json:"as_of,omitempty"`
+	AsOfEntry uint   `json:"as_of_entry,omitempty"`
+}
+
+// GetLedgerEntriesParams represents parameters for listing ledger entries.
+// StartTime and EndTime are Unix timestamps in seconds; Cursor is the next_cursor of the previous page.
+type GetLedgerEntriesParams struct {
+	AccountID   string `json:"acc,omitempty"`
+	Beneficiary string `json:"beneficiary,omitempty"`
+	Asset       string `json:"asset,omitempty"`
+	StartTime   uint64 `json:"start_time,omitempty"`
+	EndTime     uint64 `json:"end_time,omitempty"`
+	Cursor      uint   `json:"cursor,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+}
+
+// LedgerEntryResponse represents a ledger entry with the running balance of its account
+type LedgerEntryResponse struct {
+	ID            uint   `json:"id"`
+	TransactionID uint   `json:"transaction_id"`
+	AccountID     string `json:"acc"`
+	Beneficiary   string `json:"beneficiary"`
+	Asset         string `json:"asset"`
+	Credit        Amount `json:"credit"`
+	Debit         Amount `json:"debit"`
+	Balance       Amount `json:"balance"`
+	CreatedAt     uint64 `json:"created_at"`
+}
+
+// LedgerEntriesResponse represents a page of ledger entries, newest first
+type LedgerEntriesResponse struct {
+	Entries    []LedgerEntryResponse `json:"entries"`
+	NextCursor uint                  `json:"next_cursor,omitempty"` // Omitted on the last page
+}
+
+const (
+	defaultLedgerEntriesLimit = 50
+	maxLedgerEntriesLimit     = 500
+)
+
+// GetStateProofParams represents parameters for requesting the proof of a balance against a state root
+type GetStateProofParams struct {
+	AccountID   string `json:"acc"`
+	Beneficiary string `json:"beneficiary"`
+	Asset       string `json:"asset"`
+	RootID      uint   `json:"root_id,omitempty"` // Latest published root if omitted
+}
+
+// StateProofResponse represents the inclusion proof of a balance in a published state root
+type StateProofResponse struct {
+	RootID      uint     `json:"root_id"`
+	Root        string   `json:"root"`
+	LastEntryID uint     `json:"last_entry_id"`
+	Network     string   `json:"network"`
+	TxHash      string   `json:"tx_hash"`
+	PublishedAt uint64   `json:"published_at"`
+	Balance     Amount   `json:"balance"`
+	Leaf        string   `json:"leaf"`
+	Proof       []string `json:"proof"`
+}
+
+// GetLiabilityProofParams represents parameters for getting the inclusion proofs of the caller's balances in a solvency report
+type GetLiabilityProofParams struct {
+	ReportID uint   `json:"report_id,omitempty"` // Latest report if omitted
+	Asset    string `json:"asset,omitempty"`     // All assets if omitted
+}
+
+// LiabilityProofNode represents a sibling node of a Merkle sum proof
+type LiabilityProofNode struct {
+	Hash string `json:"hash"`
+	Sum  Amount `json:"sum"`
+}
+
+// AssetLiabilityProof represents the inclusion proof of a balance in the liability root of its asset
+type AssetLiabilityProof struct {
+	Asset    string               `json:"asset"`
+	Balance  Amount               `json:"balance"`
+	Leaf     string               `json:"leaf"`
+	Root     string               `json:"root"`
+	Total    Amount               `json:"total"`
+	Holdings Amount               `json:"holdings"`
+	Proof    []LiabilityProofNode `json:"proof"`
+}
+
+// LiabilityProofResponse represents the inclusion proofs of a user's balances in a solvency report
+type LiabilityProofResponse struct {
+	ReportID    uint                  `json:"report_id"`
+	LastEntryID uint                  `json:"last_entry_id"`
+	CreatedAt   uint64                `json:"created_at"`
+	Beneficiary string                `json:"beneficiary"`
+	Proofs      []AssetLiabilityProof `json:"proofs"`
+}
+
+// GetChannelStatesParams represents parameters for getting the states signed for a channel
+type GetChannelStatesParams struct {
+	ChannelID string `json:"channel_id"`
+}
+
+// CountersignStateParams represents parameters for countersigning a channel state signed by the broker
+type CountersignStateParams struct {
+	ChannelID string    `json:"channel_id"`
+	StateHash string    `json:"state_hash"`
+	Signature Signature `json:"signature"` // Participant signature over the state hash
+}
+
+// ChannelStateResponse represents a channel state signed by the broker
+type ChannelStateResponse struct {
+	Version              uint64       `json:"version"`
+	Intent               uint8        `json:"intent"`
+	StateData            string       `json:"state_data"`
+	Allocations          []Allocation `json:"allocations"`
+	StateHash            string       `json:"state_hash"`
+	Signature            Signature    `json:"server_signature"`
+	ParticipantSignature *Signature   `json:"participant_signature,omitempty"` // Omitted until the participant countersigns
+	CreatedAt            uint64       `json:"created_at"`
 }
 
 // BrokerConfig represents the broker configuration information
@@ -156,21 +283,36 @@ func HandlePing(rpc *RPCRequest) (*RPCResponse, error) {
 	return CreateResponse(rpc.Req.RequestID, "pong", []any{}, time.Now()), nil
 }
 
-// HandleGetLedgerBalances returns a list of participants and their balances for a ledger account
-func HandleGetLedgerBalances(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, error) {
-	var accountID string
+// HandleGetLedgerBalances returns a list of participants and their balances per asset for a ledger account.
+// If as_of or as_of_entry is given, balances are computed at that point in the ledger history,
+// for one of the sender's channels or an app session it takes part in.
+func HandleGetLedgerBalances(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	var params GetLedgerBalancesParams
 
 	if len(rpc.Req.Params) > 0 {
 		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
-		if err == nil {
-			var params map[string]string
-			if err := json.Unmarshal(paramsJSON, &params); err == nil {
-				accountID = params["acc"]
-			}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameters: %w", err)
+		}
+		if err := json.Unmarshal(paramsJSON, &params); err != nil {
+			return nil, fmt.Errorf("invalid parameters format: %w", err)
 		}
 	}
 
-	balances, err := GetAccountBalances(ledger.db, accountID)
+	var balances []AvailableBalance
+	var err error
+	if params.AsOf > 0 || params.AsOfEntry > 0 {
+		if err := authorizeAccount(ledger.db, params.AccountID, sender); err != nil {
+			return nil, err
+		}
+		asOf := AsOf{EntryID: params.AsOfEntry}
+		if params.AsOf > 0 {
+			asOf.Time = time.Unix(int64(params.AsOf), 0)
+		}
+		balances, err = GetAccountBalancesAsOf(ledger.db, params.AccountID, params.Asset, asOf)
+	} else {
+		balances, err = GetAccountBalances(ledger.db, params.AccountID, params.Asset)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to find account: %w", err)
 	}
@@ -179,8 +321,222 @@ func HandleGetLedgerBalances(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 	return rpcResponse, nil
 }
 
-// HandleCreateApplication creates a virtual application between participants
-func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, error) {
+// authorizeAccount checks that sender may read the ledger account with the given ID,
+// which must be one of its channels or an app session it takes part in
+func authorizeAccount(db *gorm.DB, accountID, sender string) error {
+	channel, err := GetChannelByID(db, accountID)
+	if err != nil {
+		return fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel != nil && strings.EqualFold(channel.ParticipantA, sender) {
+		return nil
+	}
+
+	var vApps []VApp
+	if err := db.Where("app_id = ?", accountID).Limit(1).Find(&vApps).Error; err != nil {
+		return fmt.Errorf("failed to find app session: %w", err)
+	}
+	if len(vApps) > 0 {
+		for _, participant := range vApps[0].Participants {
+			if strings.EqualFold(participant, sender) {
+				return nil
+			}
+		}
+	}
+	return errors.New("account not found")
+}
+
+// HandleGetLedgerEntries returns a page of ledger entries for an account and/or beneficiary.
+// The sender can only list its own entries, and the entries of its channels and of the app sessions it takes part in.
+func HandleGetLedgerEntries(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params GetLedgerEntriesParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if params.AccountID == "" && params.Beneficiary == "" {
+		return nil, errors.New("account or beneficiary is required")
+	}
+	if params.Beneficiary != "" && !strings.EqualFold(params.Beneficiary, sender) {
+		return nil, errors.New("entries of other beneficiaries cannot be listed")
+	}
+	if params.AccountID != "" {
+		if err := authorizeAccount(ledger.db, params.AccountID, sender); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.Limit < 0 || params.Limit > maxLedgerEntriesLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxLedgerEntriesLimit)
+	}
+	if params.Limit == 0 {
+		params.Limit = defaultLedgerEntriesLimit
+	}
+
+	filter := EntryFilter{
+		AccountID:   params.AccountID,
+		Beneficiary: params.Beneficiary,
+		Asset:       params.Asset,
+		BeforeID:    params.Cursor,
+		Limit:       params.Limit + 1, // One extra entry tells whether there is a next page
+	}
+	if params.StartTime > 0 {
+		filter.Since = time.Unix(int64(params.StartTime), 0)
+	}
+	if params.EndTime > 0 {
+		filter.Until = time.Unix(int64(params.EndTime), 0)
+	}
+
+	entries, err := GetEntries(ledger.db, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find ledger entries: %w", err)
+	}
+
+	response := LedgerEntriesResponse{Entries: []LedgerEntryResponse{}}
+	if len(entries) > params.Limit {
+		entries = entries[:params.Limit]
+		response.NextCursor = entries[len(entries)-1].ID
+	}
+
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, LedgerEntryResponse{
+			ID:            entry.ID,
+			TransactionID: entry.TransactionID,
+			AccountID:     entry.AccountID,
+			Beneficiary:   entry.Beneficiary,
+			Asset:         entry.Asset,
+			Credit:        entry.Credit,
+			Debit:         entry.Debit,
+			Balance:       entry.Balance,
+			CreatedAt:     uint64(entry.CreatedAt.Unix()),
+		})
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// HandleGetStateProof returns the proof of an account balance of the sender against a published state root
+func HandleGetStateProof(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params GetStateProofParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if params.AccountID == "" || params.Beneficiary == "" || params.Asset == "" {
+		return nil, errors.New("missing required parameters: acc, beneficiary or asset")
+	}
+	if !strings.EqualFold(params.Beneficiary, sender) {
+		return nil, errors.New("proofs of other beneficiaries cannot be requested")
+	}
+
+	stateRoot, proof, err := GetStateRootProof(ledger.db, params.RootID, params.AccountID, params.Beneficiary, params.Asset)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := StateLeaf(proof.AccountID, proof.Beneficiary, proof.Asset, proof.Balance)
+	if err != nil {
+		return nil, err
+	}
+
+	response := StateProofResponse{
+		RootID:      stateRoot.ID,
+		Root:        stateRoot.Root,
+		LastEntryID: stateRoot.LastEntryID,
+		Network:     stateRoot.Network,
+		TxHash:      stateRoot.TxHash,
+		Balance:     proof.Balance,
+		Leaf:        leaf.Hex(),
+		Proof:       append([]string{}, proof.Proof...),
+	}
+	if stateRoot.PublishedAt != nil {
+		response.PublishedAt = uint64(stateRoot.PublishedAt.Unix())
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// HandleGetLiabilityProof returns the proofs that the balances of the caller are included in a solvency report
+func HandleGetLiabilityProof(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	var params GetLiabilityProofParams
+	if len(rpc.Req.Params) > 0 {
+		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameters: %w", err)
+		}
+
+		if err := json.Unmarshal(paramsJSON, &params); err != nil {
+			return nil, fmt.Errorf("invalid parameters format: %w", err)
+		}
+	}
+
+	report, roots, proofs, err := GetLiabilityProofs(ledger.db, params.ReportID, sender, params.Asset)
+	if err != nil {
+		return nil, err
+	}
+
+	response := LiabilityProofResponse{
+		ReportID:    report.ID,
+		LastEntryID: report.LastEntryID,
+		CreatedAt:   uint64(report.CreatedAt.Unix()),
+		Beneficiary: normalizeAddress(sender),
+	}
+	for i, proof := range proofs {
+		leaf, err := LiabilityLeaf(proof.Beneficiary, proof.Asset, proof.Balance)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes := make([]LiabilityProofNode, len(proof.ProofHashes))
+		for j, hash := range proof.ProofHashes {
+			if j >= len(proof.ProofSums) {
+				return nil, errors.New("malformed liability proof")
+			}
+			sum, err := ParseAmount(proof.ProofSums[j])
+			if err != nil {
+				return nil, fmt.Errorf("malformed liability proof: %w", err)
+			}
+			nodes[j] = LiabilityProofNode{Hash: hash, Sum: sum}
+		}
+
+		response.Proofs = append(response.Proofs, AssetLiabilityProof{
+			Asset:    proof.Asset,
+			Balance:  proof.Balance,
+			Leaf:     leaf.Hash.Hex(),
+			Root:     roots[i].Root,
+			Total:    roots[i].Total,
+			Holdings: roots[i].Holdings,
+			Proof:    nodes,
+		})
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// HandleCreateApplication creates a virtual application between participants.
+// Broker fees are charged to participant channels on top of their allocations.
+func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger, fees *FeeSchedule, sender string) (*RPCResponse, error) {
 	if len(rpc.Req.Params) < 1 {
 		return nil, errors.New("missing parameters")
 	}
@@ -212,6 +568,14 @@ func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 		return nil, errors.New("number of weights must be equal to participants")
 	}
 
+	if len(createApp.ChannelIDs) > 0 && len(createApp.ChannelIDs) != len(createApp.Definition.Participants) {
+		return nil, errors.New("number of channels must be equal to participants")
+	}
+
+	if createApp.Token == "" {
+		return nil, errors.New("missing token")
+	}
+
 	var participantsAddresses []common.Address
 	for _, participant := range createApp.Definition.Participants {
 		participantsAddresses = append(participantsAddresses, common.HexToAddress(participant))
@@ -232,7 +596,7 @@ func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 	req := CreateAppSignData{
 		RequestID: rpc.Req.RequestID,
 		Method:    rpc.Req.Method,
-		Params:    []CreateApplicationParams{{Definition: createApp.Definition, Token: createApp.Token, Allocations: createApp.Allocations}},
+		Params:    []CreateApplicationParams{{Definition: createApp.Definition, Token: createApp.Token, Allocations: createApp.Allocations, ChannelIDs: createApp.ChannelIDs}},
 		Timestamp: rpc.Req.Timestamp,
 	}
 
@@ -250,44 +614,83 @@ func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 		recoveredAddresses[addr] = true
 	}
 
+	// The funding channels and fees are resolved before the transaction, which starts by locking the
+	// funding accounts so that their balances are only read under the lock
+	charged := make([]Amount, len(createApp.Definition.Participants))
+	fundingChannels := make(pq.StringArray, len(createApp.Definition.Participants))
+	assets := make([]string, len(createApp.Definition.Participants))
+	for i, participant := range createApp.Definition.Participants {
+		var channelID string
+		if len(createApp.ChannelIDs) > 0 {
+			channelID = createApp.ChannelIDs[i]
+		}
+		// The app session can only be funded from a channel holding the same asset.
+		participantChannel, err := getChannelForParticipant(ledger.db, participant, createApp.Token, "", channelID, []ChannelStatus{ChannelStatusOpen})
+		if err != nil {
+			return nil, err
+		}
+		fundingChannels[i] = participantChannel.ChannelID
+
+		allocation := createApp.Allocations[i]
+
+		if allocation.Cmp(rpc.Intent[i]) != 0 {
+			return nil, errors.New("intent must match allocation")
+		}
+
+		if allocation.Sign() < 0 {
+			return nil, errors.New("invalid allocation")
+		}
+
+		if allocation.Sign() > 0 {
+			if !recoveredAddresses[participant] {
+				return nil, fmt.Errorf("missing signature for participant %s", participant)
+			}
+		}
+
+		// Use the channel's spelling of the token address for all ledger accounts of the app.
+		createApp.Token = participantChannel.Token
+		assets[i] = participantChannel.Token
+
+		charged[i] = fees.Fee("create_app_session", assets[i], participantChannel.NetworkID, createApp.Definition.Protocol, allocation)
+	}
+
 	// Use a transaction to ensure atomicity for the entire operation
 	err = ledger.db.Transaction(func(tx *gorm.DB) error {
 		ledgerTx := &Ledger{db: tx}
 
+		fundingAccounts := make([]*BeneficiaryAccount, len(createApp.Definition.Participants))
 		for i, participant := range createApp.Definition.Participants {
-			participantChannel, err := getChannelForParticipant(tx, participant)
-			if err != nil {
-				return err
-			}
-
-			allocation := big.NewInt(createApp.Allocations[i])
-
-			if allocation.Cmp(big.NewInt(rpc.Intent[i])) != 0 {
-				return errors.New("intent must match allocation")
-			}
+			fundingAccounts[i] = ledgerTx.SelectBeneficiaryAccount(fundingChannels[i], participant, assets[i])
+		}
+		locked, err := lockAccounts(tx, fundingAccounts)
+		if err != nil {
+			return err
+		}
 
-			if allocation.Sign() < 0 {
-				return errors.New("invalid allocation")
+		var postings []Posting
+		for i, participant := range createApp.Definition.Participants {
+			allocation := createApp.Allocations[i]
+			account := fundingAccounts[i]
+			row := locked[account.key()]
+			if row.Balance.Sub(row.Held).Cmp(allocation.Add(charged[i])) < 0 {
+				return fmt.Errorf("%w in channel %s of %s", ErrInsufficientFunds, fundingChannels[i], participant)
 			}
 
-			if allocation.Sign() > 0 {
-				if !recoveredAddresses[participant] {
-					return fmt.Errorf("missing signature for participant %s", participant)
-				}
-			}
+			toAccount := ledgerTx.SelectBeneficiaryAccount(vAppID.Hex(), participant, assets[i])
+			postings = append(postings,
+				Posting{Account: account, Amount: allocation.Neg()},
+				Posting{Account: toAccount, Amount: allocation},
+			)
+		}
 
-			account := ledgerTx.SelectBeneficiaryAccount(participantChannel.ChannelID, participant)
-			balance, err := account.Balance()
-			if err != nil {
-				return fmt.Errorf("failed to check participant balance: %w", err)
-			}
-			if balance < allocation.Int64() {
-				return errors.New("insufficient funds")
-			}
+		reference := RPCReference(sender, rpc.Req.RequestID)
+		if _, err := ledgerTx.Post(TransactionKindAppFund, reference, postings...); err != nil {
+			return fmt.Errorf("failed to transfer funds from participants: %w", err)
+		}
 
-			toAccount := ledgerTx.SelectBeneficiaryAccount(vAppID.Hex(), participant)
-			if err := account.Transfer(toAccount, allocation.Int64()); err != nil {
-				return fmt.Errorf("failed to transfer funds from participant: %w", err)
+		for i, fee := range charged {
+			if err := ledgerTx.ChargeFee(fundingAccounts[i], fee, reference); err != nil {
+				return fmt.Errorf("failed to charge fee: %w", err)
 			}
 		}
 
@@ -310,6 +713,8 @@ func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 			Version:      rpc.Req.Timestamp,
 			CreatedAt:    time.Now(),
 			UpdatedAt:    time.Now(),
+
+			FundingChannels: fundingChannels,
 		}
 
 		if err := tx.Create(vAppDB).Error; err != nil {
@@ -326,14 +731,16 @@ func HandleCreateApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, err
 	response := &AppResponse{
 		AppID:  vAppID.Hex(),
 		Status: string(ChannelStatusOpen),
+		Fees:   charged,
 	}
 
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
 	return rpcResponse, nil
 }
 
-// HandleCloseApplication closes a virtual app and redistributes funds to participants
-func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, error) {
+// HandleCloseApplication closes a virtual app and redistributes funds to participants.
+// Broker fees are deducted from the allocations returned to participant channels.
+func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger, fees *FeeSchedule, sender string) (*RPCResponse, error) {
 	if len(rpc.Req.Params) < 1 {
 		return nil, errors.New("missing parameters")
 	}
@@ -355,7 +762,7 @@ func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, erro
 	req := CloseAppSignData{
 		RequestID: rpc.Req.RequestID,
 		Method:    rpc.Req.Method,
-		Params:    []CloseApplicationParams{{AppID: params.AppID, FinalAllocations: params.FinalAllocations}},
+		Params:    []CloseApplicationParams{{AppID: params.AppID, FinalAllocations: params.FinalAllocations, ChannelIDs: params.ChannelIDs}},
 		Timestamp: rpc.Req.Timestamp,
 	}
 
@@ -364,6 +771,8 @@ func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, erro
 		return nil, errors.New("error serializing message")
 	}
 
+	var charged []Amount
+	var legErrors []string
 	err = ledger.db.Transaction(func(tx *gorm.DB) error {
 		ledgerTx := &Ledger{db: tx}
 
@@ -399,43 +808,78 @@ func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, erro
 		if len(params.FinalAllocations) != len(vApp.Participants) {
 			return errors.New("number of allocations must match number of participants")
 		}
+		if len(params.ChannelIDs) > 0 && len(params.ChannelIDs) != len(vApp.Participants) {
+			return errors.New("number of channels must match number of participants")
+		}
 
 		// Process allocations
-		totalVirtualAppBalance, sumAllocations := int64(0), int64(0)
+		var postings []Posting
+		var totalVirtualAppBalance, sumAllocations Amount
+		charged = make([]Amount, len(vApp.Participants))
+		feeAccounts := make([]*BeneficiaryAccount, len(vApp.Participants))
+		legErrors = make([]string, len(vApp.Participants))
+		settled := true
 		for i, participant := range vApp.Participants {
 			allocation := params.FinalAllocations[i]
-			if allocation < 0 {
+			if allocation.Sign() < 0 {
 				return errors.New("invalid allocation")
 			}
 
 			// Adjust balances
-			virtualBalance := ledgerTx.SelectBeneficiaryAccount(vApp.AppID, participant)
+			virtualBalance := ledgerTx.SelectBeneficiaryAccount(vApp.AppID, participant, vApp.Token)
 			participantBalance, err := virtualBalance.Balance()
 			if err != nil {
 				return fmt.Errorf("failed to check balance for %s: %w", participant, err)
 			}
-			totalVirtualAppBalance += participantBalance
+			totalVirtualAppBalance = totalVirtualAppBalance.Add(participantBalance)
+			sumAllocations = sumAllocations.Add(allocation)
 
-			if err := virtualBalance.Record(-participantBalance); err != nil {
-				return fmt.Errorf("failed to adjust virtual balance for %s: %w", participant, err)
+			// Without a channel to settle into, the allocation stays in the app session until it is closed again
+			channel, err := settlementChannel(tx, &vApp, i, params.ChannelIDs)
+			if err != nil && len(params.ChannelIDs) > 0 && params.ChannelIDs[i] != "" {
+				return fmt.Errorf("failed to find channel for %s: %w", participant, err)
+			}
+			if err != nil && allocation.IsZero() {
+				postings = append(postings, Posting{Account: virtualBalance, Amount: participantBalance.Neg()})
+				continue
 			}
-
-			channel, err := getChannelForParticipant(tx, participant)
 			if err != nil {
-				return fmt.Errorf("failed to find channel for %s: %w", participant, err)
+				legErrors[i] = fmt.Sprintf("failed to find channel for %s: %v", participant, err)
+				settled = false
+				postings = append(postings, Posting{Account: virtualBalance, Amount: allocation.Sub(participantBalance)})
+				continue
 			}
 
-			toAccount := ledgerTx.SelectBeneficiaryAccount(channel.ChannelID, participant)
-			if err := toAccount.Record(allocation); err != nil {
-				return fmt.Errorf("failed to adjust balance for %s: %w", participant, err)
-			}
-			sumAllocations += allocation
+			toAccount := ledgerTx.SelectBeneficiaryAccount(channel.ChannelID, participant, channel.Token)
+			postings = append(postings,
+				Posting{Account: virtualBalance, Amount: participantBalance.Neg()},
+				Posting{Account: toAccount, Amount: allocation},
+			)
+			charged[i] = fees.Fee("close_app_session", channel.Token, channel.NetworkID, vApp.Protocol, allocation)
+			feeAccounts[i] = toAccount
 		}
 
-		if sumAllocations != totalVirtualAppBalance {
+		if sumAllocations.Cmp(totalVirtualAppBalance) != 0 {
 			return errors.New("allocation mismatch with virtual app balance")
 		}
 
+		reference := RPCReference(sender, rpc.Req.RequestID)
+		if _, err := ledgerTx.Post(TransactionKindAppSettle, reference, postings...); err != nil {
+			return fmt.Errorf("failed to settle virtual app balances: %w", err)
+		}
+
+		for i, fee := range charged {
+			if feeAccounts[i] == nil {
+				continue
+			}
+			if err := ledgerTx.ChargeFee(feeAccounts[i], fee, reference); err != nil {
+				return fmt.Errorf("failed to charge fee: %w", err)
+			}
+		}
+
+		if !settled {
+			return nil
+		}
 		// Close the virtual app
 		return tx.Model(&vApp).Updates(map[string]any{
 			"status":     ChannelStatusClosed,
@@ -450,12 +894,45 @@ func HandleCloseApplication(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, erro
 	response := &AppResponse{
 		AppID:  params.AppID,
 		Status: string(ChannelStatusClosed),
+		Fees:   charged,
+	}
+	for _, legError := range legErrors {
+		if legError != "" {
+			response.Status = string(ChannelStatusOpen)
+			response.Errors = legErrors
+			break
+		}
 	}
 
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
 	return rpcResponse, nil
 }
 
+// settlementChannel returns the channel receiving the allocation of the i-th participant of an app session:
+// the channel named in channelIDs, else the channel that funded the participant if it is not closed,
+// else the participant's unclosed channel in the session token on the network of the funding channel
+func settlementChannel(tx *gorm.DB, vApp *VApp, i int, channelIDs []string) (*Channel, error) {
+	participant := vApp.Participants[i]
+	if len(channelIDs) > 0 && channelIDs[i] != "" {
+		return getChannelForParticipant(tx, participant, vApp.Token, "", channelIDs[i], unclosedChannelStatuses)
+	}
+
+	var networkID string
+	if i < len(vApp.FundingChannels) && vApp.FundingChannels[i] != "" {
+		funding, err := GetChannelByID(tx, vApp.FundingChannels[i])
+		if err != nil {
+			return nil, err
+		}
+		if funding != nil {
+			if channel, err := getChannelForParticipant(tx, participant, vApp.Token, "", funding.ChannelID, unclosedChannelStatuses); err == nil {
+				return channel, nil
+			}
+			networkID = funding.NetworkID
+		}
+	}
+	return getChannelForParticipant(tx, participant, vApp.Token, networkID, "", unclosedChannelStatuses)
+}
+
 // HandleGetAppDefinition returns the application definition for a ledger account
 func HandleGetAppDefinition(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, error) {
 	var accountID string
@@ -496,6 +973,125 @@ func HandleGetAppDefinition(rpc *RPCRequest, ledger *Ledger) (*RPCResponse, erro
 	return rpcResponse, nil
 }
 
+// HandleGetChannelStates returns the states the broker signed for a channel of the caller, latest version first
+func HandleGetChannelStates(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params GetChannelStatesParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	channel, err := GetChannelByID(ledger.db, params.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel == nil || !strings.EqualFold(channel.ParticipantA, sender) {
+		return nil, errors.New("channel not found")
+	}
+
+	states, err := GetChannelStates(ledger.db, channel.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel states: %w", err)
+	}
+
+	response := make([]ChannelStateResponse, 0, len(states))
+	for _, state := range states {
+		item, err := channelStateResponse(&state)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, item)
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// channelStateResponse converts a stored channel state for RPC responses
+func channelStateResponse(state *ChannelState) (ChannelStateResponse, error) {
+	item := ChannelStateResponse{
+		Version:   state.Version,
+		Intent:    state.Intent,
+		StateData: state.Data,
+		StateHash: state.StateHash,
+		CreatedAt: uint64(state.CreatedAt.Unix()),
+	}
+	if err := json.Unmarshal(state.Allocations, &item.Allocations); err != nil {
+		return item, fmt.Errorf("failed to decode allocations: %w", err)
+	}
+	brokerSig, err := decodeSignature(state.BrokerSig)
+	if err != nil {
+		return item, err
+	}
+	item.Signature = Signature{V: brokerSig.V, R: hexutil.Encode(brokerSig.R[:]), S: hexutil.Encode(brokerSig.S[:])}
+	if state.ParticipantSig != "" {
+		participantSig, err := decodeSignature(state.ParticipantSig)
+		if err != nil {
+			return item, err
+		}
+		item.ParticipantSignature = &Signature{V: participantSig.V, R: hexutil.Encode(participantSig.R[:]), S: hexutil.Encode(participantSig.S[:])}
+	}
+	return item, nil
+}
+
+// HandleCountersignState stores the caller's signature of a state the broker signed for one of its channels,
+// so that the state can be submitted on-chain before the participant does
+func HandleCountersignState(rpc *RPCRequest, ledger *Ledger, sender string) (*RPCResponse, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params CountersignStateParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	r, errR := hexutil.Decode(params.Signature.R)
+	s, errS := hexutil.Decode(params.Signature.S)
+	if errR != nil || errS != nil || len(r) != 32 || len(s) != 32 {
+		return nil, errors.New("invalid signature")
+	}
+	sig := nitrolite.Signature{V: params.Signature.V}
+	copy(sig.R[:], r)
+	copy(sig.S[:], s)
+
+	var state *ChannelState
+	err = ledger.db.Transaction(func(tx *gorm.DB) error {
+		channel, err := GetChannelByID(tx, params.ChannelID)
+		if err != nil {
+			return fmt.Errorf("failed to find channel: %w", err)
+		}
+		if channel == nil || !strings.EqualFold(channel.ParticipantA, sender) {
+			return errors.New("channel not found")
+		}
+		state, err = RecordParticipantSignature(tx, channel, params.StateHash, sig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := channelStateResponse(state)
+	if err != nil {
+		return nil, err
+	}
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
 // HandleResizeChannel processes a request to resize a payment channel
 func HandleResizeChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCResponse, error) {
 	if len(rpc.Req.Params) < 1 {
@@ -520,6 +1116,9 @@ func HandleResizeChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCR
 	if err != nil {
 		return nil, fmt.Errorf("failed to find channel: %w", err)
 	}
+	if channel == nil {
+		return nil, fmt.Errorf("channel %s not found", params.ChannelID)
+	}
 
 	req := ResizeChannelSignData{
 		RequestID: rpc.Req.RequestID,
@@ -538,36 +1137,10 @@ func HandleResizeChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCR
 		return nil, errors.New("invalid signature")
 	}
 
-	// Get current account balance
-	account := ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA)
-	balance, err := account.Balance()
-	if err != nil {
-		return nil, fmt.Errorf("failed to check participant A balance: %w", err)
-	}
-
-	brokerPart := channel.Amount - balance
-
-	// Calculate the new channel amount
-	newAmount := new(big.Int).Add(big.NewInt(balance), params.ParticipantChange)
-	if newAmount.Sign() < 0 {
-		return nil, errors.New("invalid resize amount")
-	}
-
-	allocations := []nitrolite.Allocation{
-		{
-			Destination: common.HexToAddress(params.FundsDestination),
-			Token:       common.HexToAddress(channel.Token),
-			Amount:      newAmount,
-		},
-		{
-			Destination: common.HexToAddress(channel.ParticipantB),
-			Token:       common.HexToAddress(channel.Token),
-			Amount:      big.NewInt(0),
-		},
+	if !channel.Status.CanTransitionTo(ChannelStatusResizing) {
+		return nil, fmt.Errorf("channel %s is %s and cannot be resized", channel.ChannelID, channel.Status)
 	}
 
-	resizeAmounts := []*big.Int{params.ParticipantChange, big.NewInt(-brokerPart)} // Always release broker funds if there is a surplus.
-
 	intentionType, err := abi.NewType("int256[]", "", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ABI type for intentions: %w", err)
@@ -577,23 +1150,90 @@ func HandleResizeChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCR
 		{Type: intentionType},
 	}
 
-	encodedIntentions, err := intentionsArgs.Pack(resizeAmounts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to pack intentions: %w", err)
-	}
+	// The state is built from the available balance read under the account lock, and signed in the same
+	// transaction, so that funds spent or held concurrently cannot be allocated to the participant
+	var allocations []nitrolite.Allocation
+	var encodedIntentions []byte
+	var stateHash string
+	var sig nitrolite.Signature
+	err = ledger.db.Transaction(func(tx *gorm.DB) error {
+		ledgerTx := &Ledger{db: tx}
+		account := ledgerTx.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token)
+		row, err := lockAccount(tx, account)
+		if err != nil {
+			return err
+		}
+		balance := row.Balance.Sub(row.Held)
 
-	// Encode the channel ID and state for signing
-	channelID := common.HexToHash(channel.ChannelID)
-	encodedState, err := nitrolite.EncodeState(channelID, nitrolite.IntentRESIZE, big.NewInt(int64(channel.Version)+1), encodedIntentions, allocations)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode state hash: %w", err)
-	}
+		brokerPart := channel.Amount.Sub(balance)
 
-	// Generate state hash and sign it
-	stateHash := crypto.Keccak256Hash(encodedState).Hex()
-	sig, err := signer.NitroSign(encodedState)
+		// Calculate the new channel amount
+		newAmount := new(big.Int).Add(balance.Big(), params.ParticipantChange)
+		if newAmount.Sign() < 0 || newAmount.BitLen() > maxAmountBits {
+			return errors.New("invalid resize amount")
+		}
+
+		allocations = []nitrolite.Allocation{
+			{
+				Destination: common.HexToAddress(params.FundsDestination),
+				Token:       common.HexToAddress(channel.Token),
+				Amount:      newAmount,
+			},
+			{
+				Destination: common.HexToAddress(channel.ParticipantB),
+				Token:       common.HexToAddress(channel.Token),
+				Amount:      big.NewInt(0),
+			},
+		}
+
+		resizeAmounts := []*big.Int{params.ParticipantChange, brokerPart.Neg().Big()} // Always release broker funds if there is a surplus.
+
+		encodedIntentions, err = intentionsArgs.Pack(resizeAmounts)
+		if err != nil {
+			return fmt.Errorf("failed to pack intentions: %w", err)
+		}
+
+		// Encode the channel ID and state for signing
+		channelID := common.HexToHash(channel.ChannelID)
+		encodedState, err := nitrolite.EncodeState(channelID, nitrolite.IntentRESIZE, big.NewInt(int64(channel.Version)+1), encodedIntentions, allocations)
+		if err != nil {
+			return fmt.Errorf("failed to encode state hash: %w", err)
+		}
+
+		// Generate state hash and sign it
+		stateHash = crypto.Keccak256Hash(encodedState).Hex()
+		sig, err = signer.NitroSign(encodedState)
+		if err != nil {
+			return fmt.Errorf("failed to sign state: %w", err)
+		}
+
+		state := nitrolite.State{
+			Intent:      uint8(nitrolite.IntentRESIZE),
+			Version:     big.NewInt(int64(channel.Version) + 1),
+			Data:        encodedIntentions,
+			Allocations: allocations,
+		}
+		if err := TransitionChannel(tx, channel, ChannelStatusResizing, rpc.Req.Method, fmt.Sprint(rpc.Req.RequestID)); err != nil {
+			return err
+		}
+		if _, err := RecordChannelState(tx, channel, state, sig); err != nil {
+			return err
+		}
+
+		// Funds withdrawn by the signed state cannot be spent until the Resized event settles the hold.
+		if params.ParticipantChange.Sign() < 0 {
+			withdrawal, err := NewAmountFromBig(new(big.Int).Neg(params.ParticipantChange))
+			if err != nil {
+				return errors.New("invalid resize amount")
+			}
+			if _, err := ledgerTx.PlaceHold(account, withdrawal, channel.Version+1); err != nil {
+				return fmt.Errorf("failed to hold withdrawn funds: %w", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign state: %w", err)
+		return nil, err
 	}
 
 	response := ResizeChannelResponse{
@@ -641,6 +1281,9 @@ func HandleCloseChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCRe
 	if err != nil {
 		return nil, fmt.Errorf("failed to find channel: %w", err)
 	}
+	if channel == nil {
+		return nil, fmt.Errorf("channel %s not found", params.ChannelID)
+	}
 
 	reqBytes, err := json.Marshal(rpc.Req)
 	if err != nil {
@@ -652,17 +1295,21 @@ func HandleCloseChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCRe
 		return nil, errors.New("invalid signature")
 	}
 
-	account := ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA)
+	if !channel.Status.CanTransitionTo(ChannelStatusClosing) {
+		return nil, fmt.Errorf("channel %s is %s and cannot be closed", channel.ChannelID, channel.Status)
+	}
+
+	account := ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token)
 	balance, err := account.Balance()
 	if err != nil {
 		return nil, fmt.Errorf("failed to check participant A balance: %w", err)
 	}
 
-	if channel.Amount-balance < 0 {
+	if channel.Amount.Cmp(balance) < 0 {
 		return nil, errors.New("resize this channel first")
 	}
 
-	if balance < 0 {
+	if balance.Sign() < 0 {
 		return nil, errors.New("insufficient funds for participant: " + channel.Token)
 	}
 
@@ -670,12 +1317,12 @@ func HandleCloseChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCRe
 		{
 			Destination: common.HexToAddress(params.FundsDestination),
 			Token:       common.HexToAddress(channel.Token),
-			Amount:      big.NewInt(balance),
+			Amount:      balance.Big(),
 		},
 		{
 			Destination: common.HexToAddress(channel.ParticipantB),
 			Token:       common.HexToAddress(channel.Token),
-			Amount:      big.NewInt(channel.Amount - balance), // Broker receives the remaining amount
+			Amount:      channel.Amount.Sub(balance).Big(), // Broker receives the remaining amount
 		},
 	}
 
@@ -697,6 +1344,33 @@ func HandleCloseChannel(rpc *RPCRequest, ledger *Ledger, signer *Signer) (*RPCRe
 		return nil, fmt.Errorf("failed to sign state: %w", err)
 	}
 
+	state := nitrolite.State{
+		Intent:      uint8(nitrolite.IntentFINALIZE),
+		Version:     big.NewInt(int64(channel.Version) + 1),
+		Data:        stateData,
+		Allocations: allocations,
+	}
+	err = ledger.db.Transaction(func(tx *gorm.DB) error {
+		if err := TransitionChannel(tx, channel, ChannelStatusClosing, rpc.Req.Method, fmt.Sprint(rpc.Req.RequestID)); err != nil {
+			return err
+		}
+		if _, err := RecordChannelState(tx, channel, state, sig); err != nil {
+			return err
+		}
+
+		// The whole balance leaves the ledger with the final state, so none of it can be spent until the Closed event.
+		if balance.Sign() > 0 {
+			ledgerTx := &Ledger{db: tx}
+			if _, err := ledgerTx.PlaceHold(ledgerTx.SelectBeneficiaryAccount(account.AccountID, account.Beneficiary, account.Asset), balance, channel.Version+1); err != nil {
+				return fmt.Errorf("failed to hold channel funds: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	response := CloseChannelResponse{
 		ChannelID: channel.ChannelID,
 		Intent:    uint8(nitrolite.IntentFINALIZE),
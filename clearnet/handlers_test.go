@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
@@ -33,7 +35,7 @@ func setupTestSqlite(t testing.TB) *gorm.DB {
 	require.NoError(t, err)
 
 	// Auto migrate all required models
-	err = db.AutoMigrate(&Entry{}, &Channel{}, &VApp{}, &RPCRecord{})
+	err = migrateModels(db)
 	require.NoError(t, err)
 
 	return db
@@ -74,7 +76,7 @@ func setupTestPostgres(ctx context.Context, t testing.TB) (*gorm.DB, testcontain
 	require.NoError(t, err)
 
 	// Auto migrate all required models
-	err = db.AutoMigrate(&Entry{}, &Channel{}, &VApp{}, &RPCRecord{})
+	err = migrateModels(db)
 	require.NoError(t, err)
 
 	return db, postgresContainer
@@ -197,16 +199,20 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 	}
 	require.NoError(t, db.Create(vApp).Error)
 
-	// Add funds to the virtual app
-	accountA := ledger.SelectBeneficiaryAccount(vAppID, participantA)
-	require.NoError(t, accountA.Record(200))
+	// Add funds to the virtual app from the participants' channels
+	channelAccountA := ledger.SelectBeneficiaryAccount(channelA.ChannelID, participantA, tokenAddress)
+	require.NoError(t, ledger.Deposit(channelAccountA, NewAmount(200), "test"))
+	accountA := ledger.SelectBeneficiaryAccount(vAppID, participantA, tokenAddress)
+	require.NoError(t, channelAccountA.Transfer(TransactionKindAppFund, "test", accountA, NewAmount(200)))
 
-	accountB := ledger.SelectBeneficiaryAccount(vAppID, participantB)
-	require.NoError(t, accountB.Record(300))
+	channelAccountB := ledger.SelectBeneficiaryAccount(channelB.ChannelID, participantB, tokenAddress)
+	require.NoError(t, ledger.Deposit(channelAccountB, NewAmount(300), "test"))
+	accountB := ledger.SelectBeneficiaryAccount(vAppID, participantB, tokenAddress)
+	require.NoError(t, channelAccountB.Transfer(TransactionKindAppFund, "test", accountB, NewAmount(300)))
 
 	closeParams := CloseApplicationParams{
 		AppID:            vAppID,
-		FinalAllocations: []int64{250, 250},
+		FinalAllocations: []Amount{NewAmount(250), NewAmount(250)},
 	}
 
 	// Create RPC request
@@ -236,7 +242,7 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 	require.NoError(t, err)
 	req.Sig = []string{hexutil.Encode(signed)}
 
-	resp, err := HandleCloseApplication(req, ledger)
+	resp, err := HandleCloseApplication(req, ledger, nil, participantA)
 	require.NoError(t, err)
 
 	// Verify response
@@ -249,26 +255,26 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 	assert.Equal(t, ChannelStatusClosed, updatedChannel.Status)
 
 	// Check that funds were transferred back to channels according to allocations
-	directAccountA := ledger.SelectBeneficiaryAccount(channelA.ChannelID, participantA)
+	directAccountA := ledger.SelectBeneficiaryAccount(channelA.ChannelID, participantA, tokenAddress)
 	balanceA, err := directAccountA.Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(250), balanceA)
+	assert.Equal(t, "250", balanceA.String())
 
-	directAccountB := ledger.SelectBeneficiaryAccount(channelB.ChannelID, participantB)
+	directAccountB := ledger.SelectBeneficiaryAccount(channelB.ChannelID, participantB, tokenAddress)
 	balanceB, err := directAccountB.Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(250), balanceB)
+	assert.Equal(t, "250", balanceB.String())
 
 	// Check that virtual app accounts are empty
-	virtualAccountA := ledger.SelectBeneficiaryAccount(vAppID, participantA)
+	virtualAccountA := ledger.SelectBeneficiaryAccount(vAppID, participantA, tokenAddress)
 	virtualBalanceA, err := virtualAccountA.Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(0), virtualBalanceA)
+	assert.Equal(t, "0", virtualBalanceA.String())
 
-	virtualAccountB := ledger.SelectBeneficiaryAccount(vAppID, participantB)
+	virtualAccountB := ledger.SelectBeneficiaryAccount(vAppID, participantB, tokenAddress)
 	virtualBalanceB, err := virtualAccountB.Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(0), virtualBalanceB)
+	assert.Equal(t, "0", virtualBalanceB.String())
 }
 
 // TestHandleCreateVirtualApp tests the create virtual app handler functionality
@@ -316,10 +322,10 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 
 	// Create ledger and fund channels
 	ledger := NewLedger(db)
-	acctA := ledger.SelectBeneficiaryAccount(channelA.ChannelID, addrA)
-	require.NoError(t, acctA.Record(100))
-	acctB := ledger.SelectBeneficiaryAccount(channelB.ChannelID, addrB)
-	require.NoError(t, acctB.Record(200))
+	acctA := ledger.SelectBeneficiaryAccount(channelA.ChannelID, addrA, tokenAddress)
+	require.NoError(t, ledger.Deposit(acctA, NewAmount(100), "test"))
+	acctB := ledger.SelectBeneficiaryAccount(channelB.ChannelID, addrB, tokenAddress)
+	require.NoError(t, ledger.Deposit(acctB, NewAmount(200), "test"))
 
 	// Create common timestamp for all signatures - will also be used as nonce
 	timestamp := uint64(time.Now().Unix())
@@ -338,7 +344,7 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 	createParams := CreateApplicationParams{
 		Definition:  appDefinition,
 		Token:       tokenAddress,
-		Allocations: []int64{100, 200}, // Combined allocations
+		Allocations: []Amount{NewAmount(100), NewAmount(200)}, // Combined allocations
 	}
 
 	rpcReq := &RPCRequest{
@@ -348,7 +354,7 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 			Params:    []any{createParams},
 			Timestamp: timestamp,
 		},
-		Intent: []int64{100, 200},
+		Intent: []Amount{NewAmount(100), NewAmount(200)},
 	}
 
 	// Create the CreateAppSignData object exactly as it's created in HandleCreateApplication
@@ -379,7 +385,7 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 	rpcReq.Sig = []string{sigA, sigB}
 
 	// Process the request
-	resp, err := HandleCreateApplication(rpcReq, ledger)
+	resp, err := HandleCreateApplication(rpcReq, ledger, nil, addrA)
 	require.NoError(t, err)
 	require.NotNil(t, resp)
 
@@ -405,21 +411,29 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 	assert.Equal(t, ChannelStatusOpen, vApp.Status)
 
 	// Check balances: channels drained, virtual app funded
-	directBalA, err := ledger.SelectBeneficiaryAccount(channelA.ChannelID, addrA).Balance()
+	directBalA, err := ledger.SelectBeneficiaryAccount(channelA.ChannelID, addrA, tokenAddress).Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(0), directBalA, "channel A should be drained")
+	assert.Equal(t, "0", directBalA.String(), "channel A should be drained")
 
-	directBalB, err := ledger.SelectBeneficiaryAccount(channelB.ChannelID, addrB).Balance()
+	directBalB, err := ledger.SelectBeneficiaryAccount(channelB.ChannelID, addrB, tokenAddress).Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(0), directBalB, "channel B should be drained")
+	assert.Equal(t, "0", directBalB.String(), "channel B should be drained")
 
-	virtBalA, err := ledger.SelectBeneficiaryAccount(appResp.AppID, addrA).Balance()
+	virtBalA, err := ledger.SelectBeneficiaryAccount(appResp.AppID, addrA, tokenAddress).Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(100), virtBalA, "virtual app A balance")
+	assert.Equal(t, "100", virtBalA.String(), "virtual app A balance")
 
-	virtBalB, err := ledger.SelectBeneficiaryAccount(appResp.AppID, addrB).Balance()
+	virtBalB, err := ledger.SelectBeneficiaryAccount(appResp.AppID, addrB, tokenAddress).Balance()
 	require.NoError(t, err)
-	assert.Equal(t, int64(200), virtBalB, "virtual app B balance")
+	assert.Equal(t, "200", virtBalB.String(), "virtual app B balance")
+
+	// Funding is recorded as a single journal transaction referencing the request
+	var funding Transaction
+	require.NoError(t, db.Where("kind = ?", TransactionKindAppFund).First(&funding).Error)
+	assert.Equal(t, RPCReference(addrA, 42), funding.Reference)
+	entries, err := GetTransactionEntries(db, funding.ID)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
 }
 
 // TestHandleListParticipants tests the list available channels handler functionality
@@ -435,10 +449,11 @@ func TestHandleListParticipants(t *testing.T) {
 	participants := []struct {
 		address        string
 		channelID      string
+		token          string
 		initialBalance int64
 		status         ChannelStatus
 	}{
-		{"0xParticipant1", "0xChannel1", 1000, ChannelStatusOpen},
+		{"0xParticipant1", "0xChannel1", "0xTokenABC", 1000, ChannelStatusOpen},
 	}
 
 	// Insert channels and ledger entries for testing
@@ -449,6 +464,7 @@ func TestHandleListParticipants(t *testing.T) {
 			ParticipantA: p.address,
 			ParticipantB: BrokerAddress,
 			Status:       p.status,
+			Token:        p.token,
 			CreatedAt:    time.Now(),
 			UpdatedAt:    time.Now(),
 		}
@@ -457,8 +473,8 @@ func TestHandleListParticipants(t *testing.T) {
 
 		// Add funds if needed
 		if p.initialBalance > 0 {
-			account := ledger.SelectBeneficiaryAccount(p.channelID, p.address)
-			err = account.Record(p.initialBalance)
+			account := ledger.SelectBeneficiaryAccount(p.channelID, p.address, p.token)
+			err = ledger.Deposit(account, NewAmount(p.initialBalance), "test")
 			require.NoError(t, err)
 		}
 	}
@@ -481,7 +497,7 @@ func TestHandleListParticipants(t *testing.T) {
 	}
 
 	// Use the test-specific handler instead of the actual one
-	response, err := HandleGetLedgerBalances(rpcRequest, ledger)
+	response, err := HandleGetLedgerBalances(rpcRequest, ledger, "0xParticipant1")
 	require.NoError(t, err)
 	assert.NotNil(t, response)
 
@@ -498,20 +514,36 @@ func TestHandleListParticipants(t *testing.T) {
 	assert.Equal(t, 1, len(channelsArray), "Should have 4 channels")
 
 	// Check the contents of each channel response
-	expectedAddresses := map[string]int64{
-		"0xParticipant1": 1000,
+	expectedAddresses := map[string]string{
+		"0xParticipant1": "1000",
 	}
 
 	for _, ch := range channelsArray {
 		expectedBalance, exists := expectedAddresses[ch.Address]
 		assert.True(t, exists, "Unexpected address in response: %s", ch.Address)
-		assert.Equal(t, expectedBalance, ch.Amount, "Incorrect balance for address %s", ch.Address)
+		assert.Equal(t, expectedBalance, ch.Amount.String(), "Incorrect balance for address %s", ch.Address)
+		assert.Equal(t, "0xTokenABC", ch.Asset, "Incorrect asset for address %s", ch.Address)
 
 		// Remove from map to ensure each address appears only once
 		delete(expectedAddresses, ch.Address)
 	}
 
 	assert.Empty(t, expectedAddresses, "Not all expected addresses were found in the response")
+
+	// Past balances can only be read by participants of the account
+	asOfRequest := &RPCRequest{
+		Req: RPCData{
+			RequestID: 2,
+			Method:    "get_ledger_balances",
+			Params:    []any{GetLedgerBalancesParams{AccountID: "0xChannel1", AsOf: uint64(time.Now().Add(time.Minute).Unix())}},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	response, err = HandleGetLedgerBalances(asOfRequest, ledger, "0xParticipant1")
+	require.NoError(t, err)
+	assert.Len(t, response.Res.Params[0].([]AvailableBalance), 1)
+	_, err = HandleGetLedgerBalances(asOfRequest, ledger, "0xParticipant2")
+	assert.Error(t, err)
 }
 
 // TestHandleGetConfig tests the get config handler functionality
@@ -541,3 +573,335 @@ func TestHandleGetConfig(t *testing.T) {
 
 	assert.Equal(t, BrokerAddress, configMap.BrokerAddress)
 }
+
+// newCreateAppRequest builds a create_app_session request signed by the given signers
+func newCreateAppRequest(t *testing.T, requestID uint64, params CreateApplicationParams, signers ...Signer) *RPCRequest {
+	t.Helper()
+
+	rpcReq := &RPCRequest{
+		Req: RPCData{
+			RequestID: requestID,
+			Method:    "create_app_session",
+			Params:    []any{params},
+			Timestamp: params.Definition.Nonce,
+		},
+		Intent: params.Allocations,
+	}
+
+	reqBytes, err := CreateAppSignData{
+		RequestID: rpcReq.Req.RequestID,
+		Method:    rpcReq.Req.Method,
+		Params:    []CreateApplicationParams{params},
+		Timestamp: rpcReq.Req.Timestamp,
+	}.MarshalJSON()
+	require.NoError(t, err)
+
+	for _, signer := range signers {
+		sig, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		rpcReq.Sig = append(rpcReq.Sig, hexutil.Encode(sig))
+	}
+
+	return rpcReq
+}
+
+// TestHandleCreateVirtualAppTokenMismatch tests that an app session cannot be funded from a channel in another asset
+func TestHandleCreateVirtualAppTokenMismatch(t *testing.T) {
+	rawKeyA, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerA := Signer{privateKey: rawKeyA}
+	addrA := signerA.GetAddress().Hex()
+
+	rawKeyB, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerB := Signer{privateKey: rawKeyB}
+	addrB := signerB.GetAddress().Hex()
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	usdc, weth := "0xUSDC", "0xWETH"
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelA", ParticipantA: addrA, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: usdc, NetworkID: "137", Nonce: 1}).Error)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xChannelB", ParticipantA: addrB, ParticipantB: BrokerAddress,
+		Status: ChannelStatusOpen, Token: weth, NetworkID: "8453", Nonce: 1}).Error)
+
+	ledger := NewLedger(db)
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xChannelA", addrA, usdc), NewAmount(100), "test"))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xChannelB", addrB, weth), NewAmount(100), "test"))
+
+	params := CreateApplicationParams{
+		Definition: AppDefinition{
+			Protocol:     "test-proto",
+			Participants: []string{addrA, addrB},
+			Weights:      []uint64{1, 1},
+			Quorum:       2,
+			Challenge:    60,
+			Nonce:        uint64(time.Now().Unix()),
+		},
+		Token:       usdc,
+		Allocations: []Amount{NewAmount(50), NewAmount(50)},
+	}
+
+	_, err = HandleCreateApplication(newCreateAppRequest(t, 1, params, signerA, signerB), ledger, nil, addrA)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "holds token")
+
+	// Neither channel should have been debited
+	balA, err := ledger.SelectBeneficiaryAccount("0xChannelA", addrA, usdc).Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "100", balA.String())
+
+	balB, err := ledger.SelectBeneficiaryAccount("0xChannelB", addrB, weth).Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "100", balB.String())
+}
+
+// TestAppSessionChannelSelection tests that app sessions are funded from and settled to the participant's channel
+// in the session token, or to the channels the client names
+func TestAppSessionChannelSelection(t *testing.T) {
+	rawKeyA, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerA := Signer{privateKey: rawKeyA}
+	addrA := signerA.GetAddress().Hex()
+
+	rawKeyB, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerB := Signer{privateKey: rawKeyB}
+	addrB := signerB.GetAddress().Hex()
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ledger := NewLedger(db)
+
+	// Participant A has a channel per token and network, participant B a single one
+	usdc, weth := "0xUSDC", "0xWETH"
+	channels := []Channel{
+		{ChannelID: "0xUSDCPolygon", ParticipantA: addrA, Token: usdc, NetworkID: "137", Nonce: 1},
+		{ChannelID: "0xWETHBase", ParticipantA: addrA, Token: weth, NetworkID: "8453", Nonce: 2},
+		{ChannelID: "0xUSDCBase", ParticipantA: addrA, Token: usdc, NetworkID: "8453", Nonce: 3},
+		{ChannelID: "0xUSDCB", ParticipantA: addrB, Token: usdc, NetworkID: "137", Nonce: 1},
+	}
+	for _, channel := range channels {
+		channel.ParticipantB = BrokerAddress
+		channel.Status = ChannelStatusOpen
+		require.NoError(t, db.Create(&channel).Error)
+		require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token), NewAmount(100), "test"))
+	}
+	balance := func(channelID, participant, token string) string {
+		amount, err := ledger.SelectBeneficiaryAccount(channelID, participant, token).Balance()
+		require.NoError(t, err)
+		return amount.String()
+	}
+
+	// Another channel in the same token on the same network is not joined, but one in another token is
+	existing, err := CheckExistingChannels(db, addrA, BrokerAddress, "137", usdc)
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	assert.Equal(t, "0xUSDCPolygon", existing.ChannelID)
+	existing, err = CheckExistingChannels(db, addrA, BrokerAddress, "137", weth)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	params := CreateApplicationParams{
+		Definition: AppDefinition{
+			Protocol:     "test-proto",
+			Participants: []string{addrA, addrB},
+			Weights:      []uint64{1, 1},
+			Quorum:       2,
+			Challenge:    60,
+			Nonce:        uint64(time.Now().Unix()),
+		},
+		Token:       usdc,
+		Allocations: []Amount{NewAmount(40), NewAmount(10)},
+		ChannelIDs:  []string{"0xUSDCPolygon", ""},
+	}
+
+	// A named channel in another token is refused
+	wrongToken := params
+	wrongToken.ChannelIDs = []string{"0xWETHBase", ""}
+	_, err = HandleCreateApplication(newCreateAppRequest(t, 1, wrongToken, signerA, signerB), ledger, nil, addrA)
+	assert.ErrorContains(t, err, "holds token")
+
+	// The named channel funds the session, even though a later channel holds the same token
+	response, err := HandleCreateApplication(newCreateAppRequest(t, 2, params, signerA, signerB), ledger, nil, addrA)
+	require.NoError(t, err)
+	appID := response.Res.Params[0].(*AppResponse).AppID
+	assert.Equal(t, "60", balance("0xUSDCPolygon", addrA, usdc))
+	assert.Equal(t, "100", balance("0xUSDCBase", addrA, usdc))
+	assert.Equal(t, "90", balance("0xUSDCB", addrB, usdc))
+
+	var vApp VApp
+	require.NoError(t, db.Where("app_id = ?", appID).First(&vApp).Error)
+	assert.Equal(t, []string{"0xUSDCPolygon", "0xUSDCB"}, []string(vApp.FundingChannels))
+
+	closeApp := func(requestID uint64, closeParams CloseApplicationParams) (*AppResponse, error) {
+		req := &RPCRequest{Req: RPCData{
+			RequestID: requestID,
+			Method:    "close_app_session",
+			Params:    []any{closeParams},
+			Timestamp: uint64(time.Now().Unix()),
+		}}
+		signBytes, err := json.Marshal(CloseAppSignData{RequestID: requestID, Method: req.Req.Method, Params: []CloseApplicationParams{closeParams}, Timestamp: req.Req.Timestamp})
+		require.NoError(t, err)
+		for _, signer := range []Signer{signerA, signerB} {
+			sig, err := signer.Sign(signBytes)
+			require.NoError(t, err)
+			req.Sig = append(req.Sig, hexutil.Encode(sig))
+		}
+		response, err := HandleCloseApplication(req, ledger, nil, addrA)
+		if err != nil {
+			return nil, err
+		}
+		return response.Res.Params[0].(*AppResponse), nil
+	}
+
+	// Settlement to a channel in another token is refused
+	_, err = closeApp(3, CloseApplicationParams{AppID: appID, FinalAllocations: []Amount{NewAmount(20), NewAmount(30)}, ChannelIDs: []string{"0xWETHBase", ""}})
+	assert.ErrorContains(t, err, "holds token")
+
+	// A named channel receives the allocation, and the funding channel is used otherwise
+	_, err = closeApp(4, CloseApplicationParams{AppID: appID, FinalAllocations: []Amount{NewAmount(20), NewAmount(30)}, ChannelIDs: []string{"0xUSDCBase", ""}})
+	require.NoError(t, err)
+	assert.Equal(t, "60", balance("0xUSDCPolygon", addrA, usdc))
+	assert.Equal(t, "120", balance("0xUSDCBase", addrA, usdc))
+	assert.Equal(t, "120", balance("0xUSDCB", addrB, usdc))
+
+	// Once the funding channel is closed, the allocation goes to an open channel on the same network,
+	// even one opened with the participant address in another case
+	session := params
+	session.ChannelIDs = nil
+	session.Definition.Nonce += 100
+	session.Allocations = []Amount{NewAmount(0), NewAmount(10)}
+	response, err = HandleCreateApplication(newCreateAppRequest(t, 10, session, signerA, signerB), ledger, nil, addrA)
+	require.NoError(t, err)
+	sessionID := response.Res.Params[0].(*AppResponse).AppID
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", "0xUSDCB").Update("status", ChannelStatusClosed).Error)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xUSDCBBase", ParticipantA: addrB, ParticipantB: BrokerAddress, Status: ChannelStatusOpen, Token: usdc, NetworkID: "8453", Nonce: 3}).Error)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xUSDCBPolygon", ParticipantA: strings.ToLower(addrB), ParticipantB: BrokerAddress, Status: ChannelStatusOpen, Token: usdc, NetworkID: "137", Nonce: 2}).Error)
+	_, err = closeApp(11, CloseApplicationParams{AppID: sessionID, FinalAllocations: []Amount{NewAmount(0), NewAmount(10)}})
+	require.NoError(t, err)
+	assert.Equal(t, "10", balance("0xUSDCBPolygon", addrB, usdc))
+	assert.Equal(t, "0", balance("0xUSDCBBase", addrB, usdc))
+
+	// Allocations go back to funding channels that are not closed yet, such as closing ones
+	session.Definition.Nonce++
+	session.Allocations = []Amount{NewAmount(5), NewAmount(5)}
+	session.ChannelIDs = []string{"0xUSDCPolygon", "0xUSDCBPolygon"}
+	response, err = HandleCreateApplication(newCreateAppRequest(t, 12, session, signerA, signerB), ledger, nil, addrA)
+	require.NoError(t, err)
+	sessionID = response.Res.Params[0].(*AppResponse).AppID
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", "0xUSDCPolygon").Update("status", ChannelStatusClosing).Error)
+	closed, err := closeApp(13, CloseApplicationParams{AppID: sessionID, FinalAllocations: []Amount{NewAmount(5), NewAmount(5)}})
+	require.NoError(t, err)
+	assert.Equal(t, string(ChannelStatusClosed), closed.Status)
+	assert.Equal(t, "60", balance("0xUSDCPolygon", addrA, usdc))
+
+	// Without a channel to settle into, only that participant's allocation stays in the session, until it is closed again
+	session.Definition.Nonce++
+	session.ChannelIDs = []string{"0xUSDCBase", "0xUSDCBPolygon"}
+	response, err = HandleCreateApplication(newCreateAppRequest(t, 14, session, signerA, signerB), ledger, nil, addrA)
+	require.NoError(t, err)
+	sessionID = response.Res.Params[0].(*AppResponse).AppID
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", "0xUSDCBPolygon").Update("status", ChannelStatusClosed).Error)
+	closed, err = closeApp(15, CloseApplicationParams{AppID: sessionID, FinalAllocations: []Amount{NewAmount(5), NewAmount(5)}})
+	require.NoError(t, err)
+	assert.Equal(t, string(ChannelStatusOpen), closed.Status)
+	require.Len(t, closed.Errors, 2)
+	assert.Empty(t, closed.Errors[0])
+	assert.Contains(t, closed.Errors[1], "no unclosed channel of participant "+addrB+" holds token "+usdc+" on network 137")
+	assert.Equal(t, "120", balance("0xUSDCBase", addrA, usdc))
+	assert.Equal(t, "5", balance(sessionID, addrB, usdc))
+
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xUSDCBPolygon2", ParticipantA: addrB, ParticipantB: BrokerAddress, Status: ChannelStatusOpen, Token: usdc, NetworkID: "137", Nonce: 4}).Error)
+	closed, err = closeApp(16, CloseApplicationParams{AppID: sessionID, FinalAllocations: []Amount{NewAmount(0), NewAmount(5)}})
+	require.NoError(t, err)
+	assert.Equal(t, string(ChannelStatusClosed), closed.Status)
+	assert.Equal(t, "5", balance("0xUSDCBPolygon2", addrB, usdc))
+
+	// Without a named channel, a session in another token is funded from the channel holding that token
+	params.Token = weth
+	params.ChannelIDs = nil
+	params.Definition.Nonce++
+	params.Allocations = []Amount{NewAmount(5), NewAmount(0)}
+	_, err = HandleCreateApplication(newCreateAppRequest(t, 5, params, signerA, signerB), ledger, nil, addrA)
+	assert.ErrorContains(t, err, "no open channel of participant "+addrB+" holds token "+weth)
+	require.NoError(t, db.Create(&Channel{ChannelID: "0xWETHB", ParticipantA: addrB, ParticipantB: BrokerAddress, Status: ChannelStatusOpen, Token: weth, NetworkID: "8453", Nonce: 2}).Error)
+	_, err = HandleCreateApplication(newCreateAppRequest(t, 6, params, signerA, signerB), ledger, nil, addrA)
+	require.NoError(t, err)
+	assert.Equal(t, "95", balance("0xWETHBase", addrA, weth))
+}
+
+// TestHandleGetLedgerEntries tests paging through ledger entries with running balances
+func TestHandleGetLedgerEntries(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	require.NoError(t, CreateChannel(db, "0xChannel", "0xAlice", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	require.NoError(t, db.Create(&VApp{AppID: "0xApp", Participants: pq.StringArray{"0xAlice", "0xBob"}, Status: ChannelStatusOpen, Token: "0xUSDC", Nonce: 1}).Error)
+	alice := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xWETH"), NewAmount(5), "test"))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, alice.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(10)))
+	}
+
+	request := func(params GetLedgerEntriesParams) *RPCRequest {
+		return &RPCRequest{
+			Req: RPCData{
+				RequestID: 1,
+				Method:    "get_ledger_entries",
+				Params:    []any{params},
+				Timestamp: uint64(time.Now().Unix()),
+			},
+		}
+	}
+	getEntries := func(params GetLedgerEntriesParams) LedgerEntriesResponse {
+		response, err := HandleGetLedgerEntries(request(params), ledger, "0xAlice")
+		require.NoError(t, err)
+		require.Len(t, response.Res.Params, 1)
+		page, ok := response.Res.Params[0].(LedgerEntriesResponse)
+		require.True(t, ok)
+		return page
+	}
+
+	// Newest first, with the balance after each entry
+	page := getEntries(GetLedgerEntriesParams{AccountID: "0xChannel", Asset: "0xUSDC", Limit: 2})
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "70", page.Entries[0].Balance.String())
+	assert.Equal(t, "10", page.Entries[0].Debit.String())
+	assert.Equal(t, "80", page.Entries[1].Balance.String())
+	assert.Equal(t, page.Entries[1].ID, page.NextCursor)
+
+	page = getEntries(GetLedgerEntriesParams{AccountID: "0xChannel", Asset: "0xUSDC", Limit: 2, Cursor: page.NextCursor})
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "90", page.Entries[0].Balance.String())
+	assert.Equal(t, "100", page.Entries[1].Balance.String())
+	assert.Equal(t, "100", page.Entries[1].Credit.String())
+	assert.Zero(t, page.NextCursor)
+
+	// Beneficiary history spans channel and app accounts in all assets
+	page = getEntries(GetLedgerEntriesParams{Beneficiary: "0xAlice"})
+	assert.Len(t, page.Entries, 8)
+	assert.Zero(t, page.NextCursor)
+
+	// Time range
+	page = getEntries(GetLedgerEntriesParams{Beneficiary: "0xAlice", EndTime: uint64(time.Now().Add(-time.Hour).Unix())})
+	assert.Empty(t, page.Entries)
+
+	// An account or beneficiary is required
+	_, err := HandleGetLedgerEntries(request(GetLedgerEntriesParams{Asset: "0xUSDC"}), ledger, "0xAlice")
+	assert.Error(t, err)
+
+	// Other users can read the app sessions they take part in, but not the channels or entries of Alice
+	response, err := HandleGetLedgerEntries(request(GetLedgerEntriesParams{AccountID: "0xApp"}), ledger, "0xBob")
+	require.NoError(t, err)
+	assert.Len(t, response.Res.Params[0].(LedgerEntriesResponse).Entries, 3)
+	_, err = HandleGetLedgerEntries(request(GetLedgerEntriesParams{AccountID: "0xChannel"}), ledger, "0xBob")
+	assert.Error(t, err)
+	_, err = HandleGetLedgerEntries(request(GetLedgerEntriesParams{Beneficiary: "0xAlice"}), ledger, "0xBob")
+	assert.Error(t, err)
+	_, err = HandleGetLedgerEntries(request(GetLedgerEntriesParams{AccountID: "0xApp"}), ledger, "0xCarol")
+	assert.Error(t, err)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// HoldStatus represents the state of a hold
+type HoldStatus string
+
+var (
+	HoldStatusActive   HoldStatus = "active"   // Funds are reserved for a signed state that is not on-chain yet
+	HoldStatusSettled  HoldStatus = "settled"  // The state was submitted and the funds left the ledger
+	HoldStatusReleased HoldStatus = "released" // A state with a higher version was checkpointed and the funds are available again
+	HoldStatusExpired  HoldStatus = "expired"  // Released after a timeout by earlier versions; holds no longer expire
+)
+
+// Hold reserves funds of an account that the broker has agreed to release on-chain
+// by signing a channel state. Held funds cannot be spent until the hold is settled or released.
+// The signed state can be submitted at any time until a state with a higher version is on-chain,
+// so a hold does not expire.
+type Hold struct {
+	ID          uint       `gorm:"primaryKey"`
+	AccountID   string     `gorm:"column:account_id;not null;index:idx_ledger_holds_account"`
+	Beneficiary string     `gorm:"column:beneficiary;not null;index:idx_ledger_holds_account"`
+	Asset       string     `gorm:"column:asset;not null;index:idx_ledger_holds_account"`
+	Amount      Amount     `gorm:"column:amount;not null"`
+	Version     uint64     `gorm:"column:version;not null"` // Version of the signed channel state
+	Status      HoldStatus `gorm:"column:status;not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// TableName specifies the table name for the Hold model
+func (Hold) TableName() string {
+	return "ledger_holds"
+}
+
+// AvailableBalance returns the balance of this account that is not held
+func (a *BeneficiaryAccount) AvailableBalance() (Amount, error) {
+	var rows []LedgerAccount
+	err := a.db.Where("account_id = ? AND beneficiary = ? AND asset = ?", a.AccountID, a.Beneficiary, a.Asset).
+		Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return Amount{}, err
+	}
+	return rows[0].Balance.Sub(rows[0].Held), nil
+}
+
+// PlaceHold reserves amount of the account for the channel state with the given version.
+// Only one state per version can be submitted on-chain, so holds for the same version are not added up:
+// the existing hold is raised to amount if needed. Fails with ErrInsufficientFunds if the
+// account does not have enough available funds.
+func (l *Ledger) PlaceHold(account *BeneficiaryAccount, amount Amount, version uint64) (*Hold, error) {
+	if amount.Sign() <= 0 {
+		return nil, errors.New("hold amount must be positive")
+	}
+
+	var hold Hold
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		row, err := lockAccount(tx, account)
+		if err != nil {
+			return err
+		}
+
+		var existing []Hold
+		err = tx.Where("account_id = ? AND beneficiary = ? AND asset = ? AND version = ? AND status = ?",
+			account.AccountID, account.Beneficiary, account.Asset, version, HoldStatusActive).
+			Limit(1).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+
+		hold = Hold{
+			AccountID:   account.AccountID,
+			Beneficiary: account.Beneficiary,
+			Asset:       account.Asset,
+			Version:     version,
+			Status:      HoldStatusActive,
+		}
+		increase := amount
+		if len(existing) > 0 {
+			hold = existing[0]
+			if hold.Amount.Cmp(amount) >= 0 {
+				increase = Amount{}
+			} else {
+				increase = amount.Sub(hold.Amount)
+			}
+		}
+
+		if row.Balance.Sub(row.Held).Cmp(increase) < 0 {
+			return fmt.Errorf("%w in account %s of %s", ErrInsufficientFunds, account.AccountID, account.Beneficiary)
+		}
+
+		if increase.Sign() > 0 {
+			hold.Amount = hold.Amount.Add(increase)
+		}
+		if err := tx.Save(&hold).Error; err != nil {
+			return fmt.Errorf("failed to save hold: %w", err)
+		}
+
+		return tx.Model(row).Update("held", row.Held.Add(increase)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &hold, nil
+}
+
+// SettleHolds resolves the active holds of the account for states up to and including version
+// once a state has been submitted on-chain, and withdraws the amount that actually left the channel.
+func (l *Ledger) SettleHolds(account *BeneficiaryAccount, version uint64, withdrawn Amount, reference string) error {
+	return l.db.Transaction(func(tx *gorm.DB) error {
+		if err := resolveHolds(tx, account, version, HoldStatusSettled); err != nil {
+			return err
+		}
+		if withdrawn.IsZero() {
+			return nil
+		}
+		ledgerTx := &Ledger{db: tx}
+		return ledgerTx.Withdraw(ledgerTx.SelectBeneficiaryAccount(account.AccountID, account.Beneficiary, account.Asset), withdrawn, reference)
+	})
+}
+
+// ReleaseSupersededHolds makes the funds of the active holds of the account for states before version available again,
+// once a state with that version is checkpointed on-chain and the earlier states can no longer be submitted
+func (l *Ledger) ReleaseSupersededHolds(account *BeneficiaryAccount, version uint64) error {
+	if version == 0 {
+		return nil
+	}
+	return l.db.Transaction(func(tx *gorm.DB) error {
+		return resolveHolds(tx, account, version-1, HoldStatusReleased)
+	})
+}
+
+// resolveHolds marks the active holds of an account up to and including version with status
+// and makes their funds available again.
+func resolveHolds(tx *gorm.DB, account *BeneficiaryAccount, version uint64, status HoldStatus) error {
+	row, err := lockAccount(tx, account)
+	if err != nil {
+		return err
+	}
+
+	var holds []Hold
+	err = tx.Where("account_id = ? AND beneficiary = ? AND asset = ? AND version <= ? AND status = ?",
+		account.AccountID, account.Beneficiary, account.Asset, version, HoldStatusActive).Find(&holds).Error
+	if err != nil || len(holds) == 0 {
+		return err
+	}
+
+	held := row.Held
+	for _, hold := range holds {
+		held = held.Sub(hold.Amount)
+		err := tx.Model(&hold).Updates(map[string]any{"status": status, "updated_at": time.Now()}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update hold: %w", err)
+		}
+	}
+
+	return tx.Model(row).Update("held", held).Error
+}
+
+// lockAccount locks the row of a single account for the rest of tx and returns it
+func lockAccount(tx *gorm.DB, account *BeneficiaryAccount) (*LedgerAccount, error) {
+	locked, err := lockAccounts(tx, []*BeneficiaryAccount{account})
+	if err != nil {
+		return nil, err
+	}
+	return locked[account.key()], nil
+}
+
+// reactivateHolds puts back the holds of an account settled for states after version,
+// when the on-chain submission that settled them was removed by a reorg
+func reactivateHolds(tx *gorm.DB, account *BeneficiaryAccount, version uint64) error {
+	row, err := lockAccount(tx, account)
+	if err != nil {
+		return err
+	}
+
+	var holds []Hold
+	err = tx.Where("account_id = ? AND beneficiary = ? AND asset = ? AND version > ? AND status = ?",
+		account.AccountID, account.Beneficiary, account.Asset, version, HoldStatusSettled).Find(&holds).Error
+	if err != nil || len(holds) == 0 {
+		return err
+	}
+
+	held := row.Held
+	for _, hold := range holds {
+		held = held.Add(hold.Amount)
+		err := tx.Model(&hold).Updates(map[string]any{"status": HoldStatusActive, "updated_at": time.Now()}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update hold: %w", err)
+		}
+	}
+
+	return tx.Model(row).Update("held", held).Error
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLedgerHolds tests that held funds cannot be spent until the hold is settled
+func TestLedgerHolds(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	channel := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	app := ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(channel, NewAmount(100), "test"))
+
+	_, err := ledger.PlaceHold(channel, NewAmount(60), 2)
+	require.NoError(t, err)
+
+	// A second state for the same version replaces the first one on-chain, so the larger amount is held
+	_, err = ledger.PlaceHold(channel, NewAmount(30), 2)
+	require.NoError(t, err)
+	hold, err := ledger.PlaceHold(channel, NewAmount(70), 2)
+	require.NoError(t, err)
+	assert.Equal(t, "70", hold.Amount.String())
+
+	available, err := channel.AvailableBalance()
+	require.NoError(t, err)
+	assert.Equal(t, "30", available.String())
+
+	_, err = ledger.PlaceHold(channel, NewAmount(40), 3)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.ErrorIs(t, channel.Transfer(TransactionKindAppFund, "test", app, NewAmount(31)), ErrInsufficientFunds)
+	require.NoError(t, channel.Transfer(TransactionKindAppFund, "test", app, NewAmount(30)))
+
+	// The state was submitted on-chain with version 2
+	require.NoError(t, ledger.SettleHolds(channel, 2, NewAmount(70), ChainReference("0xabc", 1)))
+
+	balance, err := channel.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "0", balance.String())
+	available, err = channel.AvailableBalance()
+	require.NoError(t, err)
+	assert.Equal(t, "0", available.String())
+
+	var settled Hold
+	require.NoError(t, db.First(&settled, hold.ID).Error)
+	assert.Equal(t, HoldStatusSettled, settled.Status)
+
+	drifts, err := CheckAccountBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+}
+
+// TestLedgerReleaseSupersededHolds tests that held funds stay held until a state with a higher version is on-chain
+func TestLedgerReleaseSupersededHolds(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	channel := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(channel, NewAmount(100), "test"))
+
+	hold, err := ledger.PlaceHold(channel, NewAmount(100), 2)
+	require.NoError(t, err)
+
+	// The signed state can still be submitted, so its funds cannot be spent
+	require.NoError(t, ledger.ReleaseSupersededHolds(channel, 2))
+	err = channel.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(100))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	require.NoError(t, ledger.ReleaseSupersededHolds(channel, 3))
+	var released Hold
+	require.NoError(t, db.First(&released, hold.ID).Error)
+	assert.Equal(t, HoldStatusReleased, released.Status)
+
+	available, err := channel.AvailableBalance()
+	require.NoError(t, err)
+	assert.Equal(t, "100", available.String())
+}
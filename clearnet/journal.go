@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TransactionKind describes why funds were moved by a journal transaction
+type TransactionKind string
+
+var (
+	TransactionKindDeposit     TransactionKind = "deposit"      // Funds locked on-chain are credited to a channel account
+	TransactionKindAppFund     TransactionKind = "app_fund"     // Funds move from channel accounts into an app session
+	TransactionKindAppTransfer TransactionKind = "app_transfer" // Funds move between participants inside an app session
+	TransactionKindAppSettle   TransactionKind = "app_settle"   // Funds move from a closed app session back to channel accounts
+	TransactionKindWithdraw    TransactionKind = "withdraw"     // Funds leave a channel account on-chain
+	TransactionKindFee         TransactionKind = "fee"          // Funds are charged by the broker
+	TransactionKindReversal    TransactionKind = "reversal"     // Undoes transactions of an on-chain log removed by a reorg
+)
+
+// CustodyAccountID is the ledger account mirroring funds held by custody contracts.
+// Its beneficiaries are channel IDs. It is debited on deposits and credited on withdrawals,
+// so that every journal transaction, including on-chain ones, sums to zero.
+const CustodyAccountID = "custody"
+
+// ErrUnbalancedTransaction is returned when the postings of a journal transaction do not sum to zero
+var ErrUnbalancedTransaction = errors.New("journal transaction is not balanced")
+
+// Transaction groups the ledger entries created by a single operation
+type Transaction struct {
+	ID        uint            `gorm:"primaryKey"`
+	Kind      TransactionKind `gorm:"column:kind;not null"`
+	Reference string          `gorm:"column:reference;not null;index"` // What caused this transaction, see RPCReference and ChainReference
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for the Transaction model
+func (Transaction) TableName() string {
+	return "ledger_transactions"
+}
+
+// RPCReference identifies a journal transaction caused by an RPC request
+func RPCReference(sender string, requestID uint64) string {
+	return fmt.Sprintf("rpc:%s:%d", sender, requestID)
+}
+
+// ChainReference identifies a journal transaction caused by an on-chain log
+func ChainReference(txHash string, logIndex uint) string {
+	return fmt.Sprintf("chain:%s:%d", txHash, logIndex)
+}
+
+// ReversalReference identifies a journal transaction undoing the transactions with the given reference
+func ReversalReference(reference string) string {
+	return "reversal:" + reference
+}
+
+// Posting is a single side of a journal transaction.
+// Positive amounts credit the account, negative amounts debit it.
+type Posting struct {
+	Account *BeneficiaryAccount
+	Amount  Amount
+}
+
+// Post records a journal transaction with the given postings.
+// The postings of each asset must sum to zero, otherwise nothing is written.
+// Zero postings are skipped; if no posting is left, no transaction is recorded.
+//
+// All accounts are locked before the entries are written, their materialized balances are updated
+// in the same database transaction, and the transaction is rolled back with ErrInsufficientFunds
+// if any debited account other than the custody account ends up with less than its held funds.
+func (l *Ledger) Post(kind TransactionKind, reference string, postings ...Posting) (*Transaction, error) {
+	return l.post(kind, reference, true, postings...)
+}
+
+// post records a journal transaction, checking available funds of debited accounts if checkFunds is set
+func (l *Ledger) post(kind TransactionKind, reference string, checkFunds bool, postings ...Posting) (*Transaction, error) {
+	sums := make(map[string]Amount)
+	var nonZero []Posting
+	for _, p := range postings {
+		if p.Amount.IsZero() {
+			continue
+		}
+		sums[p.Account.Asset] = sums[p.Account.Asset].Add(p.Amount)
+		nonZero = append(nonZero, p)
+	}
+
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			return nil, fmt.Errorf("%w: %s postings sum to %s", ErrUnbalancedTransaction, asset, sum)
+		}
+	}
+
+	if len(nonZero) == 0 {
+		return nil, nil
+	}
+
+	transaction := &Transaction{
+		Kind:      kind,
+		Reference: reference,
+		CreatedAt: time.Now(),
+	}
+
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		accounts := make([]*BeneficiaryAccount, 0, len(nonZero))
+		for _, p := range nonZero {
+			accounts = append(accounts, &BeneficiaryAccount{
+				AccountID:   p.Account.AccountID,
+				Beneficiary: p.Account.Beneficiary,
+				Asset:       p.Account.Asset,
+				db:          tx,
+			})
+		}
+
+		locked, err := lockAccounts(tx, accounts)
+		if err != nil {
+			return err
+		}
+
+		// Each entry records the balance of its account after its own posting
+		balances := make([]Amount, len(accounts))
+		for i, account := range accounts {
+			row := locked[account.key()]
+			row.Balance = row.Balance.Add(nonZero[i].Amount)
+			balances[i] = row.Balance
+		}
+
+		// Balances are read under the account locks, so concurrent spends cannot both pass this check.
+		// Held funds are reserved for pending withdrawals and cannot be spent.
+		for i, account := range accounts {
+			if !checkFunds || nonZero[i].Amount.Sign() > 0 || account.AccountID == CustodyAccountID {
+				continue
+			}
+			row := locked[account.key()]
+			if row.Balance.Sub(row.Held).Sign() < 0 {
+				return fmt.Errorf("%w in account %s of %s", ErrInsufficientFunds, account.AccountID, account.Beneficiary)
+			}
+		}
+
+		for _, row := range locked {
+			if err := tx.Model(row).Update("balance", row.Balance).Error; err != nil {
+				return fmt.Errorf("failed to update account balance: %w", err)
+			}
+		}
+
+		if err := tx.Create(transaction).Error; err != nil {
+			return fmt.Errorf("failed to record journal transaction: %w", err)
+		}
+
+		// The chain head serializes all postings until commit, so it is locked last, once the transaction
+		// is known to succeed, to keep the serialized part down to writing the entries
+		head, err := lockChainHead(tx, ledgerChain)
+		if err != nil {
+			return err
+		}
+
+		for i, account := range accounts {
+			if err := account.record(head, transaction.ID, nonZero[i].Amount, balances[i]); err != nil {
+				return err
+			}
+		}
+
+		if err := saveChainHead(tx, head); err != nil {
+			return fmt.Errorf("failed to update ledger chain head: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// SelectCustodyAccount returns the custody counterpart of a channel account
+func (l *Ledger) SelectCustodyAccount(channelID, asset string) *BeneficiaryAccount {
+	return l.SelectBeneficiaryAccount(CustodyAccountID, channelID, asset)
+}
+
+// Deposit credits a channel account with funds that were locked in the custody contract
+func (l *Ledger) Deposit(account *BeneficiaryAccount, amount Amount, reference string) error {
+	if amount.Sign() < 0 {
+		return errors.New("deposit amount must be positive")
+	}
+
+	_, err := l.Post(TransactionKindDeposit, reference,
+		Posting{Account: account, Amount: amount},
+		Posting{Account: l.SelectCustodyAccount(account.AccountID, account.Asset), Amount: amount.Neg()},
+	)
+	return err
+}
+
+// Withdraw debits a channel account for funds that were released by the custody contract.
+// The funds already left the contract, so the withdrawal is booked even if it leaves the account
+// with less than its held funds, or a negative balance, which reconciliation reports.
+func (l *Ledger) Withdraw(account *BeneficiaryAccount, amount Amount, reference string) error {
+	if amount.Sign() < 0 {
+		return errors.New("withdrawal amount must be positive")
+	}
+
+	_, err := l.post(TransactionKindWithdraw, reference, false,
+		Posting{Account: account, Amount: amount.Neg()},
+		Posting{Account: l.SelectCustodyAccount(account.AccountID, account.Asset), Amount: amount},
+	)
+	return err
+}
+
+// ReverseTransactions records the opposite of every journal transaction with reference that was not reversed yet.
+// Funds are taken back even if they were spent since, leaving the account with a negative balance to be settled.
+func (l *Ledger) ReverseTransactions(reference string) (int, error) {
+	count := 0
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var lastReversal uint
+		err := tx.Model(&Transaction{}).Where("reference = ?", ReversalReference(reference)).
+			Select("COALESCE(MAX(id), 0)").Scan(&lastReversal).Error
+		if err != nil {
+			return err
+		}
+
+		var transactions []Transaction
+		if err := tx.Where("reference = ? AND id > ?", reference, lastReversal).Order("id").Find(&transactions).Error; err != nil {
+			return err
+		}
+
+		ledgerTx := &Ledger{db: tx}
+		for _, transaction := range transactions {
+			entries, err := GetTransactionEntries(tx, transaction.ID)
+			if err != nil {
+				return err
+			}
+			postings := make([]Posting, len(entries))
+			for i, entry := range entries {
+				postings[i] = Posting{
+					Account: ledgerTx.SelectBeneficiaryAccount(entry.AccountID, entry.Beneficiary, entry.Asset),
+					Amount:  entry.Debit.Sub(entry.Credit),
+				}
+			}
+			if _, err := ledgerTx.post(TransactionKindReversal, ReversalReference(reference), false, postings...); err != nil {
+				return fmt.Errorf("failed to reverse transaction %d: %w", transaction.ID, err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// GetTransactionEntries returns the entries of a journal transaction
+func GetTransactionEntries(db *gorm.DB, transactionID uint) ([]Entry, error) {
+	var entries []Entry
+	err := db.Where("transaction_id = ?", transactionID).Order("id").Find(&entries).Error
+	return entries, err
+}
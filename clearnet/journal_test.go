@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLedgerPost tests that a balanced journal transaction links all of its entries
+func TestLedgerPost(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	alice := ledger.SelectBeneficiaryAccount("0xChannelA", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), ChainReference("0xabc", 3)))
+
+	app := ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC")
+	transaction, err := ledger.Post(TransactionKindAppFund, RPCReference("0xAlice", 42),
+		Posting{Account: alice, Amount: NewAmount(-60)},
+		Posting{Account: app, Amount: NewAmount(60)},
+	)
+	require.NoError(t, err)
+	require.NotNil(t, transaction)
+	assert.Equal(t, TransactionKindAppFund, transaction.Kind)
+	assert.Equal(t, "rpc:0xAlice:42", transaction.Reference)
+
+	entries, err := GetTransactionEntries(db, transaction.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "0xChannelA", entries[0].AccountID)
+	assert.Equal(t, "60", entries[0].Debit.String())
+	assert.Equal(t, "0xApp", entries[1].AccountID)
+	assert.Equal(t, "60", entries[1].Credit.String())
+
+	// The deposit is balanced against the custody account of the channel
+	var deposit Transaction
+	require.NoError(t, db.Where("kind = ?", TransactionKindDeposit).First(&deposit).Error)
+	assert.Equal(t, "chain:0xabc:3", deposit.Reference)
+
+	custodyBalance, err := ledger.SelectCustodyAccount("0xChannelA", "0xUSDC").Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "-100", custodyBalance.String())
+}
+
+// TestLedgerPostUnbalanced tests that unbalanced journal transactions are rejected without writing entries
+func TestLedgerPostUnbalanced(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	alice := ledger.SelectBeneficiaryAccount("0xChannelA", "0xAlice", "0xUSDC")
+	bob := ledger.SelectBeneficiaryAccount("0xChannelB", "0xBob", "0xUSDC")
+	bobWeth := ledger.SelectBeneficiaryAccount("0xChannelB", "0xBob", "0xWETH")
+
+	_, err := ledger.Post(TransactionKindFee, "test",
+		Posting{Account: alice, Amount: NewAmount(-10)},
+		Posting{Account: bob, Amount: NewAmount(9)},
+	)
+	assert.ErrorIs(t, err, ErrUnbalancedTransaction)
+
+	// Amounts in different assets never offset each other
+	_, err = ledger.Post(TransactionKindFee, "test",
+		Posting{Account: alice, Amount: NewAmount(-10)},
+		Posting{Account: bobWeth, Amount: NewAmount(10)},
+	)
+	assert.ErrorIs(t, err, ErrUnbalancedTransaction)
+
+	var entries, transactions int64
+	require.NoError(t, db.Model(&Entry{}).Count(&entries).Error)
+	require.NoError(t, db.Model(&Transaction{}).Count(&transactions).Error)
+	assert.Zero(t, entries)
+	assert.Zero(t, transactions)
+}
@@ -3,19 +3,26 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Entry represents a ledger entry in the database
 type Entry struct {
-	ID          uint   `gorm:"primaryKey"`
-	AccountID   string `gorm:"column:account_id;not null"`
-	Beneficiary string `gorm:"column:beneficiary;not null"`
-	Credit      int64  `gorm:"column:credit;not null"`
-	Debit       int64  `gorm:"column:debit;not null"`
-	CreatedAt   time.Time
+	ID            uint      `gorm:"primaryKey;index:idx_ledger_account_history,priority:4"`
+	TransactionID uint      `gorm:"column:transaction_id;not null;default:0;index"` // Journal transaction this entry belongs to
+	AccountID     string    `gorm:"column:account_id;not null;index:idx_ledger_account_history,priority:1"`
+	Beneficiary   string    `gorm:"column:beneficiary;not null;index:idx_ledger_account_history,priority:2"`
+	Asset         string    `gorm:"column:asset;not null;default:'';index:idx_ledger_account_history,priority:3"` // Token address of the asset
+	Credit        Amount    `gorm:"column:credit;not null"`
+	Debit         Amount    `gorm:"column:debit;not null"`
+	Balance       Amount    `gorm:"column:balance;not null;default:0"`    // Running balance of the account after this entry
+	PrevHash      string    `gorm:"column:prev_hash;not null;default:''"` // Hash of the previous entry, see chain.go
+	Hash          string    `gorm:"column:hash;not null;default:''"`      // Hash of this entry chained to PrevHash
+	CreatedAt     time.Time `gorm:"index"`
 }
 
 // TableName specifies the table name for the Entry model
@@ -23,10 +30,38 @@ func (Entry) TableName() string {
 	return "ledger"
 }
 
-// BeneficiaryAccount represents an account in the ledger system
+// ErrAssetMismatch is returned when funds are moved between accounts holding different assets
+var ErrAssetMismatch = errors.New("cannot transfer between different assets")
+
+// ErrInsufficientFunds is returned when a journal transaction would leave an account with a negative balance
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// LedgerAccount holds the materialized balance of a beneficiary account.
+// The balance is updated in the same database transaction as the entries it sums, and the row
+// doubles as the account lock: writers lock the rows of every account they post to before
+// checking balances, which serializes concurrent spends from the same account.
+type LedgerAccount struct {
+	ID          uint   `gorm:"primaryKey"`
+	AccountID   string `gorm:"column:account_id;not null;uniqueIndex:idx_ledger_accounts_key"`
+	Beneficiary string `gorm:"column:beneficiary;not null;uniqueIndex:idx_ledger_accounts_key"`
+	Asset       string `gorm:"column:asset;not null;uniqueIndex:idx_ledger_accounts_key"`
+	Balance     Amount `gorm:"column:balance;not null;default:0"` // Sum of credit - debit over all entries of the account
+	Held        Amount `gorm:"column:held;not null;default:0"`    // Part of the balance reserved by active holds
+	Version     uint64 `gorm:"column:version;not null;default:0"` // Incremented by every journal transaction touching the account
+	UpdatedAt   time.Time
+}
+
+// TableName specifies the table name for the LedgerAccount model
+func (LedgerAccount) TableName() string {
+	return "ledger_accounts"
+}
+
+// BeneficiaryAccount represents an account in the ledger system.
+// Each account holds a single asset, identified by its token address.
 type BeneficiaryAccount struct {
 	AccountID   string
 	Beneficiary string
+	Asset       string
 	db          *gorm.DB
 }
 
@@ -43,125 +78,433 @@ func NewLedger(db *gorm.DB) *Ledger {
 }
 
 // Account creates an Account instance for the given parameters
-func (l *Ledger) SelectBeneficiaryAccount(channelID, beneficiary string) *BeneficiaryAccount {
+func (l *Ledger) SelectBeneficiaryAccount(channelID, beneficiary, asset string) *BeneficiaryAccount {
 	return &BeneficiaryAccount{
 		AccountID:   channelID,
 		Beneficiary: beneficiary,
+		Asset:       asset,
 		db:          l.db,
 	}
 }
 
 // Balance returns the current balance (credit - debit) for this account
-func (a *BeneficiaryAccount) Balance() (int64, error) {
-	var creditSum, debitSum int64
+func (a *BeneficiaryAccount) Balance() (Amount, error) {
+	var rows []LedgerAccount
+	err := a.db.Where("account_id = ? AND beneficiary = ? AND asset = ?", a.AccountID, a.Beneficiary, a.Asset).
+		Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return Amount{}, err
+	}
+	return rows[0].Balance, nil
+}
 
-	err := a.db.Model(&Entry{}).
-		Where("account_id = ? AND beneficiary = ?",
-			a.AccountID, a.Beneficiary).
-		Select("COALESCE(SUM(credit), 0) as credit_sum, COALESCE(SUM(debit), 0) as debit_sum").
-		Row().Scan(&creditSum, &debitSum)
+// GetAccountBalances returns the balances per beneficiary and asset for this account.
+// If asset is not empty, only balances in that asset are returned.
+func GetAccountBalances(db *gorm.DB, accountID, asset string) ([]AvailableBalance, error) {
+	query := db.Where("account_id = ?", accountID)
+	if asset != "" {
+		query = query.Where("asset = ?", asset)
+	}
 
-	if err != nil {
-		return 0, err
+	var rows []LedgerAccount
+	if err := query.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
 	}
 
-	return creditSum - debitSum, nil
+	var balances []AvailableBalance
+	for _, row := range rows {
+		balances = append(balances, AvailableBalance{
+			Address: row.Beneficiary,
+			Asset:   row.Asset,
+			Amount:  row.Balance,
+		})
+	}
+
+	return balances, nil
 }
 
-// Balances returns the balances for all token addresses for this account
-func GetAccountBalances(db *gorm.DB, accountID string) ([]AvailableBalance, error) {
-	type BalanceResult struct {
-		Beneficiary string
-		CreditSum   int64
-		DebitSum    int64
+// AsOf selects a point in the ledger history.
+// If both fields are set, the earlier of the two points is used.
+type AsOf struct {
+	Time    time.Time // Include entries created at or before this time
+	EntryID uint      // Include entries up to and including this entry ID
+}
+
+// lastEntryID resolves the point in history to the ID of the last entry it includes.
+// Entry IDs grow with their creation time, so a time is mapped to the newest entry created by then.
+func (p AsOf) lastEntryID(db *gorm.DB) (uint, error) {
+	lastID := p.EntryID
+	if !p.Time.IsZero() {
+		var id *uint
+		if err := db.Model(&Entry{}).Select("MAX(id)").Where("created_at <= ?", p.Time).Scan(&id).Error; err != nil {
+			return 0, err
+		}
+		if id == nil {
+			return 0, nil
+		}
+		if lastID == 0 || *id < lastID {
+			lastID = *id
+		}
 	}
+	return lastID, nil
+}
 
-	var results []BalanceResult
-	err := db.Model(&Entry{}).
-		Where("account_id = ?", accountID).
-		Select("beneficiary, COALESCE(SUM(credit), 0) as credit_sum, COALESCE(SUM(debit), 0) as debit_sum").
-		Group("beneficiary").
-		Scan(&results).Error
+// BalanceAsOf returns the balance (credit - debit) of this account at a point in the ledger history
+func (a *BeneficiaryAccount) BalanceAsOf(asOf AsOf) (Amount, error) {
+	lastID, err := asOf.lastEntryID(a.db)
+	if err != nil || lastID == 0 {
+		return Amount{}, err
+	}
 
-	if err != nil {
+	var entries []Entry
+	err = a.db.Where("account_id = ? AND beneficiary = ? AND asset = ? AND id <= ?", a.AccountID, a.Beneficiary, a.Asset, lastID).
+		Order("id DESC").Limit(1).Find(&entries).Error
+	if err != nil || len(entries) == 0 {
+		return Amount{}, err
+	}
+	return entries[0].Balance, nil
+}
+
+// GetAccountBalancesAsOf returns the balances per beneficiary and asset for this account at a point in the ledger history.
+// Each balance is the running balance of the last entry of the beneficiary account at that point.
+// If asset is not empty, only balances in that asset are returned.
+func GetAccountBalancesAsOf(db *gorm.DB, accountID, asset string, asOf AsOf) ([]AvailableBalance, error) {
+	lastID, err := asOf.lastEntryID(db)
+	if err != nil || lastID == 0 {
+		return nil, err
+	}
+
+	latest := db.Model(&Entry{}).Select("MAX(id)").Where("account_id = ? AND id <= ?", accountID, lastID)
+	if asset != "" {
+		latest = latest.Where("asset = ?", asset)
+	}
+	latest = latest.Group("beneficiary, asset")
+
+	var entries []Entry
+	if err := db.Where("id IN (?)", latest).Order("id").Find(&entries).Error; err != nil {
 		return nil, err
 	}
 
 	var balances []AvailableBalance
-	for _, r := range results {
+	for _, entry := range entries {
 		balances = append(balances, AvailableBalance{
-			Address: r.Beneficiary,
-			Amount:  r.CreditSum - r.DebitSum,
+			Address: entry.Beneficiary,
+			Asset:   entry.Asset,
+			Amount:  entry.Balance,
 		})
 	}
 
 	return balances, nil
 }
 
-// Record creates a new ledger entry for this account
-// If amount > 0, it records a credit; if amount < 0, it records a debit
-func (a *BeneficiaryAccount) Record(amount int64) error {
+// EntryFilter selects ledger entries. Empty fields are not filtered on.
+type EntryFilter struct {
+	AccountID   string
+	Beneficiary string
+	Asset       string
+	Since       time.Time // Only entries created at or after this time
+	Until       time.Time // Only entries created before this time
+	BeforeID    uint      // Only entries with a lower ID, used as a pagination cursor
+	Limit       int
+}
+
+// GetEntries returns the ledger entries matching filter, newest first
+func GetEntries(db *gorm.DB, filter EntryFilter) ([]Entry, error) {
+	query := db.Model(&Entry{})
+	if filter.AccountID != "" {
+		query = query.Where("account_id = ?", filter.AccountID)
+	}
+	if filter.Beneficiary != "" {
+		query = query.Where("beneficiary = ?", filter.Beneficiary)
+	}
+	if filter.Asset != "" {
+		query = query.Where("asset = ?", filter.Asset)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var entries []Entry
+	err := query.Order("id DESC").Find(&entries).Error
+	return entries, err
+}
+
+// record creates a new ledger entry for this account as part of a journal transaction
+// and appends it to the ledger hash chain, whose head must be locked.
+// If amount > 0, it records a credit; if amount < 0, it records a debit.
+// balance is the balance of the account including this entry.
+func (a *BeneficiaryAccount) record(head *ChainHead, transactionID uint, amount, balance Amount) error {
 	entry := &Entry{
-		AccountID:   a.AccountID,
-		Beneficiary: a.Beneficiary,
-		Credit:      0,
-		Debit:       0,
-		CreatedAt:   time.Now(),
+		TransactionID: transactionID,
+		AccountID:     a.AccountID,
+		Beneficiary:   a.Beneficiary,
+		Asset:         a.Asset,
+		Balance:       balance,
+		CreatedAt:     time.Now().Truncate(time.Microsecond), // PostgreSQL keeps microseconds; the hash must survive the round trip
 	}
 
-	if amount > 0 {
+	if amount.Sign() > 0 {
 		entry.Credit = amount
-	} else if amount < 0 {
-		entry.Debit = -amount // Convert negative to positive for debit
-	} else {
-		// return errors.New("amount cannot be zero") // Uncomment if you want to disallow zero amounts
+	} else if amount.Sign() < 0 {
+		entry.Debit = amount.Neg() // Convert negative to positive for debit
+	}
+
+	hash, err := linkRecord(head.Hash, entry)
+	if err != nil {
+		return err
 	}
+	entry.PrevHash = head.Hash
+	entry.Hash = hash
 
-	return a.db.Create(entry).Error
+	if err := a.db.Create(entry).Error; err != nil {
+		return err
+	}
+	head.Hash = hash
+	return nil
 }
 
-// Transfer moves funds from this account to another account
-func (a *BeneficiaryAccount) Transfer(toAccount *BeneficiaryAccount, amount int64) error {
+// Transfer moves funds from this account to another account as a single journal transaction
+func (a *BeneficiaryAccount) Transfer(kind TransactionKind, reference string, toAccount *BeneficiaryAccount, amount Amount) error {
 	fmt.Println("transferring amount:", amount)
-	if amount < 0 {
+	if amount.Sign() < 0 {
 		return errors.New("transfer amount must be positive")
 	}
 
-	// Check if the source account has sufficient funds
-	balance, err := a.Balance()
-	if err != nil {
-		return err
+	if a.Asset != toAccount.Asset {
+		return ErrAssetMismatch
 	}
 
-	if balance < amount {
-		return errors.New("insufficient funds for transfer")
-	}
+	// Post locks the source account and rejects the transfer if its balance would become negative
+	ledger := &Ledger{db: a.db}
+	_, err := ledger.Post(kind, reference,
+		Posting{Account: a, Amount: amount.Neg()},
+		Posting{Account: toAccount, Amount: amount},
+	)
+	return err
+}
+
+// accountKey identifies a beneficiary account
+type accountKey struct {
+	accountID   string
+	beneficiary string
+	asset       string
+}
+
+func (a *BeneficiaryAccount) key() accountKey {
+	return accountKey{accountID: a.AccountID, beneficiary: a.Beneficiary, asset: a.Asset}
+}
 
-	// Use a transaction to ensure atomicity
-	return a.db.Transaction(func(tx *gorm.DB) error {
-		// Create a temporary account with transaction db
-		fromAccount := &BeneficiaryAccount{
+// lockAccounts takes a write lock on the rows of the given accounts for the rest of tx
+// and returns the locked rows, whose balances cannot change until tx ends.
+// The lock is taken with an UPDATE so that it works on both PostgreSQL, where it locks the row,
+// and SQLite, where it acquires the database write lock. Accounts are locked in a fixed order
+// to avoid deadlocks between transactions touching the same accounts.
+func lockAccounts(tx *gorm.DB, accounts []*BeneficiaryAccount) (map[accountKey]*LedgerAccount, error) {
+	sorted := make([]*BeneficiaryAccount, len(accounts))
+	copy(sorted, accounts)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].AccountID != sorted[j].AccountID {
+			return sorted[i].AccountID < sorted[j].AccountID
+		}
+		if sorted[i].Beneficiary != sorted[j].Beneficiary {
+			return sorted[i].Beneficiary < sorted[j].Beneficiary
+		}
+		return sorted[i].Asset < sorted[j].Asset
+	})
+
+	locked := make(map[accountKey]*LedgerAccount, len(sorted))
+	for _, a := range sorted {
+		if _, ok := locked[a.key()]; ok {
+			continue
+		}
+
+		row := LedgerAccount{
 			AccountID:   a.AccountID,
 			Beneficiary: a.Beneficiary,
-			db:          tx,
+			Asset:       a.Asset,
+			UpdatedAt:   time.Now(),
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return nil, fmt.Errorf("failed to create ledger account: %w", err)
 		}
 
-		toAccountTx := &BeneficiaryAccount{
-			AccountID:   toAccount.AccountID,
-			Beneficiary: toAccount.Beneficiary,
-			db:          tx,
+		err := tx.Model(&LedgerAccount{}).
+			Where("account_id = ? AND beneficiary = ? AND asset = ?", a.AccountID, a.Beneficiary, a.Asset).
+			Updates(map[string]any{
+				"version":    gorm.Expr("version + 1"),
+				"updated_at": time.Now(),
+			}).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock ledger account: %w", err)
 		}
 
-		// Debit the source account
-		if err := fromAccount.Record(-amount); err != nil {
+		row = LedgerAccount{}
+		err = tx.Where("account_id = ? AND beneficiary = ? AND asset = ?", a.AccountID, a.Beneficiary, a.Asset).
+			First(&row).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ledger account: %w", err)
+		}
+		locked[a.key()] = &row
+	}
+
+	return locked, nil
+}
+
+// BalanceDrift describes an account whose materialized balance differs from the sum of its entries
+type BalanceDrift struct {
+	AccountID   string
+	Beneficiary string
+	Asset       string
+	Stored      Amount // Balance in the ledger_accounts table
+	Computed    Amount // Sum of credit - debit over the ledger entries
+}
+
+// computeAccountBalances sums credit - debit over all ledger entries per account.
+// Amounts are summed in Go because SQLite cannot aggregate 256-bit values without losing precision.
+func computeAccountBalances(db *gorm.DB) (map[accountKey]Amount, error) {
+	rows, err := db.Model(&Entry{}).Select("account_id, beneficiary, asset, credit, debit").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[accountKey]Amount)
+	for rows.Next() {
+		var key accountKey
+		var credit, debit Amount
+		if err := rows.Scan(&key.accountID, &key.beneficiary, &key.asset, &credit, &debit); err != nil {
+			return nil, err
+		}
+		totals[key] = totals[key].Add(credit).Sub(debit)
+	}
+
+	return totals, rows.Err()
+}
+
+// CheckAccountBalances recomputes every account balance from the ledger entries
+// and returns the accounts whose materialized balance has drifted.
+func CheckAccountBalances(db *gorm.DB) ([]BalanceDrift, error) {
+	var drifts []BalanceDrift
+	err := db.Transaction(func(tx *gorm.DB) error {
+		computed, err := computeAccountBalances(tx)
+		if err != nil {
+			return err
+		}
+
+		var accounts []LedgerAccount
+		if err := tx.Order("id").Find(&accounts).Error; err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			key := accountKey{accountID: account.AccountID, beneficiary: account.Beneficiary, asset: account.Asset}
+			if account.Balance.Cmp(computed[key]) != 0 {
+				drifts = append(drifts, BalanceDrift{
+					AccountID:   account.AccountID,
+					Beneficiary: account.Beneficiary,
+					Asset:       account.Asset,
+					Stored:      account.Balance,
+					Computed:    computed[key],
+				})
+			}
+			delete(computed, key)
+		}
+
+		// Accounts with entries but without a balance row
+		missing := make([]accountKey, 0, len(computed))
+		for key := range computed {
+			missing = append(missing, key)
+		}
+		sort.Slice(missing, func(i, j int) bool {
+			if missing[i].accountID != missing[j].accountID {
+				return missing[i].accountID < missing[j].accountID
+			}
+			if missing[i].beneficiary != missing[j].beneficiary {
+				return missing[i].beneficiary < missing[j].beneficiary
+			}
+			return missing[i].asset < missing[j].asset
+		})
+		for _, key := range missing {
+			drifts = append(drifts, BalanceDrift{
+				AccountID:   key.accountID,
+				Beneficiary: key.beneficiary,
+				Asset:       key.asset,
+				Computed:    computed[key],
+			})
+		}
+
+		return nil
+	})
+
+	return drifts, err
+}
+
+// backfillEntryBalances sets the running balance of entries recorded before the balance column existed
+func backfillEntryBalances(db *gorm.DB) error {
+	balances := make(map[accountKey]Amount)
+	var entries []Entry
+	return db.FindInBatches(&entries, 1000, func(_ *gorm.DB, _ int) error {
+		for _, entry := range entries {
+			key := accountKey{accountID: entry.AccountID, beneficiary: entry.Beneficiary, asset: entry.Asset}
+			balances[key] = balances[key].Add(entry.Credit).Sub(entry.Debit)
+			if err := db.Model(&Entry{}).Where("id = ?", entry.ID).Update("balance", balances[key]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// rebuildAccountBalances overwrites every materialized balance with the sum of the account's entries
+func rebuildAccountBalances(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		computed, err := computeAccountBalances(tx)
+		if err != nil {
 			return err
 		}
 
-		// Credit the destination account
-		if err := toAccountTx.Record(amount); err != nil {
+		if err := tx.Model(&LedgerAccount{}).Where("1 = 1").Update("balance", Amount{}).Error; err != nil {
 			return err
 		}
 
+		for key, balance := range computed {
+			row := LedgerAccount{
+				AccountID:   key.accountID,
+				Beneficiary: key.beneficiary,
+				Asset:       key.asset,
+				Balance:     balance,
+				UpdatedAt:   time.Now(),
+			}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "account_id"}, {Name: "beneficiary"}, {Name: "asset"}},
+				DoUpdates: clause.AssignmentColumns([]string{"balance", "updated_at"}),
+			}).Create(&row).Error
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 }
+
+// backfillEntryAssets sets the asset of entries recorded before the asset column existed,
+// using the token of the channel or virtual app that owns the account.
+// Entries that are already hash-chained are never modified.
+func backfillEntryAssets(db *gorm.DB) error {
+	if err := db.Exec(`UPDATE ledger SET asset = (SELECT token FROM channels WHERE channels.channel_id = ledger.account_id)
+		WHERE asset = '' AND hash = '' AND EXISTS (SELECT 1 FROM channels WHERE channels.channel_id = ledger.account_id)`).Error; err != nil {
+		return err
+	}
+	return db.Exec(`UPDATE ledger SET asset = (SELECT token FROM v_app WHERE v_app.app_id = ledger.account_id)
+		WHERE asset = '' AND hash = '' AND EXISTS (SELECT 1 FROM v_app WHERE v_app.app_id = ledger.account_id)`).Error
+}
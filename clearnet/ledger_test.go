@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLedgerBalancesPerAsset tests that balances in different assets are tracked separately
+func TestLedgerBalancesPerAsset(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xAccount", "0xAlice", "0xUSDC"), NewAmount(100), "test"))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xAccount", "0xAlice", "0xWETH"), NewAmount(7), "test"))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount("0xAccount", "0xBob", "0xUSDC"), NewAmount(20), "test"))
+
+	usdcBalance, err := ledger.SelectBeneficiaryAccount("0xAccount", "0xAlice", "0xUSDC").Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "100", usdcBalance.String())
+
+	balances, err := GetAccountBalances(db, "0xAccount", "")
+	require.NoError(t, err)
+	require.Len(t, balances, 3)
+
+	got := map[string]string{}
+	for _, b := range balances {
+		got[b.Address+"/"+b.Asset] = b.Amount.String()
+	}
+	assert.Equal(t, map[string]string{
+		"0xAlice/0xUSDC": "100",
+		"0xAlice/0xWETH": "7",
+		"0xBob/0xUSDC":   "20",
+	}, got)
+
+	wethOnly, err := GetAccountBalances(db, "0xAccount", "0xWETH")
+	require.NoError(t, err)
+	require.Len(t, wethOnly, 1)
+	assert.Equal(t, "0xAlice", wethOnly[0].Address)
+}
+
+// TestLedgerTransferAssetMismatch tests that transfers between accounts in different assets are rejected
+func TestLedgerTransferAssetMismatch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	from := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(from, NewAmount(100), "test"))
+
+	to := ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xWETH")
+	assert.ErrorIs(t, from.Transfer(TransactionKindAppFund, "test", to, NewAmount(10)), ErrAssetMismatch)
+
+	balance, err := from.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "100", balance.String())
+}
+
+// TestCheckAccountBalances tests that balances drifting from the ledger entries are reported and can be rebuilt
+func TestCheckAccountBalances(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	alice := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, alice.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(40)))
+
+	drifts, err := CheckAccountBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	// Tamper with a stored balance and record an entry bypassing the journal
+	require.NoError(t, db.Model(&LedgerAccount{}).Where("account_id = ? AND beneficiary = ?", "0xChannel", "0xAlice").
+		Update("balance", NewAmount(500)).Error)
+	require.NoError(t, db.Create(&Entry{AccountID: "0xOther", Beneficiary: "0xBob", Asset: "0xUSDC", Credit: NewAmount(5)}).Error)
+
+	drifts, err = CheckAccountBalances(db)
+	require.NoError(t, err)
+	require.Len(t, drifts, 2)
+	assert.Equal(t, "0xChannel", drifts[0].AccountID)
+	assert.Equal(t, "500", drifts[0].Stored.String())
+	assert.Equal(t, "60", drifts[0].Computed.String())
+	assert.Equal(t, "0xOther", drifts[1].AccountID)
+	assert.Equal(t, "0", drifts[1].Stored.String())
+	assert.Equal(t, "5", drifts[1].Computed.String())
+
+	require.NoError(t, rebuildAccountBalances(db))
+	drifts, err = CheckAccountBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	balance, err := alice.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "60", balance.String())
+}
+
+// TestLedgerBalancesAsOf tests that balances can be computed at a past point in the ledger history
+func TestLedgerBalancesAsOf(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	alice := ledger.SelectBeneficiaryAccount("0xChannel", "0xAlice", "0xUSDC")
+	bob := ledger.SelectBeneficiaryAccount("0xChannel", "0xBob", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, alice.Transfer(TransactionKindAppTransfer, "test", bob, NewAmount(30)))
+
+	var checkpoint Entry
+	require.NoError(t, db.Where("account_id = ?", "0xChannel").Order("id DESC").First(&checkpoint).Error)
+
+	require.NoError(t, alice.Transfer(TransactionKindAppTransfer, "test", bob, NewAmount(20)))
+
+	balance, err := alice.BalanceAsOf(AsOf{EntryID: checkpoint.ID})
+	require.NoError(t, err)
+	assert.Equal(t, "70", balance.String())
+
+	balances, err := GetAccountBalancesAsOf(db, "0xChannel", "", AsOf{EntryID: checkpoint.ID})
+	require.NoError(t, err)
+	require.Len(t, balances, 2)
+	assert.Equal(t, "0xAlice", balances[0].Address)
+	assert.Equal(t, "70", balances[0].Amount.String())
+	assert.Equal(t, "0xBob", balances[1].Address)
+	assert.Equal(t, "30", balances[1].Amount.String())
+
+	// Move the last transfer an hour into the future to query by time
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, db.Model(&Entry{}).Where("id > ?", checkpoint.ID).Update("created_at", later).Error)
+
+	balances, err = GetAccountBalancesAsOf(db, "0xChannel", "0xUSDC", AsOf{Time: time.Now()})
+	require.NoError(t, err)
+	require.Len(t, balances, 2)
+	assert.Equal(t, "70", balances[0].Amount.String())
+
+	balance, err = bob.BalanceAsOf(AsOf{Time: later})
+	require.NoError(t, err)
+	assert.Equal(t, "50", balance.String())
+
+	// Nothing was recorded before the first deposit
+	balances, err = GetAccountBalancesAsOf(db, "0xChannel", "", AsOf{Time: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, balances)
+}
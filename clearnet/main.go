@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -25,6 +26,13 @@ func main() {
 		log.Fatalf("Failed to setup database: %v", err)
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	ledger := NewLedger(db)
 	signer, err := NewSigner(config.privateKeyHex)
 	if err != nil {
@@ -38,18 +46,33 @@ func main() {
 	custodyClients := make(map[string]*Custody)
 
 	for name, network := range config.networks {
-		client, err := NewCustody(signer, ledger, network.InfuraURL, network.CustodyAddress, network.ChainID)
+		client, err := NewCustody(signer, ledger, metrics, network)
 		if err != nil {
 			log.Printf("Warning: Failed to initialize %s blockchain client: %v", name, err)
 			continue
 		}
 		custodyClients[name] = client
-		go client.ListenEvents(context.Background())
+		go client.endpoints.CheckHealthPeriodically(context.Background(), rpcHealthCheckInterval)
+		go client.ListenEvents(context.Background(), network.Listener)
+		go client.txs.ProcessPeriodically(context.Background(), txProcessInterval)
+		go client.challenges.RetryPeriodically(context.Background(), time.Minute)
 	}
 
+	if config.anchorNetwork != "" {
+		if client, ok := custodyClients[config.anchorNetwork]; ok {
+			anchor := NewStateAnchor(ledger, client, common.HexToAddress(config.anchorContract))
+			go anchor.AnchorPeriodically(context.Background(), config.anchorInterval)
+		} else {
+			log.Printf("Warning: state root anchoring disabled, network %s is not configured", config.anchorNetwork)
+		}
+	}
+
+	solvency := NewSolvencyReporter(ledger, custodyClients)
+	go solvency.ReportPeriodically(context.Background(), config.solvencyInterval)
+
 	go metrics.RecordMetricsPeriodically(db, custodyClients)
 
-	unifiedWSHandler := NewUnifiedWSHandler(signer, ledger, metrics, rpcStore)
+	unifiedWSHandler := NewUnifiedWSHandler(signer, ledger, config.fees, metrics, rpcStore)
 	http.HandleFunc("/ws", unifiedWSHandler.HandleConnection)
 
 	// Set up a separate mux for metrics
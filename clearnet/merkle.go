@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// MerkleTree is a binary Merkle tree over keccak256 hashes.
+// Pairs are sorted before hashing, as in OpenZeppelin's MerkleProof, so proofs are plain lists of
+// sibling hashes that can be verified on-chain. A node without a sibling is promoted unchanged.
+type MerkleTree struct {
+	layers [][]common.Hash
+}
+
+// NewMerkleTree builds a Merkle tree over the given leaves
+func NewMerkleTree(leaves []common.Hash) *MerkleTree {
+	tree := &MerkleTree{layers: [][]common.Hash{leaves}}
+	for layer := leaves; len(layer) > 1; {
+		next := make([]common.Hash, 0, (len(layer)+1)/2)
+		for i := 0; i < len(layer); i += 2 {
+			if i+1 == len(layer) {
+				next = append(next, layer[i])
+				continue
+			}
+			next = append(next, hashMerklePair(layer[i], layer[i+1]))
+		}
+		tree.layers = append(tree.layers, next)
+		layer = next
+	}
+	return tree
+}
+
+// Root returns the root of the tree, or the zero hash if the tree has no leaves
+func (t *MerkleTree) Root() common.Hash {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return common.Hash{}
+	}
+	return top[0]
+}
+
+// Proof returns the sibling hashes proving the inclusion of the leaf at index
+func (t *MerkleTree) Proof(index int) []common.Hash {
+	var proof []common.Hash
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		sibling := index ^ 1
+		if sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleProof checks that leaf is included in the tree with the given root
+func VerifyMerkleProof(leaf common.Hash, proof []common.Hash, root common.Hash) bool {
+	hash := leaf
+	for _, sibling := range proof {
+		hash = hashMerklePair(hash, sibling)
+	}
+	return hash == root
+}
+
+func hashMerklePair(a, b common.Hash) common.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a[:], b[:])
+}
+
+// MerkleSumNode is a node of a Merkle sum tree: a hash committing to the subtree and the sum of its leaf values
+type MerkleSumNode struct {
+	Hash common.Hash
+	Sum  *big.Int
+}
+
+// MerkleSumTree is a binary Merkle tree whose nodes also carry the sum of the values below them.
+// Each parent commits to the hashes and sums of both children, so the root sum cannot understate
+// any leaf value without breaking that leaf's proof. Children are sorted by hash as in MerkleTree,
+// and a node without a sibling is promoted unchanged.
+type MerkleSumTree struct {
+	layers [][]MerkleSumNode
+}
+
+// NewMerkleSumTree builds a Merkle sum tree over the given leaves, whose sums must not be negative
+func NewMerkleSumTree(leaves []MerkleSumNode) *MerkleSumTree {
+	tree := &MerkleSumTree{layers: [][]MerkleSumNode{leaves}}
+	for layer := leaves; len(layer) > 1; {
+		next := make([]MerkleSumNode, 0, (len(layer)+1)/2)
+		for i := 0; i < len(layer); i += 2 {
+			if i+1 == len(layer) {
+				next = append(next, layer[i])
+				continue
+			}
+			next = append(next, hashMerkleSumPair(layer[i], layer[i+1]))
+		}
+		tree.layers = append(tree.layers, next)
+		layer = next
+	}
+	return tree
+}
+
+// Root returns the root of the tree, or a zero hash and sum if the tree has no leaves
+func (t *MerkleSumTree) Root() MerkleSumNode {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return MerkleSumNode{Sum: new(big.Int)}
+	}
+	return top[0]
+}
+
+// Proof returns the sibling nodes proving the inclusion of the leaf at index
+func (t *MerkleSumTree) Proof(index int) []MerkleSumNode {
+	var proof []MerkleSumNode
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		sibling := index ^ 1
+		if sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleSumProof checks that leaf is included in the tree with the given root.
+// Negative sibling sums are rejected, since they could hide part of the leaf value from the root sum.
+func VerifyMerkleSumProof(leaf MerkleSumNode, proof []MerkleSumNode, root MerkleSumNode) bool {
+	if leaf.Sum == nil || leaf.Sum.Sign() < 0 || root.Sum == nil {
+		return false
+	}
+	node := leaf
+	for _, sibling := range proof {
+		if sibling.Sum == nil || sibling.Sum.Sign() < 0 {
+			return false
+		}
+		node = hashMerkleSumPair(node, sibling)
+	}
+	return node.Hash == root.Hash && node.Sum.Cmp(root.Sum) == 0
+}
+
+// hashMerkleSumPair computes the parent of two nodes as keccak256(hash, uint256 sum, hash, uint256 sum) over the sorted children
+func hashMerkleSumPair(a, b MerkleSumNode) MerkleSumNode {
+	if bytes.Compare(a.Hash[:], b.Hash[:]) > 0 {
+		a, b = b, a
+	}
+	return MerkleSumNode{
+		Hash: crypto.Keccak256Hash(a.Hash[:], math.U256Bytes(new(big.Int).Set(a.Sum)), b.Hash[:], math.U256Bytes(new(big.Int).Set(b.Sum))),
+		Sum:  new(big.Int).Add(a.Sum, b.Sum),
+	}
+}
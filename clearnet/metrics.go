@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"log"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -34,9 +35,23 @@ type Metrics struct {
 	// Application metrics
 	AppSessionsTotal prometheus.Gauge
 
+	// Fee metrics
+	FeeRevenue *prometheus.GaugeVec
+
+	// Reconciliation metrics
+	ReconciliationMismatches *prometheus.GaugeVec
+
 	// Smart contract metrics
+	CustodyEvents          *prometheus.CounterVec
 	BrokerBalanceAvailable *prometheus.GaugeVec
 	BrokerChannelCount     *prometheus.GaugeVec
+
+	// Node endpoint metrics
+	RPCEndpointUp      *prometheus.GaugeVec
+	RPCEndpointHead    *prometheus.GaugeVec
+	RPCEndpointLatency *prometheus.GaugeVec
+	RPCEndpointErrors  *prometheus.CounterVec
+	RPCFailovers       *prometheus.CounterVec
 }
 
 // NewMetrics initializes and registers Prometheus metrics
@@ -93,6 +108,62 @@ func NewMetrics() *Metrics {
 			Name: "clearnet_app_sessions_total",
 			Help: "The total number of application sessions",
 		}),
+		FeeRevenue: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_broker_fee_revenue",
+				Help: "Fees collected in the broker fee account by token",
+			},
+			[]string{"token"},
+		),
+		ReconciliationMismatches: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_reconciliation_mismatches",
+				Help: "Discrepancies found by the last reconciliation of ledger, channels and custody contracts",
+			},
+			[]string{"network", "kind"},
+		),
+		CustodyEvents: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "clearnet_custody_events_total",
+				Help: "Custody contract events handled, by event type and result",
+			},
+			[]string{"network", "event", "result"},
+		),
+		RPCEndpointUp: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_rpc_endpoint_up",
+				Help: "Whether a node endpoint is healthy (1) or skipped (0)",
+			},
+			[]string{"network", "endpoint"},
+		),
+		RPCEndpointHead: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_rpc_endpoint_head_block",
+				Help: "Latest block reported by a node endpoint",
+			},
+			[]string{"network", "endpoint"},
+		),
+		RPCEndpointLatency: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_rpc_endpoint_latency_seconds",
+				Help: "Response time of the last health check of a node endpoint",
+			},
+			[]string{"network", "endpoint"},
+		),
+		RPCEndpointErrors: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "clearnet_rpc_endpoint_errors_total",
+				Help: "Failed requests and health checks of a node endpoint",
+			},
+			[]string{"network", "endpoint"},
+		),
+		RPCFailovers: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "clearnet_rpc_failovers_total",
+				Help: "Switches of a network to another node endpoint",
+			},
+			[]string{"network"},
+		),
 		BrokerBalanceAvailable: promauto.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "clearnet_broker_balance_available",
@@ -118,11 +189,16 @@ func (m *Metrics) RecordMetricsPeriodically(db *gorm.DB, custodyClients map[stri
 
 	balanceTicker := time.NewTicker(30 * time.Second)
 	defer balanceTicker.Stop()
+
+	reconciler := NewReconciler(db, custodyClients)
+	reconcileTicker := time.NewTicker(5 * time.Minute)
+	defer reconcileTicker.Stop()
 	for {
 		select {
 		case <-dbTicker.C:
 			m.UpdateChannelMetrics(db)
 			m.UpdateAppSessionMetrics(db)
+			m.UpdateFeeMetrics(db)
 		case <-balanceTicker.C:
 			// Refresh the list of tokens to monitor
 			monitoredTokens := GetUniqueTokenAddresses(db)
@@ -131,6 +207,14 @@ func (m *Metrics) RecordMetricsPeriodically(db *gorm.DB, custodyClients map[stri
 			for _, client := range custodyClients {
 				client.UpdateBalanceMetrics(context.Background(), monitoredTokens, m)
 			}
+		case <-reconcileTicker.C:
+			run, discrepancies, err := reconciler.Reconcile(context.Background())
+			if err != nil {
+				log.Printf("Error reconciling channels: %v", err)
+				continue
+			}
+			logDiscrepancies(run, discrepancies)
+			m.UpdateReconciliationMetrics(reconciler, discrepancies)
 		}
 	}
 }
@@ -155,6 +239,45 @@ func (m *Metrics) UpdateAppSessionMetrics(db *gorm.DB) {
 	m.AppSessionsTotal.Set(float64(count))
 }
 
+// UpdateFeeMetrics updates the fee revenue metrics from the broker fee account
+func (m *Metrics) UpdateFeeMetrics(db *gorm.DB) {
+	balances, err := GetAccountBalances(db, BrokerFeeAccountID, "")
+	if err != nil {
+		return
+	}
+	// Sum over beneficiaries in case the broker address has changed
+	revenue := make(map[string]Amount)
+	for _, balance := range balances {
+		revenue[balance.Asset] = revenue[balance.Asset].Add(balance.Amount)
+	}
+	for token, amount := range revenue {
+		m.FeeRevenue.WithLabelValues(token).Set(bigToFloat64(amount.Big()))
+	}
+}
+
+// UpdateReconciliationMetrics sets the mismatch gauges from the discrepancies of the last reconciliation
+func (m *Metrics) UpdateReconciliationMetrics(reconciler *Reconciler, discrepancies []Discrepancy) {
+	type mismatchKey struct {
+		network string
+		kind    DiscrepancyKind
+	}
+	counts := make(map[mismatchKey]int)
+	// Networks without discrepancies report zero
+	for network := range reconciler.networks {
+		for _, kind := range discrepancyKinds {
+			counts[mismatchKey{network, kind}] = 0
+		}
+	}
+	for _, d := range discrepancies {
+		counts[mismatchKey{d.NetworkID, d.Kind}]++
+	}
+
+	m.ReconciliationMismatches.Reset()
+	for key, count := range counts {
+		m.ReconciliationMismatches.WithLabelValues(key.network, string(key.kind)).Set(float64(count))
+	}
+}
+
 // GetUniqueTokenAddresses returns a list of unique token addresses from the database
 func GetUniqueTokenAddresses(db *gorm.DB) []common.Address {
 	var tokens []string
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gorm.io/gorm"
+)
+
+// DiscrepancyKind identifies which check a channel failed during reconciliation
+type DiscrepancyKind string
+
+var (
+	// The funds the ledger recorded as moved into the channel on-chain differ from Channel.Amount
+	DiscrepancyCustodyAmount DiscrepancyKind = "custody_amount"
+	// The balances of the channel accounts exceed Channel.Amount, so they are not covered by locked funds
+	DiscrepancyChannelAccounts DiscrepancyKind = "channel_accounts"
+	// The channel is open in the database but not listed by the custody contract
+	DiscrepancyMissingOnChain DiscrepancyKind = "missing_on_chain"
+	// The custody contract lists a broker channel that is unknown or closed in the database
+	DiscrepancyUnexpectedOnChain DiscrepancyKind = "unexpected_on_chain"
+	// A channel account has a negative balance, e.g. after a withdrawal of funds it had spent
+	DiscrepancyNegativeBalance DiscrepancyKind = "negative_balance"
+	// The custody contract holds less of a token than the broker channels lock and the broker has available
+	DiscrepancyOnChainAmount DiscrepancyKind = "onchain_amount"
+	// The custody contract could not be read, so the on-chain checks of the network or token were not made
+	DiscrepancyOnChainUnreadable DiscrepancyKind = "onchain_unreadable"
+)
+
+// discrepancyKinds lists all discrepancy kinds, so that metrics can be reset to zero
+var discrepancyKinds = []DiscrepancyKind{
+	DiscrepancyCustodyAmount,
+	DiscrepancyChannelAccounts,
+	DiscrepancyMissingOnChain,
+	DiscrepancyUnexpectedOnChain,
+	DiscrepancyNegativeBalance,
+	DiscrepancyOnChainAmount,
+	DiscrepancyOnChainUnreadable,
+}
+
+// ReconciliationRun records a comparison of ledger balances, channel records and on-chain channel state
+type ReconciliationRun struct {
+	ID            uint `gorm:"primaryKey"`
+	Channels      int  `gorm:"column:channels;not null"`
+	Discrepancies int  `gorm:"column:discrepancies;not null"`
+	CreatedAt     time.Time
+}
+
+// TableName specifies the table name for the ReconciliationRun model
+func (ReconciliationRun) TableName() string {
+	return "reconciliation_runs"
+}
+
+// Discrepancy is a mismatch found by a reconciliation run
+type Discrepancy struct {
+	ID        uint            `gorm:"primaryKey"`
+	RunID     uint            `gorm:"column:run_id;not null;index"`
+	NetworkID string          `gorm:"column:network_id;not null"`
+	ChannelID string          `gorm:"column:channel_id;not null;index"` // Empty for checks over all channels in a token
+	Token     string          `gorm:"column:token;not null;default:''"`
+	Kind      DiscrepancyKind `gorm:"column:kind;not null"`
+	Expected  Amount          `gorm:"column:expected;not null;default:0"` // Channel.Amount, or their total for on-chain amount checks
+	Actual    Amount          `gorm:"column:actual;not null;default:0"`   // Amount found in the ledger or on-chain
+	Detail    string          `gorm:"column:detail;not null"`
+}
+
+// TableName specifies the table name for the Discrepancy model
+func (Discrepancy) TableName() string {
+	return "reconciliation_discrepancies"
+}
+
+// custodyReader reads the channels of the broker, its available funds and the funds held by a custody contract
+type custodyReader interface {
+	BrokerChannels(ctx context.Context) ([]common.Hash, error)
+	BrokerAvailable(ctx context.Context, token common.Address) (*big.Int, error)
+	CustodyBalance(ctx context.Context, token common.Address) (*big.Int, error)
+}
+
+// Reconciler compares ledger balances, channel records and on-chain channel state per network
+type Reconciler struct {
+	db       *gorm.DB
+	networks map[string]custodyReader // Custody clients by network ID
+}
+
+// NewReconciler creates a reconciler reading on-chain state through the given custody clients
+func NewReconciler(db *gorm.DB, custodyClients map[string]*Custody) *Reconciler {
+	networks := make(map[string]custodyReader, len(custodyClients))
+	for _, client := range custodyClients {
+		networks[client.networkID] = client
+	}
+	return &Reconciler{db: db, networks: networks}
+}
+
+// Reconcile checks every channel and stores the discrepancies found.
+// For each channel, the funds recorded in the custody account of the ledger must equal Channel.Amount, and the
+// channel account balances must not exceed it; funds moved into app sessions stay locked in the channel.
+// Channels that are not closed must be listed by the custody contract of their network, and the contract must not
+// list other channels of the broker. The contract has no view of the funds locked in a single channel, so per token
+// it must hold at least the Channel.Amount of those channels plus the available funds of the broker.
+// Failed contract reads are recorded as discrepancies, and the checks they prevent are skipped.
+func (r *Reconciler) Reconcile(ctx context.Context) (*ReconciliationRun, []Discrepancy, error) {
+	var channels []Channel
+	if err := r.db.Order("id").Find(&channels).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// Funds moved on-chain are mirrored by the custody account, whose beneficiaries are channel IDs
+	var custodyRows []LedgerAccount
+	if err := r.db.Where("account_id = ?", CustodyAccountID).Find(&custodyRows).Error; err != nil {
+		return nil, nil, err
+	}
+	funded := make(map[string]Amount)
+	for _, row := range custodyRows {
+		key := row.Beneficiary + "/" + normalizeAddress(row.Asset)
+		funded[key] = funded[key].Sub(row.Balance)
+	}
+
+	var channelRows []LedgerAccount
+	channelIDs := r.db.Model(&Channel{}).Select("channel_id")
+	if err := r.db.Where("account_id IN (?)", channelIDs).Find(&channelRows).Error; err != nil {
+		return nil, nil, err
+	}
+	claimed := make(map[string]Amount)
+	var discrepancies []Discrepancy
+	for _, row := range channelRows {
+		key := row.AccountID + "/" + normalizeAddress(row.Asset)
+		claimed[key] = claimed[key].Add(row.Balance)
+		if row.Balance.Sign() < 0 {
+			discrepancies = append(discrepancies, Discrepancy{
+				NetworkID: networkOfChannel(channels, row.AccountID),
+				ChannelID: row.AccountID,
+				Token:     row.Asset,
+				Kind:      DiscrepancyNegativeBalance,
+				Actual:    row.Balance,
+				Detail:    fmt.Sprintf("account of %s has a balance of %s", row.Beneficiary, row.Balance),
+			})
+		}
+	}
+
+	for _, channel := range channels {
+		key := channel.ChannelID + "/" + normalizeAddress(channel.Token)
+
+		if custody := funded[key]; custody.Cmp(channel.Amount) != 0 {
+			discrepancies = append(discrepancies, Discrepancy{
+				NetworkID: channel.NetworkID,
+				ChannelID: channel.ChannelID,
+				Token:     channel.Token,
+				Kind:      DiscrepancyCustodyAmount,
+				Expected:  channel.Amount,
+				Actual:    custody,
+				Detail:    fmt.Sprintf("ledger recorded %s moved into the channel on-chain, channel amount is %s", custody, channel.Amount),
+			})
+		}
+
+		if accounts := claimed[key]; accounts.Cmp(channel.Amount) > 0 {
+			discrepancies = append(discrepancies, Discrepancy{
+				NetworkID: channel.NetworkID,
+				ChannelID: channel.ChannelID,
+				Token:     channel.Token,
+				Kind:      DiscrepancyChannelAccounts,
+				Expected:  channel.Amount,
+				Actual:    accounts,
+				Detail:    fmt.Sprintf("channel accounts hold %s, more than the channel amount %s", accounts, channel.Amount),
+			})
+		}
+	}
+
+	networkIDs := make([]string, 0, len(r.networks))
+	for networkID := range r.networks {
+		networkIDs = append(networkIDs, networkID)
+	}
+	sort.Strings(networkIDs)
+
+	for _, networkID := range networkIDs {
+		onChain, err := r.networks[networkID].BrokerChannels(ctx)
+		if err != nil {
+			discrepancies = append(discrepancies, Discrepancy{
+				NetworkID: networkID,
+				Kind:      DiscrepancyOnChainUnreadable,
+				Detail:    fmt.Sprintf("failed to read the broker channels: %v", err),
+			})
+		} else {
+			discrepancies = append(discrepancies, compareOnChainChannels(networkID, channels, onChain)...)
+		}
+
+		amounts, err := compareOnChainAmounts(ctx, r.networks[networkID], networkID, channels)
+		if err != nil {
+			return nil, nil, err
+		}
+		discrepancies = append(discrepancies, amounts...)
+	}
+
+	run := &ReconciliationRun{Channels: len(channels), Discrepancies: len(discrepancies), CreatedAt: time.Now()}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(run).Error; err != nil {
+			return err
+		}
+		for i := range discrepancies {
+			discrepancies[i].RunID = run.ID
+		}
+		if len(discrepancies) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(discrepancies, 500).Error
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store reconciliation report: %w", err)
+	}
+
+	return run, discrepancies, nil
+}
+
+// networkOfChannel returns the network of a channel, or an empty string if it is unknown
+func networkOfChannel(channels []Channel, channelID string) string {
+	for _, channel := range channels {
+		if channel.ChannelID == channelID {
+			return channel.NetworkID
+		}
+	}
+	return ""
+}
+
+// compareOnChainChannels compares the channels of a network in the database with the broker channels listed on-chain
+func compareOnChainChannels(networkID string, channels []Channel, onChain []common.Hash) []Discrepancy {
+	listed := make(map[string]bool, len(onChain))
+	for _, id := range onChain {
+		listed[id.Hex()] = true
+	}
+
+	var discrepancies []Discrepancy
+	known := make(map[string]ChannelStatus)
+	for _, channel := range channels {
+		if channel.NetworkID != networkID {
+			continue
+		}
+		channelID := common.HexToHash(channel.ChannelID).Hex()
+		known[channelID] = channel.Status
+		if channel.Status != ChannelStatusClosed && !listed[channelID] {
+			discrepancies = append(discrepancies, Discrepancy{
+				NetworkID: networkID,
+				ChannelID: channel.ChannelID,
+				Token:     channel.Token,
+				Kind:      DiscrepancyMissingOnChain,
+				Detail:    fmt.Sprintf("channel is %s but not listed by the custody contract", channel.Status),
+			})
+		}
+	}
+
+	for _, id := range onChain {
+		status, ok := known[id.Hex()]
+		if ok && status != ChannelStatusClosed {
+			continue
+		}
+		detail := "custody contract lists a broker channel unknown to the database"
+		if ok {
+			detail = "custody contract lists a broker channel that is closed in the database"
+		}
+		discrepancies = append(discrepancies, Discrepancy{
+			NetworkID: networkID,
+			ChannelID: id.Hex(),
+			Kind:      DiscrepancyUnexpectedOnChain,
+			Detail:    detail,
+		})
+	}
+	return discrepancies
+}
+
+// compareOnChainAmounts checks that the custody contract of a network holds, in each token, at least the amounts of
+// the channels that are not closed plus the available funds of the broker. Other users deposit into the same
+// contract, so it may hold more.
+func compareOnChainAmounts(ctx context.Context, reader custodyReader, networkID string, channels []Channel) ([]Discrepancy, error) {
+	locked := make(map[common.Address]Amount)
+	var tokens []common.Address
+	for _, channel := range channels {
+		if channel.NetworkID != networkID || channel.Status == ChannelStatusClosed {
+			continue
+		}
+		token := common.HexToAddress(channel.Token)
+		if _, ok := locked[token]; !ok {
+			tokens = append(tokens, token)
+		}
+		locked[token] = locked[token].Add(channel.Amount)
+	}
+
+	var discrepancies []Discrepancy
+	for _, token := range tokens {
+		available, err := reader.BrokerAvailable(ctx, token)
+		if err != nil {
+			discrepancies = append(discrepancies, unreadableDiscrepancy(networkID, token, err))
+			continue
+		}
+		held, err := reader.CustodyBalance(ctx, token)
+		if err != nil {
+			discrepancies = append(discrepancies, unreadableDiscrepancy(networkID, token, err))
+			continue
+		}
+		discrepancy, err := compareCustodyBalance(networkID, token, locked[token], available, held)
+		if err != nil {
+			return nil, err
+		}
+		if discrepancy != nil {
+			discrepancies = append(discrepancies, *discrepancy)
+		}
+	}
+	return discrepancies, nil
+}
+
+// unreadableDiscrepancy records that the custody contract of a network could not be read for token
+func unreadableDiscrepancy(networkID string, token common.Address, err error) Discrepancy {
+	return Discrepancy{
+		NetworkID: networkID,
+		Token:     token.Hex(),
+		Kind:      DiscrepancyOnChainUnreadable,
+		Detail:    fmt.Sprintf("failed to read the custody contract: %v", err),
+	}
+}
+
+// compareCustodyBalance returns a discrepancy if the custody contract holds less of token than locked plus available
+func compareCustodyBalance(networkID string, token common.Address, locked Amount, available, held *big.Int) (*Discrepancy, error) {
+	availableAmount, err := NewAmountFromBig(available)
+	if err != nil {
+		return nil, err
+	}
+	heldAmount, err := NewAmountFromBig(held)
+	if err != nil {
+		return nil, err
+	}
+	expected := locked.Add(availableAmount)
+	if heldAmount.Cmp(expected) >= 0 {
+		return nil, nil
+	}
+	return &Discrepancy{
+		NetworkID: networkID,
+		Token:     token.Hex(),
+		Kind:      DiscrepancyOnChainAmount,
+		Expected:  expected,
+		Actual:    heldAmount,
+		Detail:    fmt.Sprintf("custody contract holds %s of %s, less than the %s locked in broker channels and the %s available to the broker", heldAmount, token.Hex(), locked, availableAmount),
+	}, nil
+}
+
+// logDiscrepancies writes the discrepancy report of a reconciliation run to the log
+func logDiscrepancies(run *ReconciliationRun, discrepancies []Discrepancy) {
+	if len(discrepancies) == 0 {
+		log.Printf("Reconciliation %d: %d channels match the ledger and custody contracts", run.ID, run.Channels)
+		return
+	}
+	log.Printf("Warning: reconciliation %d found %d discrepancies over %d channels", run.ID, len(discrepancies), run.Channels)
+	for _, d := range discrepancies {
+		if d.ChannelID == "" {
+			log.Printf("Reconciliation %d: %s on network %s: %s", run.ID, d.Kind, d.NetworkID, d.Detail)
+			continue
+		}
+		log.Printf("Reconciliation %d: %s in channel %s on network %s: %s", run.ID, d.Kind, d.ChannelID, d.NetworkID, d.Detail)
+	}
+}
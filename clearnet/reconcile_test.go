@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCustodyReader returns fixed on-chain channels and balances instead of calling a custody contract
+type fakeCustodyReader struct {
+	channels  []common.Hash
+	available map[common.Address]int64 // Funds the broker has available, by token
+	held      map[common.Address]int64 // Funds the custody contract holds, by token
+	err       error
+}
+
+func (r *fakeCustodyReader) BrokerChannels(ctx context.Context) ([]common.Hash, error) {
+	return r.channels, r.err
+}
+
+func (r *fakeCustodyReader) BrokerAvailable(ctx context.Context, token common.Address) (*big.Int, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return big.NewInt(r.available[token]), nil
+}
+
+func (r *fakeCustodyReader) CustodyBalance(ctx context.Context, token common.Address) (*big.Int, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return big.NewInt(r.held[token]), nil
+}
+
+// TestReconcile tests that mismatches between ledger, channel records and custody contracts are reported
+func TestReconcile(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	channelA := crypto.Keccak256Hash([]byte("a"))
+	channelB := crypto.Keccak256Hash([]byte("b"))
+	channelC := crypto.Keccak256Hash([]byte("c"))
+	unknown := crypto.Keccak256Hash([]byte("unknown"))
+
+	// Channel A is consistent, including funds moved into an app session
+	require.NoError(t, CreateChannel(db, channelA.Hex(), "0xAlice", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(100)))
+	alice := ledger.SelectBeneficiaryAccount(channelA.Hex(), "0xAlice", "0xUSDC")
+	require.NoError(t, ledger.Deposit(alice, NewAmount(100), "test"))
+	require.NoError(t, alice.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xAlice", "0xUSDC"), NewAmount(30)))
+
+	// The ledger missed part of the funds locked in channel B, which the contract does not list either
+	require.NoError(t, CreateChannel(db, channelB.Hex(), "0xBob", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(50)))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelB.Hex(), "0xBob", "0xUSDC"), NewAmount(40), "test"))
+
+	// Channel C is closed but still listed on-chain
+	require.NoError(t, CreateChannel(db, channelC.Hex(), "0xCarol", 1, "0xAdjudicator", "137", "0xUSDC", Amount{}))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelC.Hex()).Update("status", ChannelStatusClosed).Error)
+
+	// Channel D was closed with a state withdrawing funds that had been spent since it was signed
+	channelD := crypto.Keccak256Hash([]byte("d"))
+	require.NoError(t, CreateChannel(db, channelD.Hex(), "0xDave", 1, "0xAdjudicator", "137", "0xUSDC", Amount{}))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelD.Hex()).Update("status", ChannelStatusClosed).Error)
+	dave := ledger.SelectBeneficiaryAccount(channelD.Hex(), "0xDave", "0xUSDC")
+	require.NoError(t, ledger.Deposit(dave, NewAmount(10), "test"))
+	require.NoError(t, dave.Transfer(TransactionKindAppFund, "test", ledger.SelectBeneficiaryAccount("0xApp", "0xDave", "0xUSDC"), NewAmount(10)))
+	require.NoError(t, ledger.Withdraw(dave, NewAmount(10), "test"))
+
+	// Channel E matches the ledger, but the custody contract holds less than the open channels lock
+	channelE := crypto.Keccak256Hash([]byte("e"))
+	require.NoError(t, CreateChannel(db, channelE.Hex(), "0xEve", 1, "0xAdjudicator", "137", "0xUSDC", NewAmount(80)))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelE.Hex(), "0xEve", "0xUSDC"), NewAmount(80), "test"))
+
+	// Channel F is on a network whose contract cannot be read
+	channelF := crypto.Keccak256Hash([]byte("f"))
+	require.NoError(t, CreateChannel(db, channelF.Hex(), "0xFrank", 1, "0xAdjudicator", "1", "0xUSDC", Amount{}))
+
+	usdc := common.HexToAddress("0xUSDC")
+	reconciler := &Reconciler{db: db, networks: map[string]custodyReader{
+		"137": &fakeCustodyReader{
+			channels:  []common.Hash{channelA, channelC, channelE, unknown},
+			available: map[common.Address]int64{usdc: 20},
+			held:      map[common.Address]int64{usdc: 240},
+		},
+		"1": &fakeCustodyReader{err: errors.New("rpc unavailable")},
+	}}
+
+	run, discrepancies, err := reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 6, run.Channels)
+	assert.Equal(t, 8, run.Discrepancies)
+
+	found := make(map[DiscrepancyKind][]string)
+	for _, d := range discrepancies {
+		found[d.Kind] = append(found[d.Kind], d.ChannelID)
+	}
+	assert.Equal(t, []string{channelB.Hex()}, found[DiscrepancyCustodyAmount])
+	assert.Equal(t, []string{channelB.Hex()}, found[DiscrepancyMissingOnChain])
+	assert.ElementsMatch(t, []string{channelC.Hex(), unknown.Hex()}, found[DiscrepancyUnexpectedOnChain])
+	assert.Empty(t, found[DiscrepancyChannelAccounts])
+	assert.Equal(t, []string{channelD.Hex()}, found[DiscrepancyNegativeBalance])
+	assert.Equal(t, []string{""}, found[DiscrepancyOnChainAmount])
+	// Both the channel list and the token balances of the unreadable network are reported
+	assert.Equal(t, []string{"", ""}, found[DiscrepancyOnChainUnreadable])
+
+	var custodyAmount Discrepancy
+	require.NoError(t, db.Where("run_id = ? AND kind = ?", run.ID, DiscrepancyCustodyAmount).First(&custodyAmount).Error)
+	assert.Equal(t, "50", custodyAmount.Expected.String())
+	assert.Equal(t, "40", custodyAmount.Actual.String())
+
+	// Channels A, B and E lock 230 and the broker has 20 available, but the contract holds 240
+	var onChainAmount Discrepancy
+	require.NoError(t, db.Where("run_id = ? AND kind = ?", run.ID, DiscrepancyOnChainAmount).First(&onChainAmount).Error)
+	assert.Equal(t, "137", onChainAmount.NetworkID)
+	assert.Equal(t, usdc.Hex(), onChainAmount.Token)
+	assert.Equal(t, "250", onChainAmount.Expected.String())
+	assert.Equal(t, "240", onChainAmount.Actual.String())
+
+	var unreadable []Discrepancy
+	require.NoError(t, db.Where("run_id = ? AND kind = ?", run.ID, DiscrepancyOnChainUnreadable).Find(&unreadable).Error)
+	for _, d := range unreadable {
+		assert.Equal(t, "1", d.NetworkID)
+		assert.Contains(t, d.Detail, "rpc unavailable")
+	}
+}
+
+// balanceOfCode is the runtime code of a token answering every call with the ABI encoding of the uint256 42
+var balanceOfCode = common.FromHex("0x602a60005260206000f3")
+
+// TestCustodyBalance tests that the token and native balances of the custody contract are read on-chain
+func TestCustodyBalance(t *testing.T) {
+	token := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	custodyAddr := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	sim := simulated.NewBackend(types.GenesisAlloc{
+		token:       {Code: balanceOfCode, Balance: big.NewInt(0)},
+		custodyAddr: {Balance: big.NewInt(7)},
+	})
+	defer sim.Close()
+	ctx := context.Background()
+
+	c := &Custody{client: sim.Client(), custodyAddr: custodyAddr}
+	balance, err := c.CustodyBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(42), balance)
+
+	// The zero address reads the native balance
+	balance, err = c.CustodyBalance(ctx, common.Address{})
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(7), balance)
+}
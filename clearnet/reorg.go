@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"gorm.io/gorm"
+)
+
+// snapshotChannel returns the channel as JSON, or an empty string if it does not exist
+func snapshotChannel(tx *gorm.DB, channelID string) (string, error) {
+	channel, err := GetChannelByID(tx, channelID)
+	if err != nil || channel == nil {
+		return "", err
+	}
+	snapshot, err := json.Marshal(channel)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode channel snapshot: %w", err)
+	}
+	return string(snapshot), nil
+}
+
+// restoreChannel puts the channel of an event back in the state it had before the event was applied
+func restoreChannel(tx *gorm.DB, event *ProcessedEvent) error {
+	if event.ChannelID == "" {
+		return nil
+	}
+	if event.ChannelSnapshot == "" {
+		// The event created the channel
+		return removeChannel(tx, event.ChannelID)
+	}
+
+	var channel Channel
+	if err := json.Unmarshal([]byte(event.ChannelSnapshot), &channel); err != nil {
+		return fmt.Errorf("invalid channel snapshot: %w", err)
+	}
+	current, err := GetChannelByID(tx, event.ChannelID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Save(&channel).Error; err != nil {
+		return fmt.Errorf("failed to restore channel: %w", err)
+	}
+	// The restored status does not have to be reachable from the current one
+	if current != nil && current.Status != channel.Status {
+		if err := recordChannelTransition(tx, channel.ChannelID, current.Status, channel.Status, "reorg", event.TxHash, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// Holds settled by the event are resolved again when its state is resubmitted
+	ledger := &Ledger{db: tx}
+	return reactivateHolds(tx, ledger.SelectBeneficiaryAccount(channel.ChannelID, channel.ParticipantA, channel.Token), channel.Version)
+}
+
+// removeChannel deletes a channel whose creation was removed by a reorg, together with its history and signed states.
+// Its active holds are released and its join is cancelled if it was not sent yet.
+func removeChannel(tx *gorm.DB, channelID string) error {
+	var holds []Hold
+	if err := tx.Where("account_id = ? AND status = ?", channelID, HoldStatusActive).Find(&holds).Error; err != nil {
+		return err
+	}
+	ledger := &Ledger{db: tx}
+	released := make(map[accountKey]bool)
+	for _, hold := range holds {
+		account := ledger.SelectBeneficiaryAccount(hold.AccountID, hold.Beneficiary, hold.Asset)
+		if released[account.key()] {
+			continue
+		}
+		released[account.key()] = true
+		if err := resolveHolds(tx, account, math.MaxInt64, HoldStatusReleased); err != nil {
+			return fmt.Errorf("failed to release holds of channel %s: %w", channelID, err)
+		}
+	}
+
+	err := tx.Model(&OutboundTx{}).Where("kind = ? AND reference = ? AND status = ?", TxKindJoin, channelID, OutboundTxQueued).
+		Updates(map[string]any{"status": OutboundTxFailed, "error": "channel creation was removed by a reorg", "updated_at": time.Now()}).Error
+	if err != nil {
+		return fmt.Errorf("failed to cancel join of channel %s: %w", channelID, err)
+	}
+
+	if err := tx.Where("channel_id = ?", channelID).Delete(&ChannelState{}).Error; err != nil {
+		return fmt.Errorf("failed to delete states of channel %s: %w", channelID, err)
+	}
+	if err := tx.Where("channel_id = ?", channelID).Delete(&ChannelTransition{}).Error; err != nil {
+		return fmt.Errorf("failed to delete transitions of channel %s: %w", channelID, err)
+	}
+	return tx.Where("channel_id = ?", channelID).Delete(&Channel{}).Error
+}
+
+// revertProcessedEvent undoes the ledger and channel effects of an applied event and forgets it,
+// so that it is applied again if its log is included in another block
+func revertProcessedEvent(tx *gorm.DB, event *ProcessedEvent) error {
+	ledger := &Ledger{db: tx}
+	if _, err := ledger.ReverseTransactions(ChainReference(event.TxHash, event.LogIndex)); err != nil {
+		return err
+	}
+	if err := restoreChannel(tx, event); err != nil {
+		return err
+	}
+	// A checkpoint that confirmed a challenge response is no longer on-chain
+	err := tx.Model(&ChallengeResponse{}).Where("tx_hash = ? AND status = ?", event.TxHash, ChallengeResponseConfirmed).
+		Update("status", ChallengeResponseSubmitted).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(event).Error
+}
+
+// revertEvent undoes the effects of a custody log that a reorg removed from the canonical chain,
+// together with the events applied after it to the same channel, which build on it. Logs that were never applied are ignored.
+// It returns the events that were reverted, latest first.
+func (c *Custody) revertEvent(l types.Log) ([]ProcessedEvent, error) {
+	var reverted []ProcessedEvent
+	err := c.ledger.db.Transaction(func(tx *gorm.DB) error {
+		// The log is matched by block hash, so that a log already applied again from its new block is left alone
+		var events []ProcessedEvent
+		err := tx.Where("network_id = ? AND tx_hash = ? AND log_index = ? AND block_hash = ?",
+			c.networkID, l.TxHash.Hex(), l.Index, l.BlockHash.Hex()).Limit(1).Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		reverted = events
+		if events[0].ChannelID != "" {
+			err := tx.Where("network_id = ? AND channel_id = ? AND id >= ?", c.networkID, events[0].ChannelID, events[0].ID).
+				Order("id DESC").Find(&reverted).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range reverted {
+			if err := revertProcessedEvent(tx, &reverted[i]); err != nil {
+				return fmt.Errorf("failed to revert log %d of tx %s: %w", reverted[i].LogIndex, reverted[i].TxHash, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range reverted {
+		log.Printf("[%s] Reverted log %d of tx %s from block %d", event.EventName, event.LogIndex, event.TxHash, event.BlockNumber)
+		if c.metrics != nil {
+			c.metrics.CustodyEvents.WithLabelValues(c.networkID, event.EventName, custodyEventReverted).Inc()
+		}
+	}
+	return reverted, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// logEmitterCode deploys a contract emitting a log with the two topics at the start of the calldata and the rest as data
+var logEmitterCode = common.FromHex("0x6015600c60003960156000f3" + "604036038060406000376020356000358260" + "00a200")
+
+// TestReorgRevertsEvents tests that custody logs removed by a reorg are reverted, and applied again if they are re-included
+func TestReorgRevertsEvents(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	sim := simulated.NewBackend(types.GenesisAlloc{from: {Balance: big.NewInt(params.Ether)}})
+	defer sim.Close()
+	client := sim.Client()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chainID, err := client.ChainID(ctx)
+	require.NoError(t, err)
+	signer := types.LatestSignerForChainID(chainID)
+	signTx := func(nonce uint64, to *common.Address, data []byte, tip int64) *types.Transaction {
+		tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasTipCap: big.NewInt(tip * params.GWei),
+			GasFeeCap: big.NewInt(100 * tip * params.GWei),
+			Gas:       200000,
+			To:        to,
+			Data:      data,
+		})
+		require.NoError(t, err)
+		return tx
+	}
+	sendTx := func(nonce uint64, to *common.Address, data []byte, tip int64) *types.Transaction {
+		tx := signTx(nonce, to, data, tip)
+		require.NoError(t, client.SendTransaction(ctx, tx))
+		return tx
+	}
+
+	deployment := sendTx(0, nil, logEmitterCode, 1)
+	sim.Commit()
+	receipt, err := client.TransactionReceipt(ctx, deployment.Hash())
+	require.NoError(t, err)
+	emitter := receipt.ContractAddress
+
+	binding, err := nitrolite.NewCustody(emitter, client)
+	require.NoError(t, err)
+	ledger := NewLedger(db)
+	c := &Custody{client: client, custody: binding, ledger: ledger, custodyAddr: emitter, networkID: chainID.String()}
+
+	// The participant deposited 100 and the broker signed a resize withdrawing 40
+	channelID := crypto.Keccak256Hash([]byte("channel"))
+	participant := "0xB0B0000000000000000000000000000000000001"
+	token := "0x1000000000000000000000000000000000000001"
+	require.NoError(t, CreateChannel(db, channelID.Hex(), participant, 1, "0xAdjudicator", chainID.String(), token, NewAmount(100)))
+	account := ledger.SelectBeneficiaryAccount(channelID.Hex(), participant, token)
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), ChainReference("0xdeposit", 0)))
+	_, err = ledger.PlaceHold(account, NewAmount(40), 1)
+	require.NoError(t, err)
+
+	head, err := client.BlockNumber(ctx)
+	require.NoError(t, err)
+	go listenEvents(ctx, client, "test", emitter, chainID.String(), head, ListenerConfig{}, c.handleBlockChainEvent, c.saveEventCursor)
+
+	parent, err := client.HeaderByNumber(ctx, nil)
+	require.NoError(t, err)
+	deltas, err := custodyAbi.Events["Resized"].Inputs.NonIndexed().Pack([]*big.Int{big.NewInt(-40), big.NewInt(0)})
+	require.NoError(t, err)
+	resizedID := custodyAbi.Events["Resized"].ID
+	resize := sendTx(1, &emitter, append(append(resizedID.Bytes(), channelID.Bytes()...), deltas...), 1)
+	sim.Commit()
+
+	// processedIn polls the block the resize was applied from, while the listener may be writing
+	processedIn := func(blockHash string) func() bool {
+		return func() bool {
+			var events []ProcessedEvent
+			if err := db.Where("tx_hash = ?", resize.Hash().Hex()).Find(&events).Error; err != nil {
+				return false
+			}
+			if len(events) == 0 {
+				return blockHash == ""
+			}
+			return events[0].BlockHash == blockHash
+		}
+	}
+	channelState := func() (uint64, Amount, Amount) {
+		channel, err := GetChannelByID(db, channelID.Hex())
+		require.NoError(t, err)
+		balance, err := account.Balance()
+		require.NoError(t, err)
+		available, err := account.AvailableBalance()
+		require.NoError(t, err)
+		return channel.Version, balance, available
+	}
+
+	receipt, err = client.TransactionReceipt(ctx, resize.Hash())
+	require.NoError(t, err)
+	require.Len(t, receipt.Logs, 1)
+	require.Eventually(t, processedIn(receipt.BlockHash.Hex()), 5*time.Second, 10*time.Millisecond)
+	version, balance, available := channelState()
+	assert.Equal(t, uint64(1), version)
+	assert.Equal(t, "60", balance.String())
+	assert.Equal(t, "60", available.String())
+
+	// The resize is included again in the new chain: it is reverted, then applied once from its new block
+	require.NoError(t, sim.Fork(parent.Hash()))
+	sim.Commit()
+	reincluded, err := client.TransactionReceipt(ctx, resize.Hash())
+	require.NoError(t, err)
+	require.NotEqual(t, receipt.BlockHash, reincluded.BlockHash)
+	require.Eventually(t, processedIn(reincluded.BlockHash.Hex()), 5*time.Second, 10*time.Millisecond)
+	version, balance, available = channelState()
+	assert.Equal(t, uint64(1), version)
+	assert.Equal(t, "60", balance.String())
+	assert.Equal(t, "60", available.String())
+
+	// The resize is replaced in the new chain: its effects are reverted and the hold is active again
+	require.NoError(t, sim.Fork(parent.Hash()))
+	// The pool takes the forked out resize back asynchronously
+	replacement := signTx(1, &from, nil, 10)
+	require.Eventually(t, func() bool { return client.SendTransaction(ctx, replacement) == nil }, 5*time.Second, 10*time.Millisecond)
+	sim.Commit()
+	_, err = client.TransactionReceipt(ctx, replacement.Hash())
+	require.NoError(t, err)
+	require.Eventually(t, processedIn(""), 5*time.Second, 10*time.Millisecond)
+	version, balance, available = channelState()
+	assert.Equal(t, uint64(0), version)
+	assert.Equal(t, "100", balance.String())
+	assert.Equal(t, "60", available.String())
+
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "100", channel.Amount.String())
+
+	var reversals []Transaction
+	require.NoError(t, db.Where("kind = ?", TransactionKindReversal).Find(&reversals).Error)
+	assert.Len(t, reversals, 2)
+}
+
+// TestReorgRemovesCreatedChannel tests that reverting the event that created a channel removes everything recorded for it
+func TestReorgRemovesCreatedChannel(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ledger := NewLedger(db)
+	channelID := crypto.Keccak256Hash([]byte("channel")).Hex()
+	participant := "0xB0B0000000000000000000000000000000000001"
+	token := "0x1000000000000000000000000000000000000001"
+	event := &ProcessedEvent{NetworkID: "137", TxHash: "0xcreated", EventName: "Created", ChannelID: channelID}
+	require.NoError(t, db.Create(event).Error)
+
+	// The channel was created with a deposit, the broker signed a state for it and queued its join
+	require.NoError(t, CreateChannel(db, channelID, participant, 1, "0xAdjudicator", "137", token, NewAmount(100)))
+	account := ledger.SelectBeneficiaryAccount(channelID, participant, token)
+	require.NoError(t, ledger.Deposit(account, NewAmount(100), ChainReference(event.TxHash, event.LogIndex)))
+	_, err := ledger.PlaceHold(account, NewAmount(40), 1)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&ChannelState{ChannelID: channelID, Version: 1, Allocations: []byte("[]"), StateHash: "0xstate", BrokerSig: "0xsig"}).Error)
+	join := &OutboundTx{NetworkID: "137", Kind: TxKindJoin, Reference: channelID, Status: OutboundTxQueued}
+	require.NoError(t, db.Create(join).Error)
+
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return revertProcessedEvent(tx, event)
+	}))
+
+	channel, err := GetChannelByID(db, channelID)
+	require.NoError(t, err)
+	assert.Nil(t, channel)
+	transitions, err := GetChannelTransitions(db, channelID)
+	require.NoError(t, err)
+	assert.Empty(t, transitions)
+	states, err := GetChannelStates(db, channelID)
+	require.NoError(t, err)
+	assert.Empty(t, states)
+
+	balance, err := account.Balance()
+	require.NoError(t, err)
+	assert.Equal(t, "0", balance.String())
+	available, err := account.AvailableBalance()
+	require.NoError(t, err)
+	assert.Equal(t, "0", available.String())
+	var holds []Hold
+	require.NoError(t, db.Where("account_id = ? AND status = ?", channelID, HoldStatusActive).Find(&holds).Error)
+	assert.Empty(t, holds)
+
+	require.NoError(t, db.First(join, join.ID).Error)
+	assert.Equal(t, OutboundTxFailed, join.Status)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,7 +12,7 @@ import (
 type RPCRequest struct {
 	Req       RPCData  `json:"req"`
 	AccountID string   `json:"acc,omitempty"` // If specified, message is sent into the virtual app.
-	Intent    []int64  `json:"int,omitempty"` // Allocation intent change
+	Intent    []Amount `json:"int,omitempty"` // Allocation intent change
 	Sig       []string `json:"sig"`
 }
 
@@ -19,7 +20,7 @@ type RPCRequest struct {
 type RPCResponse struct {
 	Res       RPCData  `json:"res"`
 	AccountID string   `json:"acc,omitempty"` // If specified, message is sent into the virtual app.
-	Intent    []int64  `json:"int,omitempty"` // Allocation intent change
+	Intent    []Amount `json:"int,omitempty"` // Allocation intent change
 	Sig       []string `json:"sig"`
 }
 
@@ -79,8 +80,10 @@ func (m *RPCData) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("invalid method: %w", err)
 	}
 
-	// Parse Params ([]any)
-	if err := json.Unmarshal(rawMsg[2], &m.Params); err != nil {
+	// Parse Params ([]any), keeping numbers as json.Number so large amounts are not rounded to float64
+	decoder := json.NewDecoder(bytes.NewReader(rawMsg[2]))
+	decoder.UseNumber()
+	if err := decoder.Decode(&m.Params); err != nil {
 		return fmt.Errorf("invalid params: %w", err)
 	}
 
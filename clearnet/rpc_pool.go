@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// rpcHealthCheckInterval is how often every endpoint of a network is probed
+	rpcHealthCheckInterval = 15 * time.Second
+	// rpcHealthCheckTimeout bounds a single probe of an endpoint
+	rpcHealthCheckTimeout = 5 * time.Second
+	// maxEndpointFailures is the number of consecutive failures after which an endpoint is skipped
+	maxEndpointFailures = 3
+	// maxEndpointLag is how many blocks an endpoint may trail the highest head of its network and stay healthy
+	maxEndpointLag = 5
+)
+
+// rpcEndpoint is a node of a network and its observed health
+type rpcEndpoint struct {
+	url        string
+	label      string // URL without path, query or credentials, for logs and metrics
+	client     *ethclient.Client
+	verified   bool // The endpoint reported the expected chain ID
+	wrongChain bool // The endpoint reported another chain ID, so it is never used
+	failures   int  // Consecutive failed requests and health checks
+	head       uint64
+	latency    time.Duration
+}
+
+// healthy reports whether requests should go to the endpoint, given the highest head seen on the network
+func (e *rpcEndpoint) healthy(bestHead uint64) bool {
+	return e.verified && e.failures < maxEndpointFailures && e.head+maxEndpointLag >= bestHead
+}
+
+// RPCPool sends the node requests of a network to the first healthy of several endpoints,
+// and fails over to the next one when a request fails because of the endpoint.
+// It implements the node API used by the custody client, so calls, transactions and subscriptions all fail over.
+type RPCPool struct {
+	networkID string
+	chainID   *big.Int
+	metrics   *Metrics
+
+	mu        sync.Mutex
+	endpoints []*rpcEndpoint // In order of preference
+	current   int
+}
+
+// NewRPCPool creates a pool over the endpoint URLs of a network, in order of preference.
+// Endpoints are dialed on first use, so a node that is down at startup does not prevent the others from serving.
+// No request goes to an endpoint before it reported the chain ID of the network.
+func NewRPCPool(networkID string, chainID *big.Int, urls []string, metrics *Metrics) (*RPCPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no RPC endpoints configured for network %s", networkID)
+	}
+
+	p := &RPCPool{networkID: networkID, chainID: chainID, metrics: metrics}
+	for _, u := range urls {
+		p.endpoints = append(p.endpoints, &rpcEndpoint{url: u, label: endpointLabel(u)})
+	}
+	return p, nil
+}
+
+// endpointLabel strips the path, query and credentials from an endpoint URL, which often carry API keys
+func endpointLabel(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "endpoint"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// CheckHealthPeriodically probes every endpoint at the given interval until ctx is done
+func (p *RPCPool) CheckHealthPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.CheckHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth probes every endpoint for its chain ID, head and latency, and switches away from an unhealthy current endpoint
+func (p *RPCPool) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probe(ctx, e)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bestHead := p.bestHead()
+	for _, e := range p.endpoints {
+		if p.metrics != nil {
+			up := 0.0
+			if e.healthy(bestHead) {
+				up = 1
+			}
+			p.metrics.RPCEndpointUp.WithLabelValues(p.networkID, e.label).Set(up)
+			p.metrics.RPCEndpointHead.WithLabelValues(p.networkID, e.label).Set(float64(e.head))
+			p.metrics.RPCEndpointLatency.WithLabelValues(p.networkID, e.label).Set(e.latency.Seconds())
+		}
+	}
+	if !p.endpoints[p.current].healthy(bestHead) {
+		for i, e := range p.endpoints {
+			if e.healthy(bestHead) {
+				p.switchTo(i)
+				break
+			}
+		}
+	}
+}
+
+// probe checks a single endpoint and records the result
+func (p *RPCPool) probe(ctx context.Context, e *rpcEndpoint) {
+	ctx, cancel := context.WithTimeout(ctx, rpcHealthCheckTimeout)
+	defer cancel()
+
+	err := func() error {
+		client, err := p.dial(ctx, e)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		head, err := client.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get block number: %w", err)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		e.head = head
+		e.latency = time.Since(start)
+		e.failures = 0
+		return nil
+	}()
+	if err != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.recordFailure(e, err)
+	}
+}
+
+// dial returns the client of an endpoint, connecting and checking its chain ID on first use
+func (p *RPCPool) dial(ctx context.Context, e *rpcEndpoint) (*ethclient.Client, error) {
+	p.mu.Lock()
+	client := e.client
+	wrongChain := e.wrongChain
+	p.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	if wrongChain {
+		return nil, fmt.Errorf("endpoint %s is on another chain than %s", e.label, p.chainID)
+	}
+
+	client, err := ethclient.DialContext(ctx, e.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", e.label, err)
+	}
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to get chain ID: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if chainID.Cmp(p.chainID) != 0 {
+		client.Close()
+		e.wrongChain = true
+		logger.Errorw("RPC endpoint is on the wrong chain", "networkID", p.networkID, "endpoint", e.label, "chainID", chainID.String(), "expected", p.chainID.String())
+		return nil, fmt.Errorf("endpoint is on chain %s, expected %s", chainID, p.chainID)
+	}
+	if e.client != nil {
+		client.Close()
+		return e.client, nil
+	}
+	e.client = client
+	e.verified = true
+	return client, nil
+}
+
+// bestHead returns the highest head reported by a verified endpoint; the caller holds p.mu
+func (p *RPCPool) bestHead() uint64 {
+	var best uint64
+	for _, e := range p.endpoints {
+		if e.verified && e.failures < maxEndpointFailures {
+			best = max(best, e.head)
+		}
+	}
+	return best
+}
+
+// candidates returns the endpoints to try a request on: the current one if healthy, the other healthy
+// ones in order of preference, then the unhealthy ones with the fewest failures first.
+// Endpoints on another chain are never returned; the others are verified by dial before they are used.
+func (p *RPCPool) candidates() []*rpcEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bestHead := p.bestHead()
+	var healthy, unhealthy []*rpcEndpoint
+	for i, e := range p.endpoints {
+		switch {
+		case e.wrongChain:
+		case !e.healthy(bestHead):
+			unhealthy = append(unhealthy, e)
+		case i == p.current:
+			healthy = append([]*rpcEndpoint{e}, healthy...)
+		default:
+			healthy = append(healthy, e)
+		}
+	}
+	sort.SliceStable(unhealthy, func(i, j int) bool { return unhealthy[i].failures < unhealthy[j].failures })
+	return append(healthy, unhealthy...)
+}
+
+// do runs call on the candidate endpoints until one succeeds or fails for a reason other than the endpoint
+func (p *RPCPool) do(ctx context.Context, call func(client *ethclient.Client) error) error {
+	var lastErr error
+	for _, e := range p.candidates() {
+		client, err := p.dial(ctx, e)
+		if err == nil {
+			err = call(client)
+		}
+		if err == nil {
+			p.recordSuccess(e)
+			return nil
+		}
+		if !isEndpointError(ctx, err) {
+			return err
+		}
+
+		p.mu.Lock()
+		p.recordFailure(e, err)
+		p.mu.Unlock()
+		lastErr = err
+	}
+	return fmt.Errorf("all RPC endpoints of network %s failed: %w", p.networkID, lastErr)
+}
+
+// isEndpointError reports whether err means the endpoint could not serve the request,
+// rather than the node rejecting it or the caller giving up
+func isEndpointError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ethereum.NotFound) {
+		return false
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return true
+	}
+	var rpcErr rpc.Error
+	return !errors.As(err, &rpcErr)
+}
+
+// recordSuccess clears the failures of the endpoint that served a request and makes it the current one
+func (p *RPCPool) recordSuccess(e *rpcEndpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.failures = 0
+	if p.endpoints[p.current] == e {
+		return
+	}
+	for i := range p.endpoints {
+		if p.endpoints[i] == e {
+			p.switchTo(i)
+		}
+	}
+}
+
+// recordFailure counts a failure of an endpoint; the caller holds p.mu
+func (p *RPCPool) recordFailure(e *rpcEndpoint, err error) {
+	e.failures++
+	logger.Warnw("RPC endpoint failed", "networkID", p.networkID, "endpoint", e.label, "failures", e.failures, "error", err)
+	if p.metrics != nil {
+		p.metrics.RPCEndpointErrors.WithLabelValues(p.networkID, e.label).Inc()
+		if e.failures == maxEndpointFailures {
+			p.metrics.RPCEndpointUp.WithLabelValues(p.networkID, e.label).Set(0)
+		}
+	}
+}
+
+// switchTo makes endpoint i the current one; the caller holds p.mu
+func (p *RPCPool) switchTo(i int) {
+	logger.Warnw("failing over to another RPC endpoint", "networkID", p.networkID, "from", p.endpoints[p.current].label, "to", p.endpoints[i].label)
+	p.current = i
+	if p.metrics != nil {
+		p.metrics.RPCFailovers.WithLabelValues(p.networkID).Inc()
+	}
+}
+
+// CodeAt implements bind.ContractCaller
+func (p *RPCPool) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) (code []byte, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		code, err = client.CodeAt(ctx, contract, blockNumber)
+		return err
+	})
+	return code, err
+}
+
+// CallContract implements bind.ContractCaller
+func (p *RPCPool) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) (result []byte, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		result, err = client.CallContract(ctx, call, blockNumber)
+		return err
+	})
+	return result, err
+}
+
+// HeaderByNumber implements bind.ContractTransactor
+func (p *RPCPool) HeaderByNumber(ctx context.Context, number *big.Int) (header *types.Header, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		header, err = client.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+// PendingCodeAt implements bind.ContractTransactor
+func (p *RPCPool) PendingCodeAt(ctx context.Context, account common.Address) (code []byte, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		code, err = client.PendingCodeAt(ctx, account)
+		return err
+	})
+	return code, err
+}
+
+// PendingNonceAt implements bind.ContractTransactor
+func (p *RPCPool) PendingNonceAt(ctx context.Context, account common.Address) (nonce uint64, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		nonce, err = client.PendingNonceAt(ctx, account)
+		return err
+	})
+	return nonce, err
+}
+
+// SuggestGasPrice implements bind.ContractTransactor
+func (p *RPCPool) SuggestGasPrice(ctx context.Context) (price *big.Int, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		price, err = client.SuggestGasPrice(ctx)
+		return err
+	})
+	return price, err
+}
+
+// SuggestGasTipCap implements bind.ContractTransactor
+func (p *RPCPool) SuggestGasTipCap(ctx context.Context) (tip *big.Int, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		tip, err = client.SuggestGasTipCap(ctx)
+		return err
+	})
+	return tip, err
+}
+
+// EstimateGas implements bind.ContractTransactor
+func (p *RPCPool) EstimateGas(ctx context.Context, call ethereum.CallMsg) (gas uint64, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		gas, err = client.EstimateGas(ctx, call)
+		return err
+	})
+	return gas, err
+}
+
+// SendTransaction implements bind.ContractTransactor.
+// A signed transaction is safe to send again to another endpoint: a node that already has it rejects the copy.
+func (p *RPCPool) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return p.do(ctx, func(client *ethclient.Client) error {
+		return client.SendTransaction(ctx, tx)
+	})
+}
+
+// FilterLogs implements bind.ContractFilterer
+func (p *RPCPool) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		logs, err = client.FilterLogs(ctx, q)
+		return err
+	})
+	return logs, err
+}
+
+// SubscribeFilterLogs implements bind.ContractFilterer.
+// The subscription stays on the endpoint it was made on; when it fails, the failure counts against that
+// endpoint, so subscribing again goes to a healthy one.
+func (p *RPCPool) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	var sub ethereum.Subscription
+	var subClient *ethclient.Client
+	err := p.do(ctx, func(client *ethclient.Client) error {
+		var err error
+		sub, err = client.SubscribeFilterLogs(ctx, q, ch)
+		subClient = client
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var subEndpoint *rpcEndpoint
+	p.mu.Lock()
+	for _, e := range p.endpoints {
+		if e.client == subClient {
+			subEndpoint = e
+		}
+	}
+	p.mu.Unlock()
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		select {
+		case err := <-sub.Err():
+			if err != nil {
+				p.mu.Lock()
+				p.recordFailure(subEndpoint, err)
+				p.mu.Unlock()
+			}
+			return err
+		case <-quit:
+			sub.Unsubscribe()
+			return nil
+		}
+	}), nil
+}
+
+// NonceAt implements ethereum.ChainStateReader
+func (p *RPCPool) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (nonce uint64, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		nonce, err = client.NonceAt(ctx, account, blockNumber)
+		return err
+	})
+	return nonce, err
+}
+
+// BalanceAt implements ethereum.ChainStateReader
+func (p *RPCPool) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (balance *big.Int, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		balance, err = client.BalanceAt(ctx, account, blockNumber)
+		return err
+	})
+	return balance, err
+}
+
+// BlockNumber implements ethereum.BlockNumberReader
+func (p *RPCPool) BlockNumber(ctx context.Context) (number uint64, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		number, err = client.BlockNumber(ctx)
+		return err
+	})
+	return number, err
+}
+
+// TransactionByHash implements ethereum.TransactionReader
+func (p *RPCPool) TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		tx, isPending, err = client.TransactionByHash(ctx, hash)
+		return err
+	})
+	return tx, isPending, err
+}
+
+// TransactionReceipt implements ethereum.TransactionReader
+func (p *RPCPool) TransactionReceipt(ctx context.Context, hash common.Hash) (receipt *types.Receipt, err error) {
+	err = p.do(ctx, func(client *ethclient.Client) error {
+		receipt, err = client.TransactionReceipt(ctx, hash)
+		return err
+	})
+	return receipt, err
+}
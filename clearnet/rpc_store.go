@@ -18,6 +18,8 @@ type RPCRecord struct {
 	ReqSig    pq.StringArray `gorm:"type:text[];column:req_sig;"`
 	Response  []byte         `gorm:"column:result;type:text;not null"`
 	ResSig    pq.StringArray `gorm:"type:text[];column:res_sig;"`
+	PrevHash  string         `gorm:"column:prev_hash;not null;default:''"` // Hash of the previous record, see chain.go
+	Hash      string         `gorm:"column:hash;not null;default:''"`      // Hash of this record chained to PrevHash
 }
 
 // TableName specifies the table name for the RPCMessageDB model
@@ -35,7 +37,7 @@ func NewRPCStore(db *gorm.DB) *RPCStore {
 	return &RPCStore{db: db}
 }
 
-// StoreMessage stores an RPC message in the database
+// StoreMessage stores an RPC message in the database and appends it to the rpc_store hash chain
 func (s *RPCStore) StoreMessage(sender string, req *RPCData, reqSig []string, resBytes []byte, resSig []string) error {
 	paramsBytes, err := json.Marshal(req.Params)
 	if err != nil {
@@ -53,7 +55,24 @@ func (s *RPCStore) StoreMessage(sender string, req *RPCData, reqSig []string, re
 		Timestamp: req.Timestamp,
 	}
 
-	return s.db.Create(msg).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		head, err := lockChainHead(tx, rpcChain)
+		if err != nil {
+			return err
+		}
+
+		msg.PrevHash = head.Hash
+		msg.Hash, err = linkRecord(head.Hash, msg)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+
+		head.Hash = msg.Hash
+		return saveChainHead(tx, head)
+	})
 }
 
 // GetMessages retrieves RPC messages from the database with pagination
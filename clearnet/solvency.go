@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// SolvencyReport compares what the broker owes its users with the funds held by the custody contracts.
+// Liabilities are committed to per token with a Merkle sum tree, so users can check that their balance
+// was included and that the published total is not understated.
+type SolvencyReport struct {
+	ID          uint `gorm:"primaryKey"`
+	LastEntryID uint `gorm:"column:last_entry_id;not null"` // Liabilities include all entries up to this ID
+	CreatedAt   time.Time
+}
+
+// TableName specifies the table name for the SolvencyReport model
+func (SolvencyReport) TableName() string {
+	return "solvency_reports"
+}
+
+// LiabilityRoot is the root of the Merkle sum tree of user balances in one token
+type LiabilityRoot struct {
+	ID        uint   `gorm:"primaryKey"`
+	ReportID  uint   `gorm:"column:report_id;not null;index"`
+	Asset     string `gorm:"column:asset;not null"`
+	Root      string `gorm:"column:root;not null"`
+	Total     Amount `gorm:"column:total;not null"` // Sum of all user balances, committed to by Root
+	LeafCount int    `gorm:"column:leaf_count;not null"`
+	Holdings  Amount `gorm:"column:holdings;not null"` // Funds held on-chain over all networks
+}
+
+// TableName specifies the table name for the LiabilityRoot model
+func (LiabilityRoot) TableName() string {
+	return "liability_roots"
+}
+
+// Solvent reports whether the on-chain holdings cover the liabilities
+func (r *LiabilityRoot) Solvent() bool {
+	return r.Holdings.Cmp(r.Total) >= 0
+}
+
+// ReserveHolding is the amount of a token held by the custody contract of a network for the broker and its channels
+type ReserveHolding struct {
+	ID        uint   `gorm:"primaryKey"`
+	ReportID  uint   `gorm:"column:report_id;not null;index"`
+	NetworkID string `gorm:"column:network_id;not null"`
+	Token     string `gorm:"column:token;not null"`
+	Locked    Amount `gorm:"column:locked;not null"`    // Amounts of the broker channels listed by the custody contract
+	Available Amount `gorm:"column:available;not null"` // Deposited by the broker and not locked, read from the custody contract
+}
+
+// TableName specifies the table name for the ReserveHolding model
+func (ReserveHolding) TableName() string {
+	return "reserve_holdings"
+}
+
+// LiabilityAnomaly is a user whose total balance in an asset is negative, which a liability tree cannot include.
+// It is left out of the report's liabilities and recorded for investigation.
+type LiabilityAnomaly struct {
+	ID          uint   `gorm:"primaryKey"`
+	ReportID    uint   `gorm:"column:report_id;not null;index"`
+	Beneficiary string `gorm:"column:beneficiary;not null"`
+	Asset       string `gorm:"column:asset;not null"`
+	Balance     Amount `gorm:"column:balance;not null"`
+}
+
+// TableName specifies the table name for the LiabilityAnomaly model
+func (LiabilityAnomaly) TableName() string {
+	return "liability_anomalies"
+}
+
+// LiabilityProof proves the inclusion of a user balance in a liability root
+type LiabilityProof struct {
+	ID          uint           `gorm:"primaryKey"`
+	ReportID    uint           `gorm:"column:report_id;not null;index:idx_liability_proofs_user"`
+	Beneficiary string         `gorm:"column:beneficiary;not null;index:idx_liability_proofs_user"`
+	Asset       string         `gorm:"column:asset;not null;index:idx_liability_proofs_user"`
+	Balance     Amount         `gorm:"column:balance;not null"`
+	LeafIndex   int            `gorm:"column:leaf_index;not null"`
+	ProofHashes pq.StringArray `gorm:"type:text[];column:proof_hashes"` // Sibling hashes from the leaf up to the root
+	ProofSums   pq.StringArray `gorm:"type:text[];column:proof_sums"`   // Sibling sums, in the same order as ProofHashes
+}
+
+// TableName specifies the table name for the LiabilityProof model
+func (LiabilityProof) TableName() string {
+	return "liability_proofs"
+}
+
+// liabilityLeafArgs is the ABI encoding of a liability leaf: beneficiary, asset and balance
+var liabilityLeafArgs = func() abi.Arguments {
+	stringType, _ := abi.NewType("string", "", nil)
+	uint256Type, _ := abi.NewType("uint256", "", nil)
+	return abi.Arguments{{Type: stringType}, {Type: stringType}, {Type: uint256Type}}
+}()
+
+// LiabilityLeaf computes the Merkle sum leaf of a user balance.
+// Its hash is keccak256(keccak256(abi.encode(beneficiary, asset, balance))) and its sum is the balance.
+func LiabilityLeaf(beneficiary, asset string, balance Amount) (MerkleSumNode, error) {
+	if balance.Sign() < 0 {
+		return MerkleSumNode{}, fmt.Errorf("negative liability of %s in %s", beneficiary, asset)
+	}
+	encoded, err := liabilityLeafArgs.Pack(beneficiary, asset, balance.Big())
+	if err != nil {
+		return MerkleSumNode{}, fmt.Errorf("failed to encode liability leaf: %w", err)
+	}
+	return MerkleSumNode{Hash: crypto.Keccak256Hash(crypto.Keccak256(encoded)), Sum: balance.Big()}, nil
+}
+
+// normalizeAddress returns hex addresses in checksum form, so that differently cased addresses of a user are merged
+func normalizeAddress(s string) string {
+	if common.IsHexAddress(s) {
+		return common.HexToAddress(s).Hex()
+	}
+	return s
+}
+
+// userLiability is the total balance of a user in one asset over all channel and app session accounts
+type userLiability struct {
+	Beneficiary string
+	Asset       string
+	Balance     Amount
+}
+
+// computeLiabilities sums user balances per beneficiary and asset up to lastEntryID.
+// The custody and broker fee accounts are not owed to users and are left out.
+// Users without funds are omitted, and users with a negative total are returned separately as anomalies.
+// Both results are sorted by asset and beneficiary.
+func computeLiabilities(db *gorm.DB, lastEntryID uint) ([]userLiability, []userLiability, error) {
+	entries, err := snapshotBalances(db, lastEntryID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+
+	type userKey struct{ beneficiary, asset string }
+	totals := make(map[userKey]Amount)
+	for _, entry := range entries {
+		if entry.AccountID == CustodyAccountID || entry.AccountID == BrokerFeeAccountID {
+			continue
+		}
+		key := userKey{normalizeAddress(entry.Beneficiary), normalizeAddress(entry.Asset)}
+		totals[key] = totals[key].Add(entry.Balance)
+	}
+
+	liabilities := make([]userLiability, 0, len(totals))
+	var anomalies []userLiability
+	for key, balance := range totals {
+		liability := userLiability{Beneficiary: key.beneficiary, Asset: key.asset, Balance: balance}
+		switch {
+		case balance.Sign() < 0:
+			anomalies = append(anomalies, liability)
+		case !balance.IsZero():
+			liabilities = append(liabilities, liability)
+		}
+	}
+
+	sortLiabilities(liabilities)
+	sortLiabilities(anomalies)
+	return liabilities, anomalies, nil
+}
+
+// sortLiabilities sorts user balances by asset and beneficiary
+func sortLiabilities(liabilities []userLiability) {
+	sort.Slice(liabilities, func(i, j int) bool {
+		if liabilities[i].Asset != liabilities[j].Asset {
+			return liabilities[i].Asset < liabilities[j].Asset
+		}
+		return liabilities[i].Beneficiary < liabilities[j].Beneficiary
+	})
+}
+
+// reserveReader reads the available funds and the channels of the broker on a custody contract
+type reserveReader interface {
+	BrokerAvailable(ctx context.Context, token common.Address) (*big.Int, error)
+	BrokerChannels(ctx context.Context) ([]common.Hash, error)
+}
+
+// SolvencyReporter periodically produces solvency reports
+type SolvencyReporter struct {
+	db       *gorm.DB
+	reserves map[string]reserveReader // Custody clients by network ID
+}
+
+// NewSolvencyReporter creates a solvency reporter reading on-chain holdings through the given custody clients
+func NewSolvencyReporter(ledger *Ledger, custodyClients map[string]*Custody) *SolvencyReporter {
+	reserves := make(map[string]reserveReader, len(custodyClients))
+	for _, client := range custodyClients {
+		reserves[client.networkID] = client
+	}
+	return &SolvencyReporter{db: ledger.db, reserves: reserves}
+}
+
+// computeHoldings returns the funds held by the custody contract of every network and token with broker channels.
+// The available balance of the broker is read with getAccountInfo. The contract has no view of the funds locked in
+// a channel, so the locked funds are the amounts of the channels it lists for the broker with getAccountChannels.
+func (r *SolvencyReporter) computeHoldings(ctx context.Context) ([]ReserveHolding, error) {
+	var channels []Channel
+	if err := r.db.Select("channel_id", "network_id", "token", "amount").Find(&channels).Error; err != nil {
+		return nil, err
+	}
+
+	// Closed channels lock nothing, but the broker may still hold funds in their token
+	tokens := make(map[string][]string)
+	known := make(map[string]Channel) // Channels by network and channel ID
+	seen := make(map[string]bool)
+	for _, channel := range channels {
+		token := normalizeAddress(channel.Token)
+		if key := channel.NetworkID + "/" + token; !seen[key] {
+			seen[key] = true
+			tokens[channel.NetworkID] = append(tokens[channel.NetworkID], token)
+		}
+		known[channel.NetworkID+"/"+common.HexToHash(channel.ChannelID).Hex()] = channel
+	}
+
+	var holdings []ReserveHolding
+	for network, networkTokens := range tokens {
+		reserve, ok := r.reserves[network]
+		if !ok {
+			return nil, fmt.Errorf("network %s holding channels in %s is not configured", network, strings.Join(networkTokens, ", "))
+		}
+
+		channelIDs, err := reserve.BrokerChannels(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read broker channels on network %s: %w", network, err)
+		}
+		// Channels listed on-chain but unknown to the database are reported by reconciliation
+		locked := make(map[string]Amount)
+		for _, channelID := range channelIDs {
+			if channel, ok := known[network+"/"+channelID.Hex()]; ok {
+				token := normalizeAddress(channel.Token)
+				locked[token] = locked[token].Add(channel.Amount)
+			}
+		}
+
+		for _, token := range networkTokens {
+			available, err := reserve.BrokerAvailable(ctx, common.HexToAddress(token))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s holdings on network %s: %w", token, network, err)
+			}
+			availableAmount, err := NewAmountFromBig(available)
+			if err != nil {
+				return nil, err
+			}
+			holdings = append(holdings, ReserveHolding{
+				NetworkID: network,
+				Token:     token,
+				Locked:    locked[token],
+				Available: availableAmount,
+			})
+		}
+	}
+
+	sort.Slice(holdings, func(i, j int) bool {
+		if holdings[i].Token != holdings[j].Token {
+			return holdings[i].Token < holdings[j].Token
+		}
+		return holdings[i].NetworkID < holdings[j].NetworkID
+	})
+	return holdings, nil
+}
+
+// Report stores a solvency report over the latest ledger entry and returns it with one liability root per token
+func (r *SolvencyReporter) Report(ctx context.Context) (*SolvencyReport, []LiabilityRoot, error) {
+	var lastEntryID *uint
+	if err := r.db.Model(&Entry{}).Select("MAX(id)").Scan(&lastEntryID).Error; err != nil {
+		return nil, nil, err
+	}
+	report := &SolvencyReport{CreatedAt: time.Now()}
+	if lastEntryID != nil {
+		report.LastEntryID = *lastEntryID
+	}
+
+	liabilities, anomalies, err := computeLiabilities(r.db, report.LastEntryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, anomaly := range anomalies {
+		log.Printf("Warning: solvency report leaves out the negative balance %s of %s in %s", anomaly.Balance, anomaly.Beneficiary, anomaly.Asset)
+	}
+	holdings, err := r.computeHoldings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every asset with either liabilities or holdings gets a root
+	leaves := make(map[string][]MerkleSumNode)
+	held := make(map[string]Amount)
+	var assets []string
+	seen := make(map[string]bool)
+	for _, liability := range liabilities {
+		if !seen[liability.Asset] {
+			seen[liability.Asset] = true
+			assets = append(assets, liability.Asset)
+		}
+		leaf, err := LiabilityLeaf(liability.Beneficiary, liability.Asset, liability.Balance)
+		if err != nil {
+			return nil, nil, err
+		}
+		leaves[liability.Asset] = append(leaves[liability.Asset], leaf)
+	}
+	for _, holding := range holdings {
+		if !seen[holding.Token] {
+			seen[holding.Token] = true
+			assets = append(assets, holding.Token)
+		}
+		held[holding.Token] = held[holding.Token].Add(holding.Locked).Add(holding.Available)
+	}
+	sort.Strings(assets)
+
+	trees := make(map[string]*MerkleSumTree, len(assets))
+	roots := make([]LiabilityRoot, len(assets))
+	for i, asset := range assets {
+		tree := NewMerkleSumTree(leaves[asset])
+		root := tree.Root()
+		total, err := NewAmountFromBig(root.Sum)
+		if err != nil {
+			return nil, nil, err
+		}
+		trees[asset] = tree
+		roots[i] = LiabilityRoot{
+			Asset:     asset,
+			Root:      root.Hash.Hex(),
+			Total:     total,
+			LeafCount: len(leaves[asset]),
+			Holdings:  held[asset],
+		}
+	}
+
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(report).Error; err != nil {
+			return err
+		}
+
+		for i := range roots {
+			roots[i].ReportID = report.ID
+		}
+		if len(roots) > 0 {
+			if err := tx.Create(&roots).Error; err != nil {
+				return err
+			}
+		}
+
+		for i := range holdings {
+			holdings[i].ReportID = report.ID
+		}
+		if len(holdings) > 0 {
+			if err := tx.Create(&holdings).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, anomaly := range anomalies {
+			err := tx.Create(&LiabilityAnomaly{ReportID: report.ID, Beneficiary: anomaly.Beneficiary, Asset: anomaly.Asset, Balance: anomaly.Balance}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		proofs := make([]LiabilityProof, 0, len(liabilities))
+		leafIndex := 0
+		for i, liability := range liabilities {
+			if i > 0 && liabilities[i-1].Asset != liability.Asset {
+				leafIndex = 0
+			}
+			proof := LiabilityProof{
+				ReportID:    report.ID,
+				Beneficiary: liability.Beneficiary,
+				Asset:       liability.Asset,
+				Balance:     liability.Balance,
+				LeafIndex:   leafIndex,
+				ProofHashes: pq.StringArray{},
+				ProofSums:   pq.StringArray{},
+			}
+			for _, sibling := range trees[liability.Asset].Proof(leafIndex) {
+				proof.ProofHashes = append(proof.ProofHashes, sibling.Hash.Hex())
+				proof.ProofSums = append(proof.ProofSums, sibling.Sum.String())
+			}
+			proofs = append(proofs, proof)
+			leafIndex++
+		}
+		if len(proofs) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(proofs, 500).Error
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store solvency report: %w", err)
+	}
+
+	return report, roots, nil
+}
+
+// ReportPeriodically produces a solvency report every interval until ctx is done
+func (r *SolvencyReporter) ReportPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, roots, err := r.Report(ctx)
+			if err != nil {
+				log.Printf("Error producing solvency report: %v", err)
+				continue
+			}
+			for _, root := range roots {
+				if root.Solvent() {
+					log.Printf("Solvency report %d: %s liabilities %s covered by holdings %s", report.ID, root.Asset, root.Total, root.Holdings)
+				} else {
+					log.Printf("Warning: solvency report %d: %s liabilities %s exceed holdings %s", report.ID, root.Asset, root.Total, root.Holdings)
+				}
+			}
+		}
+	}
+}
+
+// GetLiabilityProofs returns the proofs of the balances of a user in a solvency report, with the liability root of each asset.
+// If reportID is zero, the latest report is used. If asset is empty, proofs for all assets of the user are returned.
+func GetLiabilityProofs(db *gorm.DB, reportID uint, beneficiary, asset string) (*SolvencyReport, []LiabilityRoot, []LiabilityProof, error) {
+	var report SolvencyReport
+	query := db
+	if reportID > 0 {
+		query = query.Where("id = ?", reportID)
+	}
+	if err := query.Order("id DESC").First(&report).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, errors.New("solvency report not found")
+		}
+		return nil, nil, nil, err
+	}
+
+	proofQuery := db.Where("report_id = ? AND beneficiary = ?", report.ID, normalizeAddress(beneficiary))
+	if asset != "" {
+		proofQuery = proofQuery.Where("asset = ?", normalizeAddress(asset))
+	}
+	var proofs []LiabilityProof
+	if err := proofQuery.Order("asset").Find(&proofs).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	if len(proofs) == 0 {
+		return nil, nil, nil, errors.New("no balance is included in the solvency report")
+	}
+
+	assets := make([]string, len(proofs))
+	for i, proof := range proofs {
+		assets[i] = proof.Asset
+	}
+	var roots []LiabilityRoot
+	if err := db.Where("report_id = ? AND asset IN ?", report.ID, assets).Order("asset").Find(&roots).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	if len(roots) != len(proofs) {
+		return nil, nil, nil, errors.New("liability root not found")
+	}
+
+	return &report, roots, proofs, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reserveCode is the runtime code of a custody contract answering getAccountInfo with (10, 2) for every account and
+// token, and getAccountChannels with the channel IDs 0xa and 0xb for every account
+var reserveCode = common.FromHex("0x" +
+	"600035" + "60e01c" + "80" + "636332fef6" + "14" + "601d57" + "637e2d8d72" + "14" + "602d57" + "600080fd" +
+	"5b" + "600a600052" + "6002602052" + "60406000f3" +
+	"5b" + "6020600052" + "6002602052" + "600a604052" + "600b606052" + "60806000f3")
+
+// TestMerkleSumTree tests that every leaf can be proven against the root sum for trees of any size
+func TestMerkleSumTree(t *testing.T) {
+	assert.Equal(t, "0", NewMerkleSumTree(nil).Root().Sum.String())
+
+	for size := 1; size <= 9; size++ {
+		leaves := make([]MerkleSumNode, size)
+		for i := range leaves {
+			leaves[i] = MerkleSumNode{Hash: crypto.Keccak256Hash([]byte{byte(i)}), Sum: big.NewInt(int64(i + 1))}
+		}
+
+		tree := NewMerkleSumTree(leaves)
+		assert.Equal(t, int64(size*(size+1)/2), tree.Root().Sum.Int64())
+		for i, leaf := range leaves {
+			assert.True(t, VerifyMerkleSumProof(leaf, tree.Proof(i), tree.Root()), "leaf %d of %d", i, size)
+		}
+
+		// Understating a balance changes the root sum
+		understated := MerkleSumNode{Hash: leaves[0].Hash, Sum: big.NewInt(0)}
+		assert.False(t, VerifyMerkleSumProof(understated, tree.Proof(0), tree.Root()))
+	}
+}
+
+// TestSolvencyReport tests that user liabilities are committed to per token and compared with on-chain holdings
+func TestSolvencyReport(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	usdc := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	alice := common.HexToAddress("0xA11CE00000000000000000000000000000000001")
+	bob := common.HexToAddress("0xB0B0000000000000000000000000000000000002")
+	carol := common.HexToAddress("0xCA40100000000000000000000000000000000003")
+
+	ledger := NewLedger(db)
+	channelA := common.HexToHash("0xa").Hex()
+	channelB := common.HexToHash("0xb").Hex()
+	channelC := common.HexToHash("0xc").Hex()
+	require.NoError(t, CreateChannel(db, channelA, alice.Hex(), 1, "0xAdjudicator", "137", usdc.Hex(), NewAmount(100)))
+	require.NoError(t, CreateChannel(db, channelB, bob.Hex(), 1, "0xAdjudicator", "137", usdc.Hex(), NewAmount(50)))
+	// Channel C is closed and no longer listed on-chain, so its amount is not held
+	require.NoError(t, CreateChannel(db, channelC, carol.Hex(), 1, "0xAdjudicator", "137", usdc.Hex(), NewAmount(30)))
+	require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", channelC).Update("status", ChannelStatusClosed).Error)
+
+	aliceChannel := ledger.SelectBeneficiaryAccount(channelA, alice.Hex(), usdc.Hex())
+	require.NoError(t, ledger.Deposit(aliceChannel, NewAmount(100), "test"))
+	require.NoError(t, ledger.Deposit(ledger.SelectBeneficiaryAccount(channelB, bob.Hex(), usdc.Hex()), NewAmount(50), "test"))
+	// App participants may be given in lower case; they are merged with the channel balance
+	aliceApp := ledger.SelectBeneficiaryAccount("0xApp", strings.ToLower(alice.Hex()), usdc.Hex())
+	require.NoError(t, aliceChannel.Transfer(TransactionKindAppFund, "test", aliceApp, NewAmount(40)))
+	// Fees belong to the broker and are not a liability
+	feeAccount := ledger.SelectBeneficiaryAccount(BrokerFeeAccountID, BrokerAddress, usdc.Hex())
+	require.NoError(t, aliceChannel.Transfer(TransactionKindFee, "test", feeAccount, NewAmount(5)))
+
+	// A withdrawal booked after the funds were spent leaves Carol owing the broker
+	require.NoError(t, ledger.Withdraw(ledger.SelectBeneficiaryAccount(channelC, carol.Hex(), usdc.Hex()), NewAmount(10), "test"))
+
+	// Holdings are read through the custody binding from a contract listing channels A and B
+	custodyAddr := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	sim := simulated.NewBackend(types.GenesisAlloc{custodyAddr: {Code: reserveCode, Balance: big.NewInt(0)}})
+	defer sim.Close()
+	binding, err := nitrolite.NewCustody(custodyAddr, sim.Client())
+	require.NoError(t, err)
+	custody := &Custody{client: sim.Client(), custody: binding, custodyAddr: custodyAddr, networkID: "137"}
+	reporter := NewSolvencyReporter(ledger, map[string]*Custody{"137": custody})
+
+	report, roots, err := reporter.Report(context.Background())
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	assert.Equal(t, usdc.Hex(), roots[0].Asset)
+	assert.Equal(t, "145", roots[0].Total.String())
+	assert.Equal(t, "160", roots[0].Holdings.String())
+	assert.Equal(t, 2, roots[0].LeafCount)
+	assert.True(t, roots[0].Solvent())
+
+	var holdings []ReserveHolding
+	require.NoError(t, db.Where("report_id = ?", report.ID).Find(&holdings).Error)
+	require.Len(t, holdings, 1)
+	assert.Equal(t, "150", holdings[0].Locked.String())
+	assert.Equal(t, "10", holdings[0].Available.String())
+
+	// The negative balance is recorded as an anomaly instead of a liability
+	var anomalies []LiabilityAnomaly
+	require.NoError(t, db.Where("report_id = ?", report.ID).Find(&anomalies).Error)
+	require.Len(t, anomalies, 1)
+	assert.Equal(t, carol.Hex(), anomalies[0].Beneficiary)
+	assert.Equal(t, "-10", anomalies[0].Balance.String())
+
+	// Users get proofs of their own balances through the RPC
+	rpcRequest := &RPCRequest{
+		Req: RPCData{
+			RequestID: 1,
+			Method:    "get_liability_proof",
+			Params:    []any{},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	response, err := HandleGetLiabilityProof(rpcRequest, ledger, strings.ToLower(alice.Hex()))
+	require.NoError(t, err)
+	require.Len(t, response.Res.Params, 1)
+	proofResponse, ok := response.Res.Params[0].(LiabilityProofResponse)
+	require.True(t, ok)
+	assert.Equal(t, report.ID, proofResponse.ReportID)
+	require.Len(t, proofResponse.Proofs, 1)
+
+	proof := proofResponse.Proofs[0]
+	assert.Equal(t, "95", proof.Balance.String())
+	assert.Equal(t, roots[0].Root, proof.Root)
+
+	leaf, err := LiabilityLeaf(alice.Hex(), usdc.Hex(), NewAmount(95))
+	require.NoError(t, err)
+	assert.Equal(t, leaf.Hash.Hex(), proof.Leaf)
+	var siblings []MerkleSumNode
+	for _, node := range proof.Proof {
+		siblings = append(siblings, MerkleSumNode{Hash: common.HexToHash(node.Hash), Sum: node.Sum.Big()})
+	}
+	assert.True(t, VerifyMerkleSumProof(leaf, siblings, MerkleSumNode{Hash: common.HexToHash(proof.Root), Sum: proof.Total.Big()}))
+
+	// The broker has no liability to itself
+	_, err = HandleGetLiabilityProof(rpcRequest, ledger, BrokerAddress)
+	assert.Error(t, err)
+
+	// Reports are not produced from partial holdings
+	missing, err := nitrolite.NewCustody(common.HexToAddress("0x3000000000000000000000000000000000000003"), sim.Client())
+	require.NoError(t, err)
+	custody.custody = missing
+	_, _, err = reporter.Report(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// OutboundTxStatus represents the progress of a transaction sent by the broker
+type OutboundTxStatus string
+
+var (
+	OutboundTxQueued    OutboundTxStatus = "queued"    // Waiting to be signed and sent
+	OutboundTxPending   OutboundTxStatus = "pending"   // Signed with a nonce and sent, not yet mined
+	OutboundTxConfirmed OutboundTxStatus = "confirmed" // Mined successfully in TxHash
+	OutboundTxFailed    OutboundTxStatus = "failed"    // Reverted, rejected, or its nonce was used by another transaction
+)
+
+// Kinds of outbound transactions, each with the records it references
+const (
+	TxKindJoin       = "join"       // Reference is the channel ID
+	TxKindCheckpoint = "checkpoint" // Reference is the channel ID
+	TxKindStateRoot  = "state_root" // Reference is the state root
+)
+
+const (
+	// txProcessInterval is how often outbound transactions are sent and their receipts checked
+	txProcessInterval = 5 * time.Second
+	// txGasLimitMargin is the percentage added to the gas estimate of a transaction
+	txGasLimitMargin = 20
+	// txFeeBump is the percentage by which the fees of a stuck transaction are raised; nodes require at least 10
+	txFeeBump = 15
+)
+
+// OutboundTx is a transaction sent by the broker, kept until it is mined or has failed
+type OutboundTx struct {
+	ID          uint             `gorm:"primaryKey"`
+	NetworkID   string           `gorm:"column:network_id;not null;index:idx_outbound_txs_status"`
+	Kind        string           `gorm:"column:kind;not null"`
+	Reference   string           `gorm:"column:reference;not null;index"`
+	From        string           `gorm:"column:from_address;not null"`
+	To          string           `gorm:"column:to_address;not null"`
+	Data        string           `gorm:"column:data;not null"` // Hex encoded calldata
+	Nonce       *uint64          `gorm:"column:nonce"`         // Assigned when the transaction is first signed
+	GasLimit    uint64           `gorm:"column:gas_limit;not null;default:0"`
+	GasTipCap   Amount           `gorm:"column:gas_tip_cap;not null"`
+	GasFeeCap   Amount           `gorm:"column:gas_fee_cap;not null"`
+	TxHash      string           `gorm:"column:tx_hash;not null;default:''"` // Latest signed version, or the mined one
+	TxHashes    pq.StringArray   `gorm:"column:tx_hashes;type:text[]"`       // Every version sent, replacements included
+	RawTx       string           `gorm:"column:raw_tx;not null;default:''"`  // Latest signed version, for rebroadcasting
+	Attempts    int              `gorm:"column:attempts;not null;default:0"`
+	Status      OutboundTxStatus `gorm:"column:status;not null;index:idx_outbound_txs_status"`
+	Error       string           `gorm:"column:error;not null;default:''"`
+	BlockNumber uint64           `gorm:"column:block_number;not null;default:0"`
+	SentAt      *time.Time       `gorm:"column:sent_at"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// TableName specifies the table name for the OutboundTx model
+func (OutboundTx) TableName() string {
+	return "outbound_txs"
+}
+
+// TxConfig controls the fees and replacement of the transactions the broker sends on a network
+type TxConfig struct {
+	MaxFeeCap    *big.Int      // Highest fee per gas, base fee included
+	MaxTipCap    *big.Int      // Highest priority fee per gas
+	ReplaceAfter time.Duration // Time without a receipt after which a transaction is sent again with higher fees
+}
+
+// OutboundTxHook applies a change of an outbound transaction to the records that reference it, in the database
+// transaction storing the change. previousHash is the hash those records hold, which differs from otx.TxHash
+// after a replacement.
+type OutboundTxHook func(db *gorm.DB, otx *OutboundTx, previousHash string) error
+
+// TxManager sends the broker transactions of a network from a persistent queue. It assigns nonces, sets EIP-1559
+// fees within the configured caps, replaces transactions that stay unmined, and follows them until they are mined.
+type TxManager struct {
+	db        *gorm.DB
+	client    ethBackend
+	opts      *bind.TransactOpts // Only From and Signer are used
+	chainID   *big.Int
+	networkID string
+	cfg       TxConfig
+	hooks     map[string]OutboundTxHook
+
+	mu     sync.Mutex // Serializes nonce assignment and processing
+	notify chan struct{}
+}
+
+// NewTxManager creates the transaction manager of a network
+func NewTxManager(db *gorm.DB, client ethBackend, opts *bind.TransactOpts, chainID *big.Int, networkID string, cfg TxConfig) *TxManager {
+	return &TxManager{
+		db:        db,
+		client:    client,
+		opts:      opts,
+		chainID:   chainID,
+		networkID: networkID,
+		cfg:       cfg,
+		hooks:     make(map[string]OutboundTxHook),
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// OnUpdate registers the hook applying changes of transactions of a kind: replacement, confirmation and failure
+func (m *TxManager) OnUpdate(kind string, hook OutboundTxHook) {
+	m.hooks[kind] = hook
+}
+
+// Enqueue stores a transaction to be sent by the next processing round, in db which may be an open transaction
+func (m *TxManager) Enqueue(db *gorm.DB, kind, reference string, to common.Address, data []byte) (*OutboundTx, error) {
+	otx := &OutboundTx{
+		NetworkID: m.networkID,
+		Kind:      kind,
+		Reference: reference,
+		From:      m.opts.From.Hex(),
+		To:        to.Hex(),
+		Data:      hexutil.Encode(data),
+		TxHashes:  pq.StringArray{},
+		Status:    OutboundTxQueued,
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(otx).Error; err != nil {
+		return nil, fmt.Errorf("failed to queue %s transaction: %w", kind, err)
+	}
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+	return otx, nil
+}
+
+// Send queues a transaction and signs it right away. Once signed it is kept and retried until mined,
+// so an error means it was not signed and was marked failed, and the caller may try again.
+func (m *TxManager) Send(ctx context.Context, kind, reference string, to common.Address, data []byte) (*OutboundTx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	otx, err := m.Enqueue(m.db, kind, reference, to, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.submit(ctx, otx); err != nil {
+		if otx.Status == OutboundTxQueued {
+			if err := m.fail(otx, err.Error()); err != nil {
+				log.Printf("Error marking %s transaction %d failed: %v", kind, otx.ID, err)
+			}
+		}
+		return otx, err
+	}
+	if otx.Status == OutboundTxFailed {
+		return otx, errors.New(otx.Error)
+	}
+	return otx, nil
+}
+
+// ProcessPeriodically processes the queue every interval, or sooner when a transaction is queued, until ctx is done
+func (m *TxManager) ProcessPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Process(ctx); err != nil {
+			log.Printf("Error processing outbound transactions on network %s: %v", m.networkID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.notify:
+		}
+	}
+}
+
+// Process checks the receipts of pending transactions, replaces the stuck ones, and sends the queued ones
+func (m *TxManager) Process(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []OutboundTx
+	err := m.db.Where("network_id = ? AND from_address = ? AND status = ?", m.networkID, m.opts.From.Hex(), OutboundTxPending).
+		Order("nonce").Find(&pending).Error
+	if err != nil {
+		return fmt.Errorf("failed to read pending transactions: %w", err)
+	}
+	for i := range pending {
+		if err := m.track(ctx, &pending[i]); err != nil {
+			return err
+		}
+	}
+
+	var queued []OutboundTx
+	err = m.db.Where("network_id = ? AND from_address = ? AND status = ?", m.networkID, m.opts.From.Hex(), OutboundTxQueued).
+		Order("id").Find(&queued).Error
+	if err != nil {
+		return fmt.Errorf("failed to read queued transactions: %w", err)
+	}
+	for i := range queued {
+		if err := m.submit(ctx, &queued[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submit signs a queued transaction with the next nonce and sends it. It returns an error if the transaction
+// should be tried again later, and marks it failed if it cannot succeed.
+func (m *TxManager) submit(ctx context.Context, otx *OutboundTx) error {
+	data, err := hexutil.Decode(otx.Data)
+	if err != nil {
+		return m.fail(otx, fmt.Sprintf("invalid calldata: %v", err))
+	}
+	to := common.HexToAddress(otx.To)
+
+	gas, err := m.client.EstimateGas(ctx, ethereum.CallMsg{From: m.opts.From, To: &to, Data: data})
+	if err != nil {
+		if isRejection(ctx, err) {
+			return m.fail(otx, fmt.Sprintf("gas estimation failed: %v", err))
+		}
+		return fmt.Errorf("failed to estimate gas of %s transaction %d: %w", otx.Kind, otx.ID, err)
+	}
+	tipCap, feeCap, err := m.fees(ctx, nil)
+	if err != nil {
+		return err
+	}
+	nonce, err := m.nextNonce(ctx)
+	if err != nil {
+		return err
+	}
+
+	otx.Nonce = &nonce
+	otx.GasLimit = gas + gas*txGasLimitMargin/100
+	signed, err := m.sign(otx, data, tipCap, feeCap)
+	if err != nil {
+		return err
+	}
+	otx.Status = OutboundTxPending
+	return m.broadcast(ctx, otx, signed, "")
+}
+
+// track checks whether a pending transaction was mined, and replaces it once it has been pending too long
+func (m *TxManager) track(ctx context.Context, otx *OutboundTx) error {
+	// Read before the receipts, so that a version mined in between is not taken for another transaction
+	mined, err := m.client.NonceAt(ctx, m.opts.From, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	for _, hash := range otx.TxHashes {
+		receipt, err := m.client.TransactionReceipt(ctx, common.HexToHash(hash))
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get receipt of %s: %w", hash, err)
+		}
+
+		previousHash := otx.TxHash
+		otx.TxHash = hash
+		otx.BlockNumber = receipt.BlockNumber.Uint64()
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			otx.Status = OutboundTxConfirmed
+			otx.Error = ""
+		} else {
+			otx.Status = OutboundTxFailed
+			otx.Error = "transaction reverted"
+		}
+		return m.save(otx, previousHash)
+	}
+
+	// Without a receipt for any version, a mined nonce means another transaction took its place
+	if mined > *otx.Nonce {
+		return m.fail(otx, "nonce used by another transaction")
+	}
+
+	if otx.SentAt != nil && time.Since(*otx.SentAt) < m.cfg.ReplaceAfter {
+		return nil
+	}
+	return m.replace(ctx, otx)
+}
+
+// replace sends a stuck transaction again with the same nonce and higher fees. At the fee caps, the
+// signed transaction is only broadcast again.
+func (m *TxManager) replace(ctx context.Context, otx *OutboundTx) error {
+	tipCap, feeCap, err := m.fees(ctx, otx)
+	if err != nil {
+		return err
+	}
+	if tipCap.Cmp(otx.GasTipCap.Big()) <= 0 && feeCap.Cmp(otx.GasFeeCap.Big()) <= 0 {
+		raw, err := hexutil.Decode(otx.RawTx)
+		if err != nil {
+			return fmt.Errorf("invalid raw transaction %d: %w", otx.ID, err)
+		}
+		signed := new(types.Transaction)
+		if err := signed.UnmarshalBinary(raw); err != nil {
+			return fmt.Errorf("invalid raw transaction %d: %w", otx.ID, err)
+		}
+		log.Printf("Rebroadcasting %s transaction %s on network %s at the fee cap", otx.Kind, otx.TxHash, m.networkID)
+		return m.broadcast(ctx, otx, signed, otx.TxHash)
+	}
+
+	data, err := hexutil.Decode(otx.Data)
+	if err != nil {
+		return m.fail(otx, fmt.Sprintf("invalid calldata: %v", err))
+	}
+	previousHash := otx.TxHash
+	signed, err := m.sign(otx, data, tipCap, feeCap)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replacing stuck %s transaction %s on network %s with %s", otx.Kind, previousHash, m.networkID, otx.TxHash)
+	return m.broadcast(ctx, otx, signed, previousHash)
+}
+
+// sign signs a new version of the transaction with the given fees and records it
+func (m *TxManager) sign(otx *OutboundTx, data []byte, tipCap, feeCap *big.Int) (*types.Transaction, error) {
+	to := common.HexToAddress(otx.To)
+	signed, err := m.opts.Signer(m.opts.From, types.NewTx(&types.DynamicFeeTx{
+		ChainID:   m.chainID,
+		Nonce:     *otx.Nonce,
+		GasTipCap: tipCap,
+		GasFeeCap: feeCap,
+		Gas:       otx.GasLimit,
+		To:        &to,
+		Data:      data,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s transaction %d: %w", otx.Kind, otx.ID, err)
+	}
+	raw, err := signed.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s transaction %d: %w", otx.Kind, otx.ID, err)
+	}
+
+	otx.GasTipCap, _ = NewAmountFromBig(tipCap)
+	otx.GasFeeCap, _ = NewAmountFromBig(feeCap)
+	otx.TxHash = signed.Hash().Hex()
+	otx.TxHashes = append(otx.TxHashes, otx.TxHash)
+	otx.RawTx = hexutil.Encode(raw)
+	return signed, nil
+}
+
+// broadcast stores a signed version of the transaction before sending it, so that it is tracked even if sending fails.
+// The node rejecting it is left to tracking: the nonce may have been used, or an earlier version may already be known.
+func (m *TxManager) broadcast(ctx context.Context, otx *OutboundTx, signed *types.Transaction, previousHash string) error {
+	now := time.Now()
+	otx.SentAt = &now
+	otx.Attempts++
+	if err := m.save(otx, previousHash); err != nil {
+		return err
+	}
+
+	if err := m.client.SendTransaction(ctx, signed); err != nil {
+		log.Printf("Error sending %s transaction %s on network %s: %v", otx.Kind, otx.TxHash, m.networkID, err)
+	}
+	return nil
+}
+
+// fail marks a transaction failed with the reason
+func (m *TxManager) fail(otx *OutboundTx, reason string) error {
+	log.Printf("%s transaction %d for %s failed on network %s: %s", otx.Kind, otx.ID, otx.Reference, m.networkID, reason)
+	otx.Status = OutboundTxFailed
+	otx.Error = reason
+	return m.save(otx, otx.TxHash)
+}
+
+// save stores the transaction and applies the change to the records referencing it
+func (m *TxManager) save(otx *OutboundTx, previousHash string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(otx).Error; err != nil {
+			return fmt.Errorf("failed to save %s transaction %d: %w", otx.Kind, otx.ID, err)
+		}
+		if hook, ok := m.hooks[otx.Kind]; ok {
+			if err := hook(tx, otx, previousHash); err != nil {
+				return fmt.Errorf("failed to apply %s transaction %d: %w", otx.Kind, otx.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// nextNonce returns the nonce after both the pending transactions of the node and those stored, which the node may have dropped
+func (m *TxManager) nextNonce(ctx context.Context) (uint64, error) {
+	nonce, err := m.client.PendingNonceAt(ctx, m.opts.From)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending nonce: %w", err)
+	}
+
+	var stored *uint64
+	err = m.db.Model(&OutboundTx{}).
+		Where("network_id = ? AND from_address = ? AND status IN ?", m.networkID, m.opts.From.Hex(), []OutboundTxStatus{OutboundTxPending, OutboundTxConfirmed}).
+		Select("MAX(nonce)").Scan(&stored).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stored nonces: %w", err)
+	}
+	if stored != nil && *stored+1 > nonce {
+		nonce = *stored + 1
+	}
+	return nonce, nil
+}
+
+// fees returns the priority fee and fee cap of a transaction: twice the base fee plus the suggested tip, raised by
+// txFeeBump percent over previous when replacing it, and limited to the configured caps
+func (m *TxManager) fees(ctx context.Context, previous *OutboundTx) (*big.Int, *big.Int, error) {
+	tipCap, err := m.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to suggest gas tip: %w", err)
+	}
+	head, err := m.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get latest block: %w", err)
+	}
+	if head.BaseFee == nil {
+		return nil, nil, fmt.Errorf("network %s does not support EIP-1559 transactions", m.networkID)
+	}
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tipCap)
+
+	if previous != nil {
+		tipCap = maxBig(tipCap, bump(previous.GasTipCap.Big()))
+		feeCap = maxBig(feeCap, bump(previous.GasFeeCap.Big()))
+	}
+	if m.cfg.MaxTipCap != nil {
+		tipCap = minBig(tipCap, m.cfg.MaxTipCap)
+	}
+	if m.cfg.MaxFeeCap != nil {
+		feeCap = minBig(feeCap, m.cfg.MaxFeeCap)
+	}
+	return minBig(tipCap, feeCap), feeCap, nil
+}
+
+// bump raises a fee by txFeeBump percent, rounding up
+func bump(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+txFeeBump))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+func minBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return a
+	}
+	return b
+}
+
+func maxBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) > 0 {
+		return a
+	}
+	return b
+}
+
+// isRejection reports whether the node refused a request, such as a call that reverts, rather than failing to answer it
+func isRejection(ctx context.Context, err error) bool {
+	var rpcErr rpc.Error
+	return ctx.Err() == nil && errors.As(err, &rpcErr)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// revertingCode deploys a contract that reverts every call
+var revertingCode = common.FromHex("0x6005600c60003960056000f3" + "60006000fd")
+
+// TestTxManager tests that broker transactions get consecutive nonces, are replaced when stuck,
+// and report their outcome to the records referencing them
+func TestTxManager(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	sim := simulated.NewBackend(types.GenesisAlloc{from: {Balance: big.NewInt(params.Ether)}})
+	defer sim.Close()
+	client := sim.Client()
+	ctx := context.Background()
+
+	chainID, err := client.ChainID(ctx)
+	require.NoError(t, err)
+	opts, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	require.NoError(t, err)
+
+	// The reverting contract is deployed outside of the manager, which takes the next nonce
+	deployment, err := opts.Signer(from, types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     0,
+		GasTipCap: big.NewInt(params.GWei),
+		GasFeeCap: big.NewInt(10 * params.GWei),
+		Gas:       100000,
+		Data:      revertingCode,
+	}))
+	require.NoError(t, err)
+	require.NoError(t, client.SendTransaction(ctx, deployment))
+	sim.Commit()
+	receipt, err := client.TransactionReceipt(ctx, deployment.Hash())
+	require.NoError(t, err)
+	reverting := receipt.ContractAddress
+	sink := common.HexToAddress("0x5111100000000000000000000000000000000001")
+
+	maxFee := big.NewInt(100 * params.GWei)
+	m := NewTxManager(db, client, opts, chainID, chainID.String(), TxConfig{MaxFeeCap: maxFee, MaxTipCap: maxFee, ReplaceAfter: time.Hour})
+	m.OnUpdate(TxKindJoin, applyJoinTx)
+	m.OnUpdate(TxKindCheckpoint, applyCheckpointTx)
+
+	// A join that would revert fails without using a nonce, and marks its channel
+	require.NoError(t, CreateChannel(db, "0xfailed", "0xParticipant", 1, "0xAdjudicator", chainID.String(), "0xUSDC", NewAmount(100)))
+	require.NoError(t, CreateChannel(db, "0xjoined", "0xParticipant", 2, "0xAdjudicator", chainID.String(), "0xUSDC", NewAmount(100)))
+	failedJoin, err := m.Enqueue(db, TxKindJoin, "0xfailed", reverting, []byte{0x01})
+	require.NoError(t, err)
+	join, err := m.Enqueue(db, TxKindJoin, "0xjoined", sink, []byte{0x02})
+	require.NoError(t, err)
+	require.NoError(t, m.Process(ctx))
+
+	require.NoError(t, db.First(failedJoin, failedJoin.ID).Error)
+	assert.Equal(t, OutboundTxFailed, failedJoin.Status)
+	assert.Contains(t, failedJoin.Error, "gas estimation failed")
+	assert.Nil(t, failedJoin.Nonce)
+	channel, err := GetChannelByID(db, "0xfailed")
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusJoinFailed, channel.Status)
+
+	require.NoError(t, db.First(join, join.ID).Error)
+	assert.Equal(t, OutboundTxPending, join.Status)
+	require.NotNil(t, join.Nonce)
+	assert.Equal(t, uint64(1), *join.Nonce)
+	assert.LessOrEqual(t, join.GasFeeCap.Big().Cmp(maxFee), 0)
+
+	sim.Commit()
+	require.NoError(t, m.Process(ctx))
+	require.NoError(t, db.First(join, join.ID).Error)
+	assert.Equal(t, OutboundTxConfirmed, join.Status)
+	assert.NotZero(t, join.BlockNumber)
+	channel, err = GetChannelByID(db, "0xjoined")
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusJoining, channel.Status)
+
+	// A stuck checkpoint is replaced with higher fees, and its challenge response follows the new hash
+	checkpoint, err := m.Send(ctx, TxKindCheckpoint, "0xjoined", sink, []byte{0x03})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), *checkpoint.Nonce)
+	response := &ChallengeResponse{ChannelID: "0xjoined", NetworkID: chainID.String(), ChallengeTxHash: "0xchallenge", Expiration: time.Now().Add(time.Hour), Status: ChallengeResponseSubmitted, TxHash: checkpoint.TxHash}
+	require.NoError(t, db.Create(response).Error)
+
+	m.cfg.ReplaceAfter = time.Nanosecond
+	require.NoError(t, m.Process(ctx))
+	replaced := &OutboundTx{}
+	require.NoError(t, db.First(replaced, checkpoint.ID).Error)
+	require.Len(t, replaced.TxHashes, 2)
+	assert.NotEqual(t, checkpoint.TxHash, replaced.TxHash)
+	assert.Equal(t, *checkpoint.Nonce, *replaced.Nonce)
+	assert.GreaterOrEqual(t, replaced.GasTipCap.Big().Cmp(bump(checkpoint.GasTipCap.Big())), 0)
+	assert.GreaterOrEqual(t, replaced.GasFeeCap.Big().Cmp(bump(checkpoint.GasFeeCap.Big())), 0)
+	require.NoError(t, db.First(response, response.ID).Error)
+	assert.Equal(t, replaced.TxHash, response.TxHash)
+
+	m.cfg.ReplaceAfter = time.Hour
+	sim.Commit()
+	require.NoError(t, m.Process(ctx))
+	require.NoError(t, db.First(replaced, checkpoint.ID).Error)
+	assert.Equal(t, OutboundTxConfirmed, replaced.Status)
+
+	// A transaction whose nonce is taken by another one fails, and its challenge response is submitted again
+	checkpoint, err = m.Send(ctx, TxKindCheckpoint, "0xjoined", sink, []byte{0x04})
+	require.NoError(t, err)
+	require.NoError(t, db.Model(response).Updates(map[string]any{"tx_hash": checkpoint.TxHash, "status": ChallengeResponseSubmitted}).Error)
+	other, err := opts.Signer(from, types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     *checkpoint.Nonce,
+		GasTipCap: big.NewInt(50 * params.GWei),
+		GasFeeCap: big.NewInt(90 * params.GWei),
+		Gas:       21000,
+		To:        &sink,
+	}))
+	require.NoError(t, err)
+	require.NoError(t, client.SendTransaction(ctx, other))
+	sim.Commit()
+
+	require.NoError(t, m.Process(ctx))
+	require.NoError(t, db.First(checkpoint, checkpoint.ID).Error)
+	assert.Equal(t, OutboundTxFailed, checkpoint.Status)
+	assert.Equal(t, "nonce used by another transaction", checkpoint.Error)
+	require.NoError(t, db.First(response, response.ID).Error)
+	assert.Equal(t, ChallengeResponseFailed, response.Status)
+}
+
+// TestTxFeeCaps tests that fees never exceed the caps, even when replacing a transaction
+func TestTxFeeCaps(t *testing.T) {
+	sim := simulated.NewBackend(types.GenesisAlloc{})
+	defer sim.Close()
+
+	tipCap := big.NewInt(params.GWei / 100000)
+	feeCap := big.NewInt(params.GWei)
+	m := &TxManager{client: sim.Client(), networkID: "1337", cfg: TxConfig{MaxFeeCap: feeCap, MaxTipCap: tipCap}}
+
+	tip, fee, err := m.fees(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, tipCap, tip)
+	assert.LessOrEqual(t, fee.Cmp(feeCap), 0)
+
+	previous := &OutboundTx{GasTipCap: NewAmount(params.GWei / 100000), GasFeeCap: NewAmount(params.GWei)}
+	tip, fee, err = m.fees(context.Background(), previous)
+	require.NoError(t, err)
+	assert.Equal(t, tipCap, tip)
+	assert.Equal(t, feeCap, fee)
+}
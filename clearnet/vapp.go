@@ -22,6 +22,9 @@ type VApp struct {
 	Version      uint64         `gorm:"column:version;default:1"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
+
+	// FundingChannels are the channels that funded the session, in the order of participants
+	FundingChannels pq.StringArray `gorm:"type:text[];column:funding_channels"`
 }
 
 // TableName specifies the table name for the Virtual App model
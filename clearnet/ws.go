@@ -20,6 +20,7 @@ import (
 type UnifiedWSHandler struct {
 	signer        *Signer
 	ledger        *Ledger
+	fees          *FeeSchedule
 	upgrader      websocket.Upgrader
 	connections   map[string]*websocket.Conn
 	connectionsMu sync.RWMutex
@@ -31,12 +32,14 @@ type UnifiedWSHandler struct {
 func NewUnifiedWSHandler(
 	signer *Signer,
 	ledger *Ledger,
+	fees *FeeSchedule,
 	metrics *Metrics,
 	rpcStore *RPCStore,
 ) *UnifiedWSHandler {
 	return &UnifiedWSHandler{
 		signer: signer,
 		ledger: ledger,
+		fees:   fees,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -213,13 +216,53 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 
 		case "get_ledger_balances":
-			rpcResponse, handlerErr = HandleGetLedgerBalances(&rpcRequest, h.ledger)
+			rpcResponse, handlerErr = HandleGetLedgerBalances(&rpcRequest, h.ledger, address)
 			if handlerErr != nil {
 				log.Printf("Error handling get_ledger_balances: %v", handlerErr)
 				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to get ledger balances: "+handlerErr.Error())
 				continue
 			}
 
+		case "get_ledger_entries":
+			rpcResponse, handlerErr = HandleGetLedgerEntries(&rpcRequest, h.ledger, address)
+			if handlerErr != nil {
+				log.Printf("Error handling get_ledger_entries: %v", handlerErr)
+				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to get ledger entries: "+handlerErr.Error())
+				continue
+			}
+
+		case "get_state_proof":
+			rpcResponse, handlerErr = HandleGetStateProof(&rpcRequest, h.ledger, address)
+			if handlerErr != nil {
+				log.Printf("Error handling get_state_proof: %v", handlerErr)
+				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to get state proof: "+handlerErr.Error())
+				continue
+			}
+
+		case "get_liability_proof":
+			rpcResponse, handlerErr = HandleGetLiabilityProof(&rpcRequest, h.ledger, address)
+			if handlerErr != nil {
+				log.Printf("Error handling get_liability_proof: %v", handlerErr)
+				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to get liability proof: "+handlerErr.Error())
+				continue
+			}
+
+		case "get_channel_states":
+			rpcResponse, handlerErr = HandleGetChannelStates(&rpcRequest, h.ledger, address)
+			if handlerErr != nil {
+				log.Printf("Error handling get_channel_states: %v", handlerErr)
+				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to get channel states: "+handlerErr.Error())
+				continue
+			}
+
+		case "countersign_state":
+			rpcResponse, handlerErr = HandleCountersignState(&rpcRequest, h.ledger, address)
+			if handlerErr != nil {
+				log.Printf("Error handling countersign_state: %v", handlerErr)
+				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to countersign state: "+handlerErr.Error())
+				continue
+			}
+
 		case "get_app_definition":
 			rpcResponse, handlerErr = HandleGetAppDefinition(&rpcRequest, h.ledger)
 			if handlerErr != nil {
@@ -229,7 +272,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 
 		case "create_app_session":
-			rpcResponse, handlerErr = HandleCreateApplication(&rpcRequest, h.ledger)
+			rpcResponse, handlerErr = HandleCreateApplication(&rpcRequest, h.ledger, h.fees, address)
 			if handlerErr != nil {
 				log.Printf("Error handling create_app_session: %v", handlerErr)
 				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to create application: "+handlerErr.Error())
@@ -237,7 +280,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 
 		case "close_app_session":
-			rpcResponse, handlerErr = HandleCloseApplication(&rpcRequest, h.ledger)
+			rpcResponse, handlerErr = HandleCloseApplication(&rpcRequest, h.ledger, h.fees, address)
 			if handlerErr != nil {
 				log.Printf("Error handling close_app_session: %v", handlerErr)
 				h.sendErrorResponse(address, &rpcRequest.Req, rpcRequest.Sig, conn, "Failed to close application: "+handlerErr.Error())
@@ -328,7 +371,7 @@ func forwardMessage(appID string, rpcData RPCData, signatures []string, msg []by
 		participants = vApp.Participants
 
 		// TODO: we currently skip intent as in current rpc it is not securely signed.
-		intent := []int64{}
+		intent := []Amount{}
 		// Update ledger with the new intent if present
 		if len(intent) != 0 {
 			participantWeights := make(map[string]int64, len(vApp.Participants))
@@ -352,31 +395,34 @@ func forwardMessage(appID string, rpcData RPCData, signatures []string, msg []by
 				return errors.New("Invalid intent length")
 			}
 
-			var totalIntent int64 = 0
+			var totalIntent Amount
 			for _, value := range intent {
-				totalIntent += value
+				totalIntent = totalIntent.Add(value)
 			}
-			if totalIntent != 0 {
+			if !totalIntent.IsZero() {
 				return errors.New("Invalid intent: sum of all intents must be 0")
 			}
 
-			participantsBalances, err := GetAccountBalances(tx, appID)
+			participantsBalances, err := GetAccountBalances(tx, appID, vApp.Token)
 			if err != nil {
 				return errors.New("Failed to get participant balance: " + err.Error())
 			}
 
 			for i, participantBalance := range participantsBalances {
-				if participantBalance.Amount+intent[i] < 0 {
+				if participantBalance.Amount.Add(intent[i]).Sign() < 0 {
 					return errors.New("Invalid intent: insufficient balance for participant " + participantBalance.Address)
 				}
 			}
 
 			// Iterate over participants to keep same order with intent
+			ledgerTx := &Ledger{db: tx}
+			var postings []Posting
 			for i, participant := range participants {
-				account := h.ledger.SelectBeneficiaryAccount(appID, participant)
-				if err := account.Record(intent[i]); err != nil {
-					return errors.New("Failed to record intent: " + err.Error())
-				}
+				account := ledgerTx.SelectBeneficiaryAccount(appID, participant, vApp.Token)
+				postings = append(postings, Posting{Account: account, Amount: intent[i]})
+			}
+			if _, err := ledgerTx.Post(TransactionKindAppTransfer, RPCReference(fromAddress, rpcData.RequestID), postings...); err != nil {
+				return errors.New("Failed to record intent: " + err.Error())
 			}
 
 			// Update the virtual app version in the database